@@ -5,14 +5,24 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-playground/validator/v10"
 	_ "github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	pb "github.com/yosupo06/library-checker-judge/api/proto"
 )
@@ -79,7 +89,7 @@ func (s *server) UserInfo(ctx context.Context, in *pb.UserInfoRequest) (*pb.User
 	if err != nil {
 		return nil, errors.New("invalid user name")
 	}
-	stats, err := fetchUserStatistics(s.db, name)
+	stats, err := fetchUserStatistics(s.visibleSubmissions(ctx, s.db), name)
 	if err != nil {
 		return nil, errors.New("failed to fetch statistics")
 	}
@@ -94,9 +104,16 @@ func (s *server) UserInfo(ctx context.Context, in *pb.UserInfoRequest) (*pb.User
 		respUser.Email = ""
 	}
 
+	hacksFound, err := fetchHacksFound(s.visibleSubmissions(ctx, s.db), name)
+	if err != nil {
+		return nil, err
+	}
+
 	resp := &pb.UserInfoResponse{
-		IsAdmin: user.Admin,
-		User:    respUser,
+		IsAdmin:     user.Admin,
+		User:        respUser,
+		SolvedCount: int32(len(stats)),
+		HacksFound:  hacksFound,
 	}
 	resp.SolvedMap = make(map[string]pb.SolvedStatus)
 	for key, value := range stats {
@@ -105,14 +122,90 @@ func (s *server) UserInfo(ctx context.Context, in *pb.UserInfoRequest) (*pb.User
 	return resp, nil
 }
 
+func (s *server) UserInfoBatch(ctx context.Context, in *pb.UserInfoBatchRequest) (*pb.UserInfoBatchResponse, error) {
+	if 100 < len(in.Names) {
+		return nil, errors.New("too many names")
+	}
+	res := &pb.UserInfoBatchResponse{}
+	if len(in.Names) == 0 {
+		return res, nil
+	}
+	users := []User{}
+	if err := s.db.Select("name, admin, library_url").Where("name in ?", in.Names).Find(&users).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to get users")
+	}
+	counts, err := fetchSolvedCounts(s.visibleSubmissions(ctx, s.db), in.Names)
+	if err != nil {
+		return nil, err
+	}
+	userMap := make(map[string]User)
+	for _, user := range users {
+		userMap[user.Name] = user
+	}
+	for _, name := range in.Names {
+		user, ok := userMap[name]
+		if !ok {
+			continue
+		}
+		res.Users = append(res.Users, &pb.UserProfile{
+			User: &pb.User{
+				Name:       user.Name,
+				IsAdmin:    user.Admin,
+				LibraryUrl: user.LibraryURL,
+			},
+			SolvedCount: counts[user.Name],
+		})
+	}
+	return res, nil
+}
+
+func (s *server) HasSolved(ctx context.Context, in *pb.HasSolvedRequest) (*pb.HasSolvedResponse, error) {
+	if in.User == "" {
+		return nil, errors.New("empty user name")
+	}
+	if in.Problem == "" {
+		return nil, errors.New("empty problem name")
+	}
+	// unpublished problems are not solved by anyone, as well as unknown problems
+	if err := s.visibleProblems(ctx, s.db).Select("name").Where("name = ?", in.Problem).Take(&Problem{}).Error; err != nil {
+		return &pb.HasSolvedResponse{}, nil
+	}
+	solved, err := hasSolved(s.db, in.User, in.Problem)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HasSolvedResponse{
+		Solved: solved,
+	}, nil
+}
+
+func (s *server) UserSolveTimeline(ctx context.Context, in *pb.UserSolveTimelineRequest) (*pb.UserSolveTimelineResponse, error) {
+	if in.Name == "" {
+		return nil, errors.New("empty user name")
+	}
+	events, err := fetchSolveTimeline(s.visibleSubmissions(ctx, s.db), in.Name)
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.UserSolveTimelineResponse{}
+	for _, event := range events {
+		protoEvent := &pb.SolveEvent{
+			Problem: event.ProblemName,
+		}
+		if event.FirstACTime.Valid {
+			protoEvent.FirstAcTime = timestamppb.New(event.FirstACTime.Time)
+		}
+		res.Events = append(res.Events, protoEvent)
+	}
+	return res, nil
+}
+
 func (s *server) UserList(ctx context.Context, in *pb.UserListRequest) (*pb.UserListResponse, error) {
 	currentUserName := getCurrentUserName(ctx)
 	currentUser, _ := fetchUser(s.db, currentUserName)
-	if currentUser.Name == "" {
-		return nil, errors.New("not login")
-	}
 	if !currentUser.Admin {
-		return nil, errors.New("must be admin")
+		return nil, permissionError(currentUser)
 	}
 	users := []User{}
 	if err := s.db.Select("name, admin").Find(&users).Error; err != nil {
@@ -138,15 +231,39 @@ func (s *server) ChangeUserInfo(ctx context.Context, in *pb.ChangeUserInfoReques
 	currentUser, _ := fetchUser(s.db, currentUserName)
 
 	if currentUser.Name == "" {
-		return nil, errors.New("not login")
+		return nil, errNotLoggedIn
 	}
 	if name == "" {
 		return nil, errors.New("requested name is empty")
 	}
 	if name != currentUser.Name && !currentUser.Admin {
-		return nil, errors.New("permission denied")
+		return nil, errPermissionDenied
+	}
+
+	// proto field name -> db column
+	fieldColumns := map[string]string{
+		"is_admin":    "admin",
+		"email":       "email",
+		"library_url": "library_url",
+	}
+	updateFields := in.UpdateFields
+	if len(updateFields) == 0 {
+		updateFields = []string{"is_admin", "email", "library_url"}
+	}
+	var columns []string
+	updateAdmin := false
+	for _, field := range updateFields {
+		column, ok := fieldColumns[field]
+		if !ok {
+			return nil, errors.New("unknown field: " + field)
+		}
+		columns = append(columns, column)
+		if column == "admin" {
+			updateAdmin = true
+		}
 	}
-	if name == currentUser.Name && currentUser.Admin && !in.User.IsAdmin {
+
+	if updateAdmin && name == currentUser.Name && currentUser.Admin && !in.User.IsAdmin {
 		return nil, errors.New("cannot remove myself from admin group")
 	}
 
@@ -163,29 +280,246 @@ func (s *server) ChangeUserInfo(ctx context.Context, in *pb.ChangeUserInfoReques
 		Admin:      in.User.IsAdmin,
 		Email:      userInfo.Email,
 		LibraryURL: userInfo.LibraryURL,
-	}); err != nil {
+	}, columns); err != nil {
 		return nil, err
 	}
 
 	return &pb.ChangeUserInfoResponse{}, nil
 }
 
+// statisticsVersionKey is the metadata key of the version of the statistics derived from submissions.
+// RecomputeUserStatistics changes it, and the caches of all servers computed with another version are stale.
+const statisticsVersionKey = "statistics_version"
+
+// fetchStatisticsVersion returns the current version of the statistics, "" if RecomputeUserStatistics has never been called
+func fetchStatisticsVersion(db *gorm.DB) (string, error) {
+	version, err := fetchMetadata(db, statisticsVersionKey)
+	if errors.Is(err, errMetadataNotFound) {
+		return "", nil
+	}
+	return version, err
+}
+
+func (s *server) RecomputeUserStatistics(ctx context.Context, in *pb.RecomputeUserStatisticsRequest) (*pb.RecomputeUserStatisticsResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+
+	var updated int64
+	if in.Name != "" {
+		if _, err := fetchUser(s.db, in.Name); err != nil {
+			return nil, errors.New("invalid user name")
+		}
+		updated = 1
+	} else {
+		if err := s.db.
+			Model(&Submission{}).
+			Where("user_name is not null").
+			Distinct("user_name").
+			Count(&updated).Error; err != nil {
+			log.Print(err)
+			return nil, errors.New("count query failed")
+		}
+	}
+	// statistics of each user are computed from submissions directly, so only the caches derived from them are stale.
+	// They are shared by all users, so they are dropped on all servers even if only a user is specified.
+	if err := setMetadata(s.db, statisticsVersionKey, strconv.FormatInt(time.Now().UnixNano(), 10)); err != nil {
+		return nil, err
+	}
+	log.Printf("recompute user statistics by %v: %v users", currentUserName, updated)
+
+	return &pb.RecomputeUserStatisticsResponse{
+		UpdatedUsers: int32(updated),
+	}, nil
+}
+
+// problemInfoColumns maps the fields of ProblemInfoResponse to the columns of problems
+var problemInfoColumns = map[string]string{
+	"title":                "title",
+	"author":               "author",
+	"excluded_langs":       "excluded_langs",
+	"statement":            "statement",
+	"statement_format":     "statement_format",
+	"time_limit":           "timelimit",
+	"case_version":         "testhash",
+	"case_count":           "case_count",
+	"staging_case_version": "staging_testhash",
+	"staging_case_count":   "staging_case_count",
+	"source_url":           "source_url",
+	"solution_url":         "solution_url",
+	"checker_url":          "checker_url",
+	"generator_url":        "generator_url",
+	"template":             "template",
+	"unpublished":          "unpublished",
+	"editorial_url":        "editorial_url",
+	"editorial_visibility": "editorial_visibility",
+}
+
+// editorial visibilities, who can see the editorial of a problem
+const (
+	editorialVisibilitySolved    = "solved"
+	editorialVisibilityAttempted = "attempted"
+	editorialVisibilityAlways    = "always"
+)
+
+// canViewEditorial returns whether the caller can see the editorial of the problem
+func (s *server) canViewEditorial(ctx context.Context, problem *Problem) (bool, error) {
+	if problem.EditorialVisibility == editorialVisibilityAlways || isJudge(ctx) {
+		return true, nil
+	}
+	currentUser, _ := fetchUser(s.db, getCurrentUserName(ctx))
+	if currentUser.Admin {
+		return true, nil
+	}
+	if currentUser.Name == "" {
+		return false, nil
+	}
+	if problem.EditorialVisibility == editorialVisibilityAttempted {
+		return hasAttempted(s.db, currentUser.Name, problem.Name)
+	}
+	return hasSolved(s.db, currentUser.Name, problem.Name)
+}
+
+// canSeeUnpublished returns whether the caller can see unpublished problems and the submissions to them.
+// Unpublished problems are visible to admins and judges, which judge the submissions of admins to them.
+func (s *server) canSeeUnpublished(ctx context.Context) bool {
+	if isJudge(ctx) {
+		return true
+	}
+	currentUser, _ := fetchUser(s.db, getCurrentUserName(ctx))
+	return currentUser.Admin
+}
+
+// visibleProblems restricts the query of problems to the ones which the caller can see
+func (s *server) visibleProblems(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if s.canSeeUnpublished(ctx) {
+		return db
+	}
+	return db.Where("not unpublished")
+}
+
+// publishedProblemNames is the subquery of the names of the published problems
+func (s *server) publishedProblemNames() *gorm.DB {
+	return s.db.Model(&Problem{}).Select("name").Where("not unpublished")
+}
+
+// visibleSubmissions restricts the query of submissions to the ones to the problems which the caller can see
+func (s *server) visibleSubmissions(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if s.canSeeUnpublished(ctx) {
+		return db
+	}
+	return db.Where("problem_name in (?)", s.publishedProblemNames())
+}
+
 func (s *server) ProblemInfo(ctx context.Context, in *pb.ProblemInfoRequest) (*pb.ProblemInfoResponse, error) {
 	name := in.Name
 	if name == "" {
 		return nil, errors.New("empty problem name")
 	}
+	columns := []string{"name"}
+	if len(in.Fields) == 0 {
+		columns = append(columns, "title", "author", "excluded_langs", "statement", "statement_format", "timelimit", "testhash", "case_count", "staging_testhash", "staging_case_count", "source_url", "solution_url", "checker_url", "generator_url", "template", "unpublished", "editorial_url", "editorial_visibility")
+	}
+	for _, field := range in.Fields {
+		column, ok := problemInfoColumns[field]
+		if !ok {
+			return nil, errors.New("unknown field: " + field)
+		}
+		columns = append(columns, column)
+		if field == "editorial_url" {
+			// needed to decide whether the editorial is visible
+			columns = append(columns, "editorial_visibility")
+		}
+	}
 	var problem Problem
-	if err := s.db.Select("name, title, statement, timelimit, testhash, source_url").Where("name = ?", name).Take(&problem).Error; err != nil {
+	if err := s.visibleProblems(ctx, s.db).Select(columns).Where("name = ?", name).Take(&problem).Error; err != nil {
 		return nil, errors.New("failed to get problem")
 	}
 
-	return &pb.ProblemInfoResponse{
-		Title:       problem.Title,
-		Statement:   problem.Statement,
-		TimeLimit:   float64(problem.Timelimit) / 1000.0,
-		CaseVersion: problem.Testhash,
-		SourceUrl:   problem.SourceUrl,
+	res := &pb.ProblemInfoResponse{
+		Title:               problem.Title,
+		Author:              problem.Author,
+		Statement:           problem.Statement,
+		StatementFormat:     problem.StatementFormat,
+		TimeLimit:           float64(problem.Timelimit) / 1000.0,
+		CaseVersion:         problem.Testhash,
+		CaseCount:           problem.CaseCount,
+		SourceUrl:           problem.SourceUrl,
+		SolutionUrl:         problem.SolutionUrl,
+		CheckerUrl:          problem.CheckerUrl,
+		GeneratorUrl:        problem.GeneratorUrl,
+		Template:            problem.Template,
+		Unpublished:         problem.Unpublished,
+		EditorialVisibility: problem.EditorialVisibility,
+	}
+	if problem.ExcludedLangs != "" {
+		res.ExcludedLangs = strings.Split(problem.ExcludedLangs, ",")
+	}
+	if problem.StagingTesthash != "" {
+		currentUser, _ := fetchUser(s.db, getCurrentUserName(ctx))
+		if currentUser.Admin {
+			res.StagingCaseVersion = problem.StagingTesthash
+			res.StagingCaseCount = problem.StagingCaseCount
+		}
+	}
+	if problem.EditorialUrl != "" {
+		visible, err := s.canViewEditorial(ctx, &problem)
+		if err != nil {
+			return nil, err
+		}
+		if visible {
+			res.EditorialUrl = problem.EditorialUrl
+		} else {
+			res.EditorialHidden = true
+		}
+	}
+	return res, nil
+}
+
+func (s *server) PendingSubmissionCount(ctx context.Context, in *pb.PendingSubmissionCountRequest) (*pb.PendingSubmissionCountResponse, error) {
+	if in.Problem == "" {
+		return nil, errors.New("empty problem name")
+	}
+	count, err := countPendingSubmissions(s.visibleSubmissions(ctx, s.db), in.Problem)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PendingSubmissionCountResponse{
+		Count: int32(count),
+	}, nil
+}
+
+// defaultStatementFormat is the format of statements generated by the problems repository
+const defaultStatementFormat = "html"
+
+// statementContentTypes maps the formats of statements to their content types
+var statementContentTypes = map[string]string{
+	"html":     "text/html; charset=utf-8",
+	"markdown": "text/markdown; charset=utf-8",
+	"latex":    "text/x-tex; charset=utf-8",
+}
+
+func (s *server) ProblemStatementRaw(ctx context.Context, in *pb.ProblemStatementRawRequest) (*pb.ProblemStatementRawResponse, error) {
+	if in.Name == "" {
+		return nil, errors.New("empty problem name")
+	}
+	var problem Problem
+	if err := s.visibleProblems(ctx, s.db).Select("name, statement, statement_format").Where("name = ?", in.Name).Take(&problem).Error; err != nil {
+		return nil, errors.New("failed to get problem")
+	}
+	format := problem.StatementFormat
+	if format == "" {
+		format = defaultStatementFormat
+	}
+	return &pb.ProblemStatementRawResponse{
+		Statement:   []byte(problem.Statement),
+		Format:      format,
+		ContentType: statementContentTypes[format],
 	}, nil
 }
 
@@ -193,7 +527,7 @@ func (s *server) ChangeProblemInfo(ctx context.Context, in *pb.ChangeProblemInfo
 	currentUserName := getCurrentUserName(ctx)
 	currentUser, _ := fetchUser(s.db, currentUserName)
 	if !currentUser.Admin {
-		return nil, errors.New("must be admin")
+		return nil, permissionError(currentUser)
 	}
 	name := in.Name
 	if name == "" {
@@ -203,13 +537,46 @@ func (s *server) ChangeProblemInfo(ctx context.Context, in *pb.ChangeProblemInfo
 	err := s.db.Select("name, title, statement, timelimit").Where("name = ?", name).First(&problem).Error
 	problem.Name = name
 	problem.Title = in.Title
+	problem.Author = in.Author
 	problem.Timelimit = int32(in.TimeLimit * 1000.0)
 	problem.Statement = in.Statement
+	problem.StatementFormat = in.StatementFormat
+	if problem.StatementFormat == "" {
+		problem.StatementFormat = defaultStatementFormat
+	}
+	if _, ok := statementContentTypes[problem.StatementFormat]; !ok {
+		return nil, errors.New("unknown statement format: " + problem.StatementFormat)
+	}
 	problem.Testhash = in.CaseVersion
+	problem.CaseCount = in.CaseCount
+	problem.StagingTesthash = in.StagingCaseVersion
+	problem.StagingCaseCount = in.StagingCaseCount
 	problem.SourceUrl = in.SourceUrl
+	problem.SolutionUrl = in.SolutionUrl
+	problem.CheckerUrl = in.CheckerUrl
+	problem.GeneratorUrl = in.GeneratorUrl
+	problem.Template = in.Template
+	for _, lang := range in.ExcludedLangs {
+		if !s.isKnownLang(lang) {
+			return nil, errors.New("unknown lang: " + lang)
+		}
+	}
+	problem.ExcludedLangs = strings.Join(in.ExcludedLangs, ",")
+	problem.EditorialUrl = in.EditorialUrl
+	// empty visibility keeps the current one, e.g. the deploy script does not send it
+	problem.EditorialVisibility = in.EditorialVisibility
+	switch problem.EditorialVisibility {
+	case "", editorialVisibilitySolved, editorialVisibilityAttempted, editorialVisibilityAlways:
+	default:
+		return nil, errors.New("unknown editorial visibility: " + problem.EditorialVisibility)
+	}
 
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		log.Printf("add problem: %v", name)
+		problem.Unpublished = in.Unpublished
+		if problem.EditorialVisibility == "" {
+			problem.EditorialVisibility = editorialVisibilitySolved
+		}
 		if err := s.db.Create(&problem).Error; err != nil {
 			return nil, errors.New("failed to insert")
 		}
@@ -220,138 +587,564 @@ func (s *server) ChangeProblemInfo(ctx context.Context, in *pb.ChangeProblemInfo
 	if err := s.db.Model(&Problem{}).Where("name = ?", name).Updates(problem).Error; err != nil {
 		return nil, errors.New("failed to update user")
 	}
+	// Updates with struct skips empty values, so the fields which can be cleared are written explicitly
+	if err := s.db.Model(&Problem{}).Where("name = ?", name).Updates(map[string]interface{}{
+		"author":         problem.Author,
+		"source_url":     problem.SourceUrl,
+		"solution_url":   problem.SolutionUrl,
+		"checker_url":    problem.CheckerUrl,
+		"generator_url":  problem.GeneratorUrl,
+		"template":       problem.Template,
+		"excluded_langs": problem.ExcludedLangs,
+		"editorial_url":  problem.EditorialUrl,
+	}).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to update problem")
+	}
 	return &pb.ChangeProblemInfoResponse{}, nil
 }
 
-func (s *server) ProblemList(ctx context.Context, in *pb.ProblemListRequest) (*pb.ProblemListResponse, error) {
-	problems := []Problem{}
-	if err := s.db.Select("name, title").Find(&problems).Error; err != nil {
-		return nil, errors.New("fetch problems failed")
+func (s *server) ChangeProblemPublished(ctx context.Context, in *pb.ChangeProblemPublishedRequest) (*pb.ChangeProblemPublishedResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
 	}
-
-	res := pb.ProblemListResponse{}
-	for _, prob := range problems {
-		res.Problems = append(res.Problems, &pb.Problem{
-			Name:  prob.Name,
-			Title: prob.Title,
-		})
+	result := s.db.Model(&Problem{}).Where("name = ?", in.Name).Update("unpublished", !in.Published)
+	if result.Error != nil {
+		log.Print(result.Error)
+		return nil, errors.New("failed to update problem")
 	}
-	return &res, nil
+	if result.RowsAffected == 0 {
+		return nil, errors.New("unknown problem")
+	}
+	return &pb.ChangeProblemPublishedResponse{}, nil
 }
 
-func (s *server) Submit(ctx context.Context, in *pb.SubmitRequest) (*pb.SubmitResponse, error) {
-	if in.Source == "" {
-		return nil, errors.New("empty Source")
-	}
-	if len(in.Source) > 1024*1024 {
-		return nil, errors.New("too large Source")
+func (s *server) PromoteStagingTestdata(ctx context.Context, in *pb.PromoteStagingTestdataRequest) (*pb.PromoteStagingTestdataResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
 	}
-	ok := false
-	for _, lang := range s.langs {
-		if lang.Id == in.Lang {
-			ok = true
-			break
-		}
+	testhash, err := promoteStagingTestdata(s.db, in.Problem)
+	if err != nil {
+		return nil, err
 	}
-	if !ok {
-		return nil, errors.New("unknown Lang")
+	log.Printf("promote staging testdata: %v %v", in.Problem, testhash)
+	return &pb.PromoteStagingTestdataResponse{
+		CaseVersion: testhash,
+	}, nil
+}
+
+func (s *server) ClearStagingTestdata(ctx context.Context, in *pb.ClearStagingTestdataRequest) (*pb.ClearStagingTestdataResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
 	}
-	if _, err := s.ProblemInfo(ctx, &pb.ProblemInfoRequest{
-		Name: in.Problem,
-	}); err != nil {
-		log.Print(err)
-		return nil, errors.New("unknown problem")
+	if err := clearStagingTestdata(s.db, in.Problem); err != nil {
+		return nil, err
 	}
+	log.Printf("clear staging testdata: %v by %v", in.Problem, currentUserName)
+	return &pb.ClearStagingTestdataResponse{}, nil
+}
+
+func (s *server) ProblemByTesthash(ctx context.Context, in *pb.ProblemByTesthashRequest) (*pb.ProblemByTesthashResponse, error) {
 	currentUserName := getCurrentUserName(ctx)
 	currentUser, _ := fetchUser(s.db, currentUserName)
-	name := currentUser.Name
-	submission := Submission{
-		ProblemName: in.Problem,
-		Lang:        in.Lang,
-		Status:      "WJ",
-		Source:      in.Source,
-		MaxTime:     -1,
-		MaxMemory:   -1,
-		UserName:    sql.NullString{String: name, Valid: name != ""},
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
 	}
-
-	if err := s.db.Create(&submission).Error; err != nil {
-		log.Print(err)
-		return nil, errors.New("Submit failed")
+	if in.Testhash == "" {
+		return nil, errors.New("empty testhash")
 	}
-
-	if err := toWaitingJudge(s.db, submission.ID, 50, time.Duration(0)); err != nil {
+	names := make([]string, 0)
+	if err := s.db.Model(&Problem{}).Where("testhash = ?", in.Testhash).Order("name asc").Pluck("name", &names).Error; err != nil {
 		log.Print(err)
-		return nil, errors.New("inserting to judge queue is failed")
+		return nil, errors.New("failed to fetch problems")
 	}
+	return &pb.ProblemByTesthashResponse{
+		Names: names,
+	}, nil
+}
 
-	log.Println("Submit ", submission.ID)
+const problemSolversCacheTTL = 5 * time.Minute
 
-	return &pb.SubmitResponse{Id: submission.ID}, nil
+// problemSolversCache is the materialized # of distinct solvers of each problem
+type problemSolversCache struct {
+	mu        sync.Mutex
+	fetchedAt time.Time
+	version   string // statistics version
+	counts    map[string]int32
 }
 
-func canRejudge(currentUser User, submission *pb.SubmissionOverview) bool {
-	name := currentUser.Name
-	if name == "" {
-		return false
+func (s *server) fetchProblemSolvers() (map[string]int32, error) {
+	version, err := fetchStatisticsVersion(s.db)
+	if err != nil {
+		return nil, err
 	}
-	if name == submission.UserName {
-		return true
+	s.solversCache.mu.Lock()
+	defer s.solversCache.mu.Unlock()
+	if time.Since(s.solversCache.fetchedAt) < problemSolversCacheTTL && s.solversCache.version == version {
+		return s.solversCache.counts, nil
 	}
-	if !submission.IsLatest && submission.Status == "AC" {
-		return true
+	type Result struct {
+		ProblemName string
+		SolverCount int32
 	}
-	if currentUser.Admin {
-		return true
+	var results = make([]Result, 0)
+	if err := s.db.
+		Model(&Submission{}).
+		Select("problem_name, count(distinct user_name) as solver_count").
+		Where("status = 'AC' and user_name is not null and not staging").
+		Group("problem_name").
+		Find(&results).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed sql query")
 	}
-	return false
+	counts := make(map[string]int32)
+	for _, result := range results {
+		counts[result.ProblemName] = result.SolverCount
+	}
+	s.solversCache.fetchedAt = time.Now()
+	s.solversCache.version = version
+	s.solversCache.counts = counts
+	return counts, nil
 }
 
-func (s *server) SubmissionInfo(ctx context.Context, in *pb.SubmissionInfoRequest) (*pb.SubmissionInfoResponse, error) {
-	currentUserName := getCurrentUserName(ctx)
-	currentUser, _ := fetchUser(s.db, currentUserName)
-	var sub Submission
-	sub, err := fetchSubmission(s.db, in.Id)
-	if err != nil {
-		return nil, err
+func (s *server) ProblemList(ctx context.Context, in *pb.ProblemListRequest) (*pb.ProblemListResponse, error) {
+	if in.Order != "" && in.Order != "name" && in.Order != "solvers_desc" && in.Order != "solvers_asc" {
+		return nil, errors.New("unknown sort order")
 	}
-	var cases []SubmissionTestcaseResult
-	if err := s.db.Where("submission = ?", in.Id).Find(&cases).Error; err != nil {
-		return nil, errors.New("Submission fetch failed")
+	query := s.db.Where("not unpublished")
+	if in.IncludeUnpublished {
+		query = s.visibleProblems(ctx, s.db)
 	}
-	overview, err := toProtoSubmission(&sub)
-	if err != nil {
-		log.Print(err)
-		return nil, err
+	if in.UnattemptedOnly {
+		currentUserName := getCurrentUserName(ctx)
+		if currentUserName == "" {
+			return nil, errNotLoggedIn
+		}
+		query = query.Where("not exists (select 1 from submissions where submissions.problem_name = problems.name and submissions.user_name = ?)", currentUserName)
 	}
-
-	res := &pb.SubmissionInfoResponse{
-		Overview:     overview,
-		Source:       sub.Source,
-		CompileError: sub.CompileError,
-		CanRejudge:   canRejudge(currentUser, overview),
+	problems := []Problem{}
+	if err := query.Select("name, title, unpublished").Order("name asc").Find(&problems).Error; err != nil {
+		return nil, errors.New("fetch problems failed")
 	}
 
-	sort.Slice(cases, func(i, j int) bool {
-		return cases[i].Testcase < cases[j].Testcase
-	})
-
-	for _, c := range cases {
-		res.CaseResults = append(res.CaseResults, &pb.SubmissionCaseResult{
-			Case:   c.Testcase,
-			Status: c.Status,
-			Time:   float64(c.Time) / 1000.0,
-			Memory: int64(c.Memory),
+	res := pb.ProblemListResponse{}
+	for _, prob := range problems {
+		res.Problems = append(res.Problems, &pb.Problem{
+			Name:        prob.Name,
+			Title:       prob.Title,
+			Unpublished: prob.Unpublished,
 		})
 	}
-	return res, nil
-}
 
-func (s *server) SubmissionList(ctx context.Context, in *pb.SubmissionListRequest) (*pb.SubmissionListResponse, error) {
-	if 1000 < in.Limit {
-		in.Limit = 1000
+	if in.Order == "solvers_desc" || in.Order == "solvers_asc" {
+		counts, err := s.fetchProblemSolvers()
+		if err != nil {
+			return nil, err
+		}
+		for _, prob := range res.Problems {
+			prob.SolverCount = counts[prob.Name]
+		}
+		desc := in.Order == "solvers_desc"
+		sort.Slice(res.Problems, func(i, j int) bool {
+			a, b := res.Problems[i], res.Problems[j]
+			if a.SolverCount != b.SolverCount {
+				return (a.SolverCount > b.SolverCount) == desc
+			}
+			return a.Name < b.Name
+		})
+	}
+	return &res, nil
+}
+
+func (s *server) FeaturedProblems(ctx context.Context, in *pb.FeaturedProblemsRequest) (*pb.FeaturedProblemsResponse, error) {
+	problems := []Problem{}
+	if err := s.visibleProblems(ctx, s.db).Select("name, title").Where("featured").Order("featured_order asc, name asc").Find(&problems).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("fetch problems failed")
+	}
+	res := &pb.FeaturedProblemsResponse{}
+	for _, prob := range problems {
+		res.Problems = append(res.Problems, &pb.Problem{
+			Name:  prob.Name,
+			Title: prob.Title,
+		})
+	}
+	return res, nil
+}
+
+func (s *server) ChangeFeaturedProblems(ctx context.Context, in *pb.ChangeFeaturedProblemsRequest) (*pb.ChangeFeaturedProblemsResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Problem{}).Where("featured").Updates(map[string]interface{}{
+			"featured":       false,
+			"featured_order": 0,
+		}).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to update problems")
+		}
+		for i, name := range in.Problems {
+			result := tx.Model(&Problem{}).Where("name = ?", name).Updates(map[string]interface{}{
+				"featured":       true,
+				"featured_order": i,
+			})
+			if result.Error != nil {
+				log.Print(result.Error)
+				return errors.New("failed to update problems")
+			}
+			if result.RowsAffected == 0 {
+				return errors.New("unknown problem: " + name)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &pb.ChangeFeaturedProblemsResponse{}, nil
+}
+
+func (s *server) Submit(ctx context.Context, in *pb.SubmitRequest) (*pb.SubmitResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if getCurrentUserName(ctx) == "" {
+		if s.config.DisableAnonymousSubmission {
+			return nil, status.Error(codes.Unauthenticated, "anonymous submission is disabled, please login")
+		}
+	}
+	return s.submit(ctx, in, true)
+}
+
+// findLang returns the lang of id, or nil if not exists
+func (s *server) findLang(id string) *pb.Lang {
+	for _, lang := range s.langs {
+		if lang.Id == id {
+			return lang
+		}
+	}
+	return nil
+}
+
+func (s *server) isKnownLang(id string) bool {
+	return s.findLang(id) != nil
+}
+
+// sourceHardLimit is the maximum size of a source regardless of ServerConfig.MaxSourceLength
+const sourceHardLimit = 1024 * 1024
+
+// truncateUTF8 returns the longest prefix of s whose size is at most n bytes, without breaking UTF-8 characters
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for 0 < n && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// compileErrorTruncatedSuffix is appended to the truncated compile error
+const compileErrorTruncatedSuffix = "\n... (truncated)"
+
+// truncateCompileError returns the prefix of compileError whose size is at most n bytes, without breaking UTF-8 characters
+func truncateCompileError(compileError []byte, n int) []byte {
+	if len(compileError) <= n {
+		return compileError
+	}
+	if n <= len(compileErrorTruncatedSuffix) {
+		return []byte(truncateUTF8(string(compileError), n))
+	}
+	return []byte(truncateUTF8(string(compileError), n-len(compileErrorTruncatedSuffix)) + compileErrorTruncatedSuffix)
+}
+
+// draftStatus is the status of a submission which is created without judging, it can be judged by Rejudge
+const draftStatus = "Draft"
+
+// submit creates a submission. If judge is false, it is not judged and its status is draftStatus.
+// The response also has the warning to the submitter (e.g. the lang is excluded on the problem) and the remaining quota.
+func (s *server) submit(ctx context.Context, in *pb.SubmitRequest, judge bool) (*pb.SubmitResponse, error) {
+	if in.Source == "" {
+		return nil, errors.New("empty Source")
+	}
+	if len(in.Source) > sourceHardLimit || len(in.Source) > s.config.MaxSourceLength {
+		return nil, errors.New("too large Source")
+	}
+	lang := s.findLang(in.Lang)
+	if lang == nil {
+		return nil, errors.New("unknown Lang")
+	}
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if in.Staging && !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	problem, err := s.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name:   in.Problem,
+		Fields: []string{"template", "excluded_langs", "staging_case_version"},
+	})
+	if err != nil {
+		log.Print(err)
+		return nil, errors.New("unknown problem")
+	}
+	if in.Staging && problem.StagingCaseVersion == "" {
+		return nil, errors.New("problem has no staging testdata")
+	}
+	if problem.Template != "" && isSameIgnoringSpaces(problem.Template, in.Source) {
+		return nil, errors.New("source is the same as the template, please write your solution")
+	}
+	res := &pb.SubmitResponse{
+		RemainingQuota: -1,
+	}
+	for _, lang := range problem.ExcludedLangs {
+		if lang != in.Lang {
+			continue
+		}
+		if s.config.BlockExcludedLangs {
+			return nil, fmt.Errorf("%v is excluded on this problem, it is too slow to pass", in.Lang)
+		}
+		res.Warning = fmt.Sprintf("%v is excluded on this problem, it may be too slow to pass", in.Lang)
+	}
+	name := currentUser.Name
+	now := time.Now()
+	if name != "" && !currentUser.Admin && s.config.DuplicateSubmissionWindow > 0 {
+		latestSourceHash, err := fetchLatestSourceHash(s.db, name, in.Problem, now.Add(-s.config.DuplicateSubmissionWindow))
+		if err != nil {
+			return nil, err
+		}
+		if latestSourceHash == sourceHash(in.Source) {
+			return nil, errors.New("same source was submitted just now, please wait a moment")
+		}
+	}
+	// consumed after the checks above, so that rejected requests do not use up the limit
+	if name == "" && !s.anonymousLimiter.allow(clientIP(ctx, s.config.TrustedIPHeader), now) {
+		return nil, status.Error(codes.ResourceExhausted, "too many anonymous submissions, please login or wait a moment")
+	}
+	submissionStatus := "WJ"
+	if !judge {
+		submissionStatus = draftStatus
+	}
+	submission := Submission{
+		ProblemName:  in.Problem,
+		Lang:         in.Lang,
+		LangVersion:  lang.Version,
+		Status:       submissionStatus,
+		Source:       in.Source,
+		SourceHash:   sourceHash(in.Source),
+		SubmitTime:   now,
+		ClientIPHash: hashIP(s.authTokenManager.hmacKey, clientIP(ctx, s.config.TrustedIPHeader)),
+		MaxTime:      -1,
+		MaxMemory:    -1,
+		UserName:     sql.NullString{String: name, Valid: name != ""},
+		Staging:      in.Staging,
+	}
+
+	// create the submission and enqueue it atomically, not to leave a WJ submission without any task
+	quota := 0
+	if name != "" && !currentUser.Admin {
+		quota = s.config.DailySubmissionQuota
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if quota > 0 {
+			count, ok, err := consumeSubmissionQuota(tx, name, now, quota)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted, "daily submission quota (%d) is exceeded, it is reset at %v",
+					quota, quotaResetTime(now).Format(time.RFC3339))
+			}
+			res.RemainingQuota = int32(quota - count)
+		}
+		if err := tx.Create(&submission).Error; err != nil {
+			log.Print(err)
+			return errors.New("Submit failed")
+		}
+		if judge {
+			if err := toWaitingJudge(tx, submission.ID, s.config.SubmitPriority, time.Duration(0), ""); err != nil {
+				log.Print(err)
+				return errors.New("inserting to judge queue is failed")
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	log.Println("Submit ", submission.ID)
+
+	res.Id = submission.ID
+	return res, nil
+}
+
+func (s *server) CloneSubmission(ctx context.Context, in *pb.CloneSubmissionRequest) (*pb.CloneSubmissionResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if getCurrentUserName(ctx) == "" {
+		return nil, errNotLoggedIn
+	}
+	info, err := s.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: in.Id})
+	if err != nil {
+		return nil, err
+	}
+	lang := info.Overview.Lang
+	if in.Lang != "" {
+		lang = in.Lang
+	}
+	res, err := s.submit(ctx, &pb.SubmitRequest{
+		Problem: info.Overview.ProblemName,
+		Source:  info.Source,
+		Lang:    lang,
+	}, in.Judge)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CloneSubmissionResponse{Id: res.Id}, nil
+}
+
+func isSameIgnoringSpaces(a, b string) bool {
+	return strings.Join(strings.Fields(a), "") == strings.Join(strings.Fields(b), "")
+}
+
+func canRejudge(currentUser User, submission *pb.SubmissionOverview) bool {
+	name := currentUser.Name
+	if name == "" {
+		return false
+	}
+	if name == submission.UserName {
+		return true
+	}
+	if !submission.IsLatest && submission.Status == "AC" {
+		return true
+	}
+	if currentUser.Admin {
+		return true
+	}
+	return false
+}
+
+func (s *server) UserBestSubmission(ctx context.Context, in *pb.UserBestSubmissionRequest) (*pb.UserBestSubmissionResponse, error) {
+	if in.User == "" {
+		return nil, errors.New("empty user name")
+	}
+	if in.Problem == "" {
+		return nil, errors.New("empty problem name")
+	}
+	sub, err := fetchBestSubmission(s.visibleSubmissions(ctx, s.db), in.User, in.Problem)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil {
+		return &pb.UserBestSubmissionResponse{}, nil
+	}
+	overview, err := toProtoSubmission(sub)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+	return &pb.UserBestSubmissionResponse{
+		Submission: overview,
+	}, nil
+}
+
+func (s *server) SubmissionInfo(ctx context.Context, in *pb.SubmissionInfoRequest) (*pb.SubmissionInfoResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	return s.submissionInfo(ctx, currentUser, in)
+}
+
+// submissionInfo returns SubmissionInfoResponse seen by currentUser, the submissions to unpublished problems are not found unless visible
+func (s *server) submissionInfo(ctx context.Context, currentUser User, in *pb.SubmissionInfoRequest) (*pb.SubmissionInfoResponse, error) {
+	var sub Submission
+	sub, err := fetchSubmission(s.visibleSubmissions(ctx, s.db), in.Id)
+	if err != nil {
+		return nil, err
+	}
+	var cases []SubmissionTestcaseResult
+	if err := s.db.Where("submission = ?", in.Id).Find(&cases).Error; err != nil {
+		return nil, errors.New("Submission fetch failed")
+	}
+	overview, err := toProtoSubmission(&sub)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+
+	res := &pb.SubmissionInfoResponse{
+		Overview:     overview,
+		LangVersion:  sub.LangVersion,
+		Source:       sub.Source,
+		CompileError: sub.CompileError,
+		CanRejudge:   canRejudge(currentUser, overview),
+	}
+	if 0 < in.SourceLimit && int(in.SourceLimit) < len(sub.Source) {
+		res.Source = truncateUTF8(sub.Source, int(in.SourceLimit))
+		res.SourceTruncated = true
+	}
+	if currentUser.Admin {
+		res.JudgeName = sub.LastJudgeName
+		res.ClientIpHash = sub.ClientIPHash
+		res.SourceHash = sub.SourceHash
+		res.CompileCache = pb.CompileCacheStatus(sub.CompileCache)
+		if sub.CompileTime.Valid {
+			res.CompileTime = durationpb.New(time.Duration(sub.CompileTime.Int32) * time.Millisecond)
+		}
+	}
+	if sub.JudgeName != "" || sub.Testhash == "" || sub.Testhash == sub.Problem.Testhash {
+		// waiting or in judging, so the cases of the current version are used
+		res.CaseCount = sub.Problem.CaseCount
+	}
+
+	sort.Slice(cases, func(i, j int) bool {
+		return cases[i].Testcase < cases[j].Testcase
+	})
+
+	for _, c := range cases {
+		res.CaseResults = append(res.CaseResults, &pb.SubmissionCaseResult{
+			Case:   c.Testcase,
+			Status: c.Status,
+			Time:   float64(c.Time) / 1000.0,
+			Memory: int64(c.Memory),
+		})
+	}
+	return res, nil
+}
+
+// firstACSubmissionsCond matches the first AC submission of each (user, problem)
+const firstACSubmissionsCond = `id in (
+	select id from (
+		select id, row_number() over (partition by user_name, problem_name order by id) as rn
+		from submissions where status = 'AC' and user_name is not null and not staging
+	) as first_ac where rn = 1)`
+
+// validateSubmissionListFilter checks the ranges of the filters of in, which must be called before submissionListQuery
+func validateSubmissionListFilter(in *pb.SubmissionListRequest) error {
+	if in.MinTime < 0 || in.MaxTime < 0 || (in.MaxTime > 0 && in.MinTime > in.MaxTime) {
+		return errors.New("invalid time range")
+	}
+	if in.MinMemory < 0 || in.MaxMemory < 0 || (in.MaxMemory > 0 && in.MinMemory > in.MaxMemory) {
+		return errors.New("invalid memory range")
+	}
+	if in.WaitingLongerThan != nil && in.WaitingLongerThan.AsDuration() < 0 {
+		return errors.New("negative waiting_longer_than")
 	}
+	return nil
+}
 
+// submissionListQuery returns the query of the submissions matching the filters of in
+func submissionListQuery(db *gorm.DB, in *pb.SubmissionListRequest) *gorm.DB {
 	filter := &Submission{
 		ProblemName: in.Problem,
 		Status:      in.Status,
@@ -359,9 +1152,50 @@ func (s *server) SubmissionList(ctx context.Context, in *pb.SubmissionListReques
 		UserName:    sql.NullString{String: in.User, Valid: (in.User != "")},
 		Hacked:      in.Hacked,
 	}
+	query := db.Model(&Submission{}).Where(filter)
+	if len(in.Langs) > 0 {
+		query = query.Where("lang in ?", in.Langs)
+	}
+	if in.FirstAc {
+		query = query.Where(firstACSubmissionsCond)
+	}
+	if in.MinTime > 0 || in.MaxTime > 0 {
+		query = query.Where("max_time >= ?", int32(in.MinTime*1000))
+	}
+	if in.MaxTime > 0 {
+		query = query.Where("max_time <= ?", int32(in.MaxTime*1000))
+	}
+	if in.MinMemory > 0 || in.MaxMemory > 0 {
+		query = query.Where("max_memory >= ?", in.MinMemory)
+	}
+	if in.MaxMemory > 0 {
+		query = query.Where("max_memory <= ?", in.MaxMemory)
+	}
+	if in.WaitingLongerThan != nil {
+		query = query.Where("status = 'WJ' and coalesce(rejudge_time, submit_time) < ?", time.Now().Add(-in.WaitingLongerThan.AsDuration()))
+	}
+	return query
+}
+
+func (s *server) SubmissionList(ctx context.Context, in *pb.SubmissionListRequest) (*pb.SubmissionListResponse, error) {
+	limit := int(in.Limit)
+	if limit <= 0 {
+		limit = s.config.SubmissionListDefaultLimit
+	}
+	if s.config.SubmissionListMaxLimit < limit {
+		limit = s.config.SubmissionListMaxLimit
+	}
+
+	if err := validateSubmissionListFilter(in); err != nil {
+		return nil, err
+	}
+
+	query := func() *gorm.DB {
+		return submissionListQuery(s.visibleSubmissions(ctx, s.db), in)
+	}
 
 	count := int64(0)
-	if err := s.db.Model(&Submission{}).Where(filter).Count(&count).Error; err != nil {
+	if err := query().Count(&count).Error; err != nil {
 		return nil, errors.New("count query failed")
 	}
 	order := ""
@@ -372,9 +1206,16 @@ func (s *server) SubmissionList(ctx context.Context, in *pb.SubmissionListReques
 	} else {
 		return nil, errors.New("unknown sort order")
 	}
+	if in.BeforeId < 0 || (in.BeforeId > 0 && order != "id desc") {
+		return nil, errors.New("before_id is only available in the -id order")
+	}
 
+	pageQuery := query()
+	if in.BeforeId > 0 {
+		pageQuery = pageQuery.Where("id < ?", in.BeforeId)
+	}
 	var submissions = make([]Submission, 0)
-	if err := s.db.Where(filter).Limit(int(in.Limit)).Offset(int(in.Skip)).
+	if err := pageQuery.Limit(limit).Offset(int(in.Skip)).
 		Preload("User", func(db *gorm.DB) *gorm.DB {
 			return db.Select("name")
 		}).
@@ -398,38 +1239,625 @@ func (s *server) SubmissionList(ctx context.Context, in *pb.SubmissionListReques
 		}
 		res.Submissions = append(res.Submissions, protoSub)
 	}
+	if order == "id desc" && len(submissions) == limit {
+		res.NextBeforeId = submissions[len(submissions)-1].ID
+	}
 	return &res, nil
 }
 
-func (s *server) Rejudge(ctx context.Context, in *pb.RejudgeRequest) (*pb.RejudgeResponse, error) {
-	sub, err := s.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: in.Id})
+func (s *server) SubmissionStatusCounts(ctx context.Context, in *pb.SubmissionStatusCountsRequest) (*pb.SubmissionStatusCountsResponse, error) {
+	filter := in.Filter
+	if filter == nil {
+		filter = &pb.SubmissionListRequest{}
+	}
+	if err := validateSubmissionListFilter(filter); err != nil {
+		return nil, err
+	}
+	type Result struct {
+		Status string
+		Count  int32
+	}
+	var results = make([]Result, 0)
+	if err := submissionListQuery(s.visibleSubmissions(ctx, s.db), filter).
+		Select("status, count(*) as count").
+		Group("status").
+		Order("count desc, status asc").
+		Find(&results).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("count query failed")
+	}
+
+	res := &pb.SubmissionStatusCountsResponse{}
+	for _, result := range results {
+		res.Total += result.Count
+		res.Counts = append(res.Counts, &pb.SubmissionStatusCount{
+			Status: result.Status,
+			Count:  result.Count,
+		})
+	}
+	return res, nil
+}
+
+// activeJudgeWindow is the duration to regard a judge as active since its last PopJudgeTask
+const activeJudgeWindow = time.Minute
+
+func (s *server) SubmissionQueuePosition(ctx context.Context, in *pb.SubmissionQueuePositionRequest) (*pb.SubmissionQueuePositionResponse, error) {
+	sub := Submission{}
+	// the same visibility as SubmissionInfo
+	err := s.visibleSubmissions(ctx, s.db).Select("id, judge_name, judge_ping").Where("id = ?", in.Id).Take(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errSubmissionNotFound
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch submission")
+	}
+	res := &pb.SubmissionQueuePositionResponse{
+		Position: -1,
+	}
+	if currentRegistrationStatus(&sub, "") != Waiting {
+		return res, nil
+	}
+	position, err := fetchQueuePosition(s.db, sub.ID)
+	if err != nil {
+		return nil, err
+	}
+	if position == -1 {
+		return res, nil
+	}
+	judges, err := countActiveJudges(s.db, time.Now().Add(-activeJudgeWindow))
 	if err != nil {
 		return nil, err
 	}
-	if !sub.CanRejudge {
-		return nil, errors.New("no permission")
+	if judges == 0 {
+		judges = 1
+	}
+	res.Position = int32(position)
+	res.EstimatedWait = durationpb.New(time.Duration(position) * s.config.EstimatedJudgeTime / time.Duration(judges))
+	return res, nil
+}
+
+const (
+	recentSubmissionsDefaultLimit = 20
+	recentSubmissionsMaxLimit     = 100
+	recentSubmissionsCacheTTL     = 5 * time.Second
+)
+
+// recentSubmissionsCache holds the latest recentSubmissionsMaxLimit submissions for a short time
+type recentSubmissionsCache struct {
+	mu          sync.Mutex
+	fetchedAt   time.Time
+	submissions []*pb.SubmissionOverview
+}
+
+func (s *server) fetchRecentSubmissions() ([]*pb.SubmissionOverview, error) {
+	s.recentCache.mu.Lock()
+	defer s.recentCache.mu.Unlock()
+	if time.Since(s.recentCache.fetchedAt) < recentSubmissionsCacheTTL {
+		return s.recentCache.submissions, nil
+	}
+
+	var submissions = make([]Submission, 0)
+	// shared by all users, so only the submissions to published problems. Drafts are not judged, so they are not recent submissions.
+	if err := s.db.Where("problem_name in (?) and status <> ?", s.publishedProblemNames(), draftStatus).Limit(recentSubmissionsMaxLimit).
+		Preload("User", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name")
+		}).
+		Preload("Problem", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name, title, testhash")
+		}).
+		Select("id, user_name, problem_name, lang, status, hacked, testhash, max_time, max_memory").
+		Order("id desc").
+		Find(&submissions).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("select query failed")
+	}
+	overviews := make([]*pb.SubmissionOverview, 0, len(submissions))
+	for _, sub := range submissions {
+		protoSub, err := toProtoSubmission(&sub)
+		if err != nil {
+			log.Print(err)
+			return nil, err
+		}
+		overviews = append(overviews, protoSub)
+	}
+	s.recentCache.fetchedAt = time.Now()
+	s.recentCache.submissions = overviews
+	return overviews, nil
+}
+
+func (s *server) RecentSubmissions(ctx context.Context, in *pb.RecentSubmissionsRequest) (*pb.RecentSubmissionsResponse, error) {
+	limit := int(in.Limit)
+	if limit == 0 {
+		limit = recentSubmissionsDefaultLimit
+	}
+	if recentSubmissionsMaxLimit < limit {
+		limit = recentSubmissionsMaxLimit
+	}
+	submissions, err := s.fetchRecentSubmissions()
+	if err != nil {
+		return nil, err
+	}
+	if len(submissions) < limit {
+		limit = len(submissions)
+	}
+	return &pb.RecentSubmissionsResponse{
+		Submissions: submissions[:limit],
+	}, nil
+}
+
+func (s *server) ProblemFastestSubmissions(ctx context.Context, in *pb.ProblemFastestSubmissionsRequest) (*pb.ProblemFastestSubmissionsResponse, error) {
+	if in.Problem == "" {
+		return nil, errors.New("empty problem name")
+	}
+	order := ""
+	if in.Order == "" || in.Order == "time" {
+		order = "max_time asc, id asc"
+	} else if in.Order == "memory" {
+		order = "max_memory asc, id asc"
+	} else {
+		return nil, errors.New("unknown sort order")
+	}
+	limit := int(in.Limit)
+	if limit == 0 {
+		limit = 20
+	}
+	if 100 < limit {
+		limit = 100
+	}
+
+	query := s.visibleSubmissions(ctx, s.db).Where("problem_name = ? and status = 'AC' and not staging", in.Problem)
+	if !in.AllSubmissions {
+		query = query.Where(`id in (
+			select id from (
+				select id, row_number() over (partition by user_name order by `+order+`) as rn
+				from submissions where problem_name = ? and status = 'AC' and user_name is not null and not staging
+			) as best where rn = 1)`, in.Problem)
+	}
+	var submissions = make([]Submission, 0)
+	if err := query.Limit(limit).
+		Preload("User", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name")
+		}).
+		Preload("Problem", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name, title, testhash")
+		}).
+		Select("id, user_name, problem_name, lang, status, hacked, testhash, max_time, max_memory").
+		Order(order).
+		Find(&submissions).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("select query failed")
+	}
+
+	res := &pb.ProblemFastestSubmissionsResponse{}
+	for _, sub := range submissions {
+		protoSub, err := toProtoSubmission(&sub)
+		if err != nil {
+			log.Print(err)
+			return nil, err
+		}
+		res.Submissions = append(res.Submissions, protoSub)
+	}
+	return res, nil
+}
+
+func (s *server) Rejudge(ctx context.Context, in *pb.RejudgeRequest) (*pb.RejudgeResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	sub, err := s.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: in.Id})
+	if err != nil {
+		return nil, err
+	}
+	currentUser, _ := fetchUser(s.db, getCurrentUserName(ctx))
+	if !sub.CanRejudge {
+		return nil, permissionError(currentUser)
+	}
+	cooldown := s.config.RejudgeCooldown
+	if currentUser.Admin {
+		cooldown = 0
+	}
+	// the cooldown is consumed only if the submission is enqueued
+	rejudged := false
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		ok, err := markRejudged(tx, in.Id, cooldown, currentUser.Name)
+		if err != nil || !ok {
+			return err
+		}
+		if err := toWaitingJudge(tx, in.Id, s.config.RejudgePriority, time.Duration(0), currentUser.Name); err != nil {
+			log.Print(err)
+			return errors.New("cannot insert into queue")
+		}
+		rejudged = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if !rejudged {
+		return nil, fmt.Errorf("this submission was rejudged recently, please wait %v before rejudging it again", cooldown)
+	}
+	return &pb.RejudgeResponse{}, nil
+}
+
+// staleRejudgePriority is lower than ServerConfig.SubmitPriority and RejudgePriority, not to delay them
+const staleRejudgePriority = 10
+
+func (s *server) RejudgeStaleSubmissions(ctx context.Context, in *pb.RejudgeStaleSubmissionsRequest) (*pb.RejudgeStaleSubmissionsResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	ids, err := fetchStaleSubmissionIDs(s.db, in.Problem)
+	if err != nil {
+		return nil, err
+	}
+	count := int32(0)
+	for _, id := range ids {
+		// not a rejudge by a user, so nobody is credited for hacks
+		if err := toWaitingJudge(s.db, id, staleRejudgePriority, time.Duration(0), ""); err != nil {
+			log.Print(err)
+			continue
+		}
+		count++
+	}
+	log.Printf("Rejudge %v stale submissions", count)
+	return &pb.RejudgeStaleSubmissionsResponse{
+		Count: count,
+	}, nil
+}
+
+func (s *server) ResetSubmission(ctx context.Context, in *pb.ResetSubmissionRequest) (*pb.ResetSubmissionResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if err := resetSubmission(s.db, in.Id, s.config.RejudgePriority); err != nil {
+		return nil, err
+	}
+	return &pb.ResetSubmissionResponse{}, nil
+}
+
+func (s *server) RetryCompile(ctx context.Context, in *pb.RetryCompileRequest) (*pb.RetryCompileResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if err := retryCompile(s.db, in.Id, s.config.RejudgePriority); err != nil {
+		log.Print(err)
+		return nil, err
+	}
+	return &pb.RetryCompileResponse{}, nil
+}
+
+func (s *server) CompareSubmissions(ctx context.Context, in *pb.CompareSubmissionsRequest) (*pb.CompareSubmissionsResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	sub1, err := fetchSubmission(s.db, in.Id1)
+	if err != nil {
+		return nil, err
+	}
+	sub2, err := fetchSubmission(s.db, in.Id2)
+	if err != nil {
+		return nil, err
+	}
+	overview1, err := toProtoSubmission(&sub1)
+	if err != nil {
+		return nil, err
+	}
+	overview2, err := toProtoSubmission(&sub2)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CompareSubmissionsResponse{
+		Overview1:  overview1,
+		Overview2:  overview2,
+		Source1:    sub1.Source,
+		Source2:    sub2.Source,
+		Similarity: sourceSimilarity(sub1.Source, sub2.Source),
+	}, nil
+}
+
+func (s *server) SubmissionDiff(ctx context.Context, in *pb.SubmissionDiffRequest) (*pb.SubmissionDiffResponse, error) {
+	if err := s.checkFeature("submission_diff"); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	if currentUserName == "" {
+		return nil, errNotLoggedIn
+	}
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	sub := Submission{}
+	if err := s.db.Select("id, user_name, problem_name, source").Where("id = ?", in.Id).Take(&sub).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("unknown submission")
+	}
+	if !sub.UserName.Valid || (sub.UserName.String != currentUserName && !currentUser.Admin) {
+		return nil, errPermissionDenied
+	}
+	prev, err := fetchPreviousSubmission(s.db, sub.UserName.String, sub.ProblemName, sub.ID)
+	if err != nil {
+		return nil, err
+	}
+	if prev == nil {
+		return &pb.SubmissionDiffResponse{}, nil
+	}
+	diff, err := unifiedDiff(prev.Source, sub.Source, fmt.Sprintf("#%d", prev.ID), fmt.Sprintf("#%d", sub.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SubmissionDiffResponse{
+		PreviousId: prev.ID,
+		Diff:       diff,
+	}, nil
+}
+
+const (
+	searchSubmissionSourceMaxLimit = 100
+	searchSubmissionSourceMinQuery = 3
+)
+
+func (s *server) SearchSubmissionSource(ctx context.Context, in *pb.SearchSubmissionSourceRequest) (*pb.SearchSubmissionSourceResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if utf8.RuneCountInString(in.Query) < searchSubmissionSourceMinQuery {
+		return nil, fmt.Errorf("query must be at least %d characters", searchSubmissionSourceMinQuery)
+	}
+	limit := int(in.Limit)
+	if limit == 0 || searchSubmissionSourceMaxLimit < limit {
+		limit = searchSubmissionSourceMaxLimit
+	}
+	subs, err := searchSubmissionSource(s.db, in.Query, in.Problem, in.Lang, limit)
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.SearchSubmissionSourceResponse{}
+	for _, sub := range subs {
+		protoSub, err := toProtoSubmission(&sub)
+		if err != nil {
+			log.Print(err)
+			return nil, err
+		}
+		res.Submissions = append(res.Submissions, protoSub)
+	}
+	return res, nil
+}
+
+const (
+	scanPlagiarismMaxLimit         = 200
+	scanPlagiarismDefaultThreshold = 0.8
+)
+
+func (s *server) ScanPlagiarism(ctx context.Context, in *pb.ScanPlagiarismRequest) (*pb.ScanPlagiarismResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if in.Problem == "" {
+		return nil, errors.New("empty problem name")
+	}
+	limit := int(in.Limit)
+	if limit == 0 || scanPlagiarismMaxLimit < limit {
+		limit = scanPlagiarismMaxLimit
+	}
+	threshold := in.Threshold
+	if threshold == 0 {
+		threshold = scanPlagiarismDefaultThreshold
+	}
+
+	query := func() *gorm.DB {
+		return s.db.Model(&Submission{}).Where("problem_name = ? and status = 'AC'", in.Problem)
+	}
+	count := int64(0)
+	if err := query().Count(&count).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("count query failed")
+	}
+	var submissions = make([]Submission, 0)
+	if err := query().Select("id, user_name, source").
+		Order("id asc").Limit(limit).Offset(int(in.Skip)).
+		Find(&submissions).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("select query failed")
+	}
+
+	res := &pb.ScanPlagiarismResponse{
+		Count: int32(count),
+	}
+	sourceShingles := make([]map[string]struct{}, len(submissions))
+	for i, sub := range submissions {
+		sourceShingles[i] = shingles(sub.Source)
+	}
+	for i := range submissions {
+		for j := i + 1; j < len(submissions); j++ {
+			a, b := submissions[i], submissions[j]
+			if a.UserName.Valid && a.UserName == b.UserName {
+				continue
+			}
+			similarity := shinglesSimilarity(sourceShingles[i], sourceShingles[j])
+			if similarity < threshold {
+				continue
+			}
+			res.Pairs = append(res.Pairs, &pb.SimilarSubmissionPair{
+				Id1:        a.ID,
+				Id2:        b.ID,
+				Similarity: similarity,
+			})
+		}
+	}
+	sort.SliceStable(res.Pairs, func(i, j int) bool {
+		return res.Pairs[i].Similarity > res.Pairs[j].Similarity
+	})
+	return res, nil
+}
+
+const (
+	sourceClustersMaxLimit       = 100
+	sourceClustersMaxIDs         = 100
+	sourceClustersDefaultMinSize = 2
+)
+
+func (s *server) SourceClusters(ctx context.Context, in *pb.SourceClustersRequest) (*pb.SourceClustersResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if in.Problem == "" {
+		return nil, errors.New("empty problem name")
+	}
+	minSize := int(in.MinSize)
+	if minSize < sourceClustersDefaultMinSize {
+		minSize = sourceClustersDefaultMinSize
+	}
+	limit := int(in.Limit)
+	if limit == 0 || sourceClustersMaxLimit < limit {
+		limit = sourceClustersMaxLimit
+	}
+
+	type Result struct {
+		SourceHash string
+		Size       int32
+		UserCount  int32
+	}
+	var results = make([]Result, 0)
+	if err := s.db.
+		Model(&Submission{}).
+		Select("source_hash, count(*) as size, count(distinct user_name) as user_count").
+		Where("problem_name = ? and source_hash <> '' and status <> ?", in.Problem, draftStatus).
+		Group("source_hash").
+		Having("count(*) >= ?", minSize).
+		Order("size desc, source_hash asc").
+		Limit(limit).
+		Find(&results).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed sql query")
+	}
+
+	res := &pb.SourceClustersResponse{}
+	for _, result := range results {
+		var ids = make([]int32, 0)
+		if err := s.db.
+			Model(&Submission{}).
+			Where("problem_name = ? and source_hash = ? and status <> ?", in.Problem, result.SourceHash, draftStatus).
+			Order("id asc").
+			Limit(sourceClustersMaxIDs).
+			Pluck("id", &ids).Error; err != nil {
+			log.Print(err)
+			return nil, errors.New("failed sql query")
+		}
+		res.Clusters = append(res.Clusters, &pb.SourceCluster{
+			SourceHash: result.SourceHash,
+			Size:       result.Size,
+			UserCount:  result.UserCount,
+			Ids:        ids,
+		})
+	}
+	return res, nil
+}
+
+func (s *server) SubmissionNote(ctx context.Context, in *pb.SubmissionNoteRequest) (*pb.SubmissionNoteResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	sub := Submission{}
+	if err := s.db.Select("id, admin_note, admin_tags").Where("id = ?", in.Id).Take(&sub).Error; err != nil {
+		return nil, errors.New("Submission fetch failed")
+	}
+	res := &pb.SubmissionNoteResponse{
+		Note: sub.AdminNote,
+	}
+	if sub.AdminTags != "" {
+		res.Tags = strings.Split(sub.AdminTags, ",")
+	}
+	return res, nil
+}
+
+func (s *server) ChangeSubmissionNote(ctx context.Context, in *pb.ChangeSubmissionNoteRequest) (*pb.ChangeSubmissionNoteResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if len(in.Note) > 10000 {
+		return nil, errors.New("too long note")
+	}
+	for _, tag := range in.Tags {
+		if tag == "" || len(tag) > 32 || strings.Contains(tag, ",") {
+			return nil, errors.New("invalid tag: " + tag)
+		}
 	}
-	if err := toWaitingJudge(s.db, in.Id, 40, time.Duration(0)); err != nil {
+	result := s.db.Model(&Submission{}).Where("id = ?", in.Id).Updates(map[string]interface{}{
+		"admin_note": in.Note,
+		"admin_tags": strings.Join(in.Tags, ","),
+	})
+	if err := result.Error; err != nil {
 		log.Print(err)
-		return nil, errors.New("cannot insert into queue")
+		return nil, errors.New("failed to update note")
 	}
-	return &pb.RejudgeResponse{}, nil
+	if result.RowsAffected == 0 {
+		return nil, errors.New("Submission not found")
+	}
+	return &pb.ChangeSubmissionNoteResponse{}, nil
 }
 
 func (s *server) LangList(ctx context.Context, in *pb.LangListRequest) (*pb.LangListResponse, error) {
 	return &pb.LangListResponse{Langs: s.langs}, nil
 }
 
+func (s *server) LangInfo(ctx context.Context, in *pb.LangInfoRequest) (*pb.LangInfoResponse, error) {
+	for _, lang := range s.langs {
+		if lang.Id == in.Id {
+			return &pb.LangInfoResponse{Lang: lang}, nil
+		}
+	}
+	return nil, errors.New("unknown Lang")
+}
+
+const rankingMaxProblems = 1000
+
 func (s *server) Ranking(ctx context.Context, in *pb.RankingRequest) (*pb.RankingResponse, error) {
+	if rankingMaxProblems < len(in.Problems) {
+		return nil, fmt.Errorf("too many problems, max %d", rankingMaxProblems)
+	}
 	type Result struct {
 		UserName string
 		AcCount  int
 	}
 	var results = make([]Result, 0)
-	if err := s.db.
+	query := s.visibleSubmissions(ctx, s.db).
 		Model(&Submission{}).
 		Select("user_name, count(distinct problem_name) as ac_count").
-		Where("status = 'AC' and user_name is not null").
+		Where("status = 'AC' and user_name is not null and not staging")
+	if in.ExcludeAdmins {
+		query = query.
+			Joins("join users on submissions.user_name = users.name").
+			Where("users.admin is not true")
+	}
+	if len(in.Problems) != 0 {
+		query = query.Where("problem_name in ?", in.Problems)
+	}
+	if err := query.
 		Group("user_name").
 		Find(&results).Error; err != nil {
 		log.Print(err)
@@ -454,18 +1882,379 @@ func (s *server) Ranking(ctx context.Context, in *pb.RankingRequest) (*pb.Rankin
 	return &res, nil
 }
 
-func (s *server) PopJudgeTask(ctx context.Context, in *pb.PopJudgeTaskRequest) (*pb.PopJudgeTaskResponse, error) {
+const siteStatisticsCacheTTL = time.Minute
+
+type siteStatisticsCache struct {
+	mu         sync.Mutex
+	fetchedAt  time.Time
+	version    string // statistics version
+	statistics *pb.SiteStatisticsResponse
+}
+
+func (s *server) SiteStatistics(ctx context.Context, in *pb.SiteStatisticsRequest) (*pb.SiteStatisticsResponse, error) {
+	version, err := fetchStatisticsVersion(s.db)
+	if err != nil {
+		return nil, err
+	}
+	s.statisticsCache.mu.Lock()
+	defer s.statisticsCache.mu.Unlock()
+	if time.Since(s.statisticsCache.fetchedAt) < siteStatisticsCacheTTL && s.statisticsCache.version == version {
+		return s.statisticsCache.statistics, nil
+	}
+
+	var problemCount, userCount int64
+	if err := s.db.Model(&Problem{}).Count(&problemCount).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("count query failed")
+	}
+	if err := s.db.Model(&User{}).Count(&userCount).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("count query failed")
+	}
+	var result struct {
+		SubmissionCount   int32
+		AcSubmissionCount int32
+		SolverCount       int32
+		SubmitterCount    int32
+	}
+	if err := s.db.Model(&Submission{}).Select(`
+		count(*) as submission_count,
+		count(*) filter (where status = 'AC') as ac_submission_count,
+		count(distinct user_name) filter (where status = 'AC') as solver_count,
+		count(distinct user_name) as submitter_count`).
+		Where("not staging").
+		Take(&result).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed sql query")
+	}
+
+	s.statisticsCache.fetchedAt = time.Now()
+	s.statisticsCache.version = version
+	s.statisticsCache.statistics = &pb.SiteStatisticsResponse{
+		ProblemCount:      int32(problemCount),
+		UserCount:         int32(userCount),
+		SubmissionCount:   result.SubmissionCount,
+		AcSubmissionCount: result.AcSubmissionCount,
+		SolverCount:       result.SolverCount,
+		SubmitterCount:    result.SubmitterCount,
+	}
+	return s.statisticsCache.statistics, nil
+}
+
+const langStatisticsCacheTTL = time.Minute
+
+type langStatisticsCacheEntry struct {
+	fetchedAt  time.Time
+	version    string // statistics version
+	statistics *pb.LangStatisticsResponse
+}
+
+// langStatisticsCache is LangStatisticsResponse for each ac_only
+type langStatisticsCache struct {
+	mu      sync.Mutex
+	entries map[bool]langStatisticsCacheEntry
+}
+
+func (s *server) LangStatistics(ctx context.Context, in *pb.LangStatisticsRequest) (*pb.LangStatisticsResponse, error) {
+	version, err := fetchStatisticsVersion(s.db)
+	if err != nil {
+		return nil, err
+	}
+	s.langStatsCache.mu.Lock()
+	defer s.langStatsCache.mu.Unlock()
+	if entry, ok := s.langStatsCache.entries[in.AcOnly]; ok && time.Since(entry.fetchedAt) < langStatisticsCacheTTL && entry.version == version {
+		return entry.statistics, nil
+	}
+
+	type Result struct {
+		Lang   string
+		Status string
+		Count  int32
+	}
+	var results = make([]Result, 0)
+	query := s.db.Model(&Submission{}).Where("not staging")
+	if in.AcOnly {
+		query = query.Where("status = 'AC'")
+	}
+	if err := query.
+		Select("lang, status, count(*) as count").
+		Group("lang, status").
+		Order("count desc, lang asc, status asc").
+		Find(&results).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("count query failed")
+	}
+
+	res := &pb.LangStatisticsResponse{}
+	langs := make(map[string]*pb.LangStatistic)
+	for _, result := range results {
+		lang, ok := langs[result.Lang]
+		if !ok {
+			lang = &pb.LangStatistic{Lang: result.Lang}
+			langs[result.Lang] = lang
+			res.Langs = append(res.Langs, lang)
+		}
+		lang.Count += result.Count
+		lang.StatusCounts = append(lang.StatusCounts, &pb.SubmissionStatusCount{
+			Status: result.Status,
+			Count:  result.Count,
+		})
+		res.Total += result.Count
+	}
+	sort.SliceStable(res.Langs, func(i, j int) bool {
+		return res.Langs[i].Count > res.Langs[j].Count
+	})
+
+	if s.langStatsCache.entries == nil {
+		s.langStatsCache.entries = make(map[bool]langStatisticsCacheEntry)
+	}
+	s.langStatsCache.entries[in.AcOnly] = langStatisticsCacheEntry{
+		fetchedAt:  time.Now(),
+		version:    version,
+		statistics: res,
+	}
+	return res, nil
+}
+
+// checkJudge checks that the caller can act as the judge named judgeName.
+// A token issued by RegisterJudge can act only as its own judge while it is registered, while the shared judge token and admin users
+// can act as any judge (only registered ones if RequireJudgeRegistration).
+func (s *server) checkJudge(ctx context.Context, judgeName string) error {
+	if judgeName == "" {
+		return errors.New("JudgeName is empty")
+	}
+	if name := getJudgeName(ctx); name != "" {
+		if name != judgeName {
+			return status.Error(codes.PermissionDenied, "JudgeName does not match to the token")
+		}
+		judge, err := fetchJudge(s.db, name)
+		if err != nil {
+			return status.Error(codes.PermissionDenied, "unregistered judge: "+name)
+		}
+		// registered again after the token is issued
+		if getJudgeRegisteredAt(ctx) != judge.RegisteredAt.Time.UnixMicro() {
+			return status.Error(codes.PermissionDenied, "revoked judge token")
+		}
+		return nil
+	}
+	if !isJudge(ctx) {
+		currentUserName := getCurrentUserName(ctx)
+		currentUser, _ := fetchUser(s.db, currentUserName)
+		if !currentUser.Admin {
+			return permissionError(currentUser)
+		}
+	}
+	if s.config.RequireJudgeRegistration {
+		if _, err := fetchJudge(s.db, judgeName); err != nil {
+			return errors.New("unregistered judge: " + judgeName)
+		}
+	}
+	return nil
+}
+
+// checkJudgeTaskID requires task_id from the judges, not to let a stale judge overwrite the result of a newer claim.
+// Only admin users may omit it, e.g. to finish a task by hand, then stale completions are not detected.
+func checkJudgeTaskID(ctx context.Context, judgeName string, taskID int32) error {
+	if taskID != 0 {
+		return nil
+	}
+	if isJudge(ctx) {
+		return status.Error(codes.InvalidArgument, "task_id is required")
+	}
+	log.Printf("task_id of judge %v is omitted by admin", judgeName)
+	return nil
+}
+
+func (s *server) RegisterJudge(ctx context.Context, in *pb.RegisterJudgeRequest) (*pb.RegisterJudgeResponse, error) {
+	if !isJudge(ctx) || getJudgeName(ctx) != "" {
+		currentUserName := getCurrentUserName(ctx)
+		currentUser, _ := fetchUser(s.db, currentUserName)
+		if !currentUser.Admin {
+			return nil, permissionError(currentUser)
+		}
+	}
+	if in.Name == "" {
+		return nil, errors.New("empty judge name")
+	}
+	registeredAt, err := registerJudge(s.db, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	token, expiresAt, err := s.authTokenManager.IssueJudgeToken(in.Name, registeredAt)
+	if err != nil {
+		log.Print(err)
+		return nil, errors.New("broken token")
+	}
+	return &pb.RegisterJudgeResponse{
+		Token:     token,
+		ExpiresAt: timestamppb.New(expiresAt),
+	}, nil
+}
+
+func (s *server) UnregisterJudge(ctx context.Context, in *pb.UnregisterJudgeRequest) (*pb.UnregisterJudgeResponse, error) {
 	currentUserName := getCurrentUserName(ctx)
 	currentUser, _ := fetchUser(s.db, currentUserName)
 	if !currentUser.Admin {
-		return nil, errors.New("permission denied")
+		return nil, permissionError(currentUser)
 	}
-	if in.JudgeName == "" {
-		return nil, errors.New("JudgeName is empty")
+	if err := unregisterJudge(s.db, in.Name); err != nil {
+		return nil, err
 	}
-	for i := 0; i < 10; i++ {
-		task, err := popTask(s.db)
+	log.Printf("unregister judge %v by %v", in.Name, currentUserName)
+	return &pb.UnregisterJudgeResponse{}, nil
+}
+
+// compileStatsValues returns the columns to update by the compile stats reported by the judge, only the reported ones are included
+func compileStatsValues(cache pb.CompileCacheStatus, compileTime *durationpb.Duration) map[string]interface{} {
+	values := make(map[string]interface{})
+	if cache != pb.CompileCacheStatus_COMPILE_CACHE_UNKNOWN {
+		values["compile_cache"] = int32(cache)
+	}
+	if compileTime.IsValid() {
+		values["compile_time"] = compileTime.AsDuration().Milliseconds()
+	}
+	return values
+}
+
+// judgeTaskLease returns the lease of a judge task requested by a judge
+func (s *server) judgeTaskLease(expectedTime *durationpb.Duration) (time.Duration, error) {
+	if !expectedTime.IsValid() {
+		return s.config.JudgeTaskLeaseDefault, nil
+	}
+	lease := expectedTime.AsDuration()
+	if lease <= 0 || s.config.JudgeTaskLeaseMax < lease {
+		return 0, fmt.Errorf("expected time must be in (0, %v]", s.config.JudgeTaskLeaseMax)
+	}
+	return lease, nil
+}
+
+const deadLetterSubmissionsLimit = 100
+
+func (s *server) DeadLetterSubmissions(ctx context.Context, in *pb.DeadLetterSubmissionsRequest) (*pb.DeadLetterSubmissionsResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	subs, err := fetchDeadLetterSubmissions(s.db, deadLetterSubmissionsLimit)
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.DeadLetterSubmissionsResponse{}
+	for _, sub := range subs {
+		protoSub, err := toProtoSubmission(&sub)
 		if err != nil {
+			log.Print(err)
+			return nil, err
+		}
+		res.Submissions = append(res.Submissions, protoSub)
+	}
+	return res, nil
+}
+
+func (s *server) JudgeList(ctx context.Context, in *pb.JudgeListRequest) (*pb.JudgeListResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	judges, err := fetchJudges(s.db)
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.JudgeListResponse{}
+	for _, judge := range judges {
+		res.Judges = append(res.Judges, &pb.JudgeInfo{
+			Name:           judge.Name,
+			Registered:     judge.RegisteredAt.Valid,
+			LastSeen:       timestamppb.New(judge.LastSeen),
+			ProcessedCount: judge.ProcessedCount,
+		})
+	}
+	return res, nil
+}
+
+func (s *server) PopJudgeTask(ctx context.Context, in *pb.PopJudgeTaskRequest) (*pb.PopJudgeTaskResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := s.checkJudge(ctx, in.JudgeName); err != nil {
+		return nil, err
+	}
+	if err := touchJudge(s.db, in.JudgeName, 0); err != nil {
+		log.Print(err)
+	}
+	expectedTime, err := s.judgeTaskLease(in.ExpectedTime)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 10; i++ {
+		task := Task{}
+		claimed := false
+		caseVersion := ""
+		retryCompile := false
+		// pop the task and claim its submission atomically, not to lose the task by a failure partway
+		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			task, err = popTask(tx, s.config.FairScheduling, s.config.MaxInFlightPerUser)
+			if err != nil {
+				return err
+			}
+			if task.Submission == -1 {
+				return nil
+			}
+			id := task.Submission
+
+			if 0 < s.config.JudgeTaskMaxAttempts && s.config.JudgeTaskMaxAttempts <= int(task.Attempts) {
+				if err := deadLetterSubmission(tx, id, task.Attempts); err != nil {
+					log.Print(err)
+				}
+				return nil
+			}
+
+			log.Println("Pop Submission:", id, expectedTime)
+
+			if err := registerSubmission(tx, id, in.JudgeName, expectedTime, Waiting); err != nil {
+				// invalid task, only remove it
+				log.Print(err)
+				return nil
+			}
+			if err := tx.Model(&Submission{}).Where("id = ?", id).Updates(map[string]interface{}{
+				"judge_task_id": task.ID,
+				"compile_cache": 0,
+				"compile_time":  nil,
+			}).Error; err != nil {
+				log.Print(err)
+				return errors.New("failed to update judge task id")
+			}
+			if err := pushTask(tx, Task{
+				Submission: id,
+				Priority:   task.Priority + 1,
+				Available:  time.Now().Add(expectedTime),
+				Attempts:   task.Attempts + 1,
+			}); err != nil {
+				log.Print(err)
+				return err
+			}
+
+			if caseVersion, err = fetchStagingTesthash(tx, id); err != nil {
+				return err
+			}
+			sub := Submission{}
+			if err := tx.Select("retry_compile").Take(&sub, id).Error; err != nil {
+				log.Print(err)
+				return errors.New("failed to fetch submission")
+			}
+			retryCompile = sub.RetryCompile
+
+			log.Print("Clear SubmissionTestcaseResults: ", id)
+			if err := tx.Where("submission = ?", id).Delete(&SubmissionTestcaseResult{}).Error; err != nil {
+				log.Println(err)
+				return errors.New("failed to clear submission testcase results")
+			}
+			claimed = true
+			return nil
+		}); err != nil {
 			return nil, err
 		}
 		if task.Submission == -1 {
@@ -474,34 +2263,14 @@ func (s *server) PopJudgeTask(ctx context.Context, in *pb.PopJudgeTaskRequest) (
 				SubmissionId: -1,
 			}, nil
 		}
-		id := task.Submission
-
-		expectedTime := in.ExpectedTime.AsDuration()
-		if !in.ExpectedTime.IsValid() {
-			expectedTime = time.Minute
-		}
-		log.Println("Pop Submission:", id, expectedTime)
-
-		if err := registerSubmission(s.db, id, in.JudgeName, expectedTime, Waiting); err != nil {
-			log.Print(err)
+		if !claimed {
 			continue
 		}
-		if err := pushTask(s.db, Task{
-			Submission: id,
-			Priority:   task.Priority + 1,
-			Available:  time.Now().Add(expectedTime),
-		}); err != nil {
-			log.Print(err)
-			return nil, err
-		}
-
-		log.Print("Clear SubmissionTestcaseResults: ", id)
-		if err := s.db.Where("submission = ?", id).Delete(&SubmissionTestcaseResult{}).Error; err != nil {
-			log.Println(err)
-			return nil, errors.New("failed to clear submission testcase results")
-		}
 		return &pb.PopJudgeTaskResponse{
 			SubmissionId: task.Submission,
+			TaskId:       task.ID,
+			CaseVersion:  caseVersion,
+			RetryCompile: retryCompile,
 		}, nil
 	}
 	log.Println("Too many invalid tasks")
@@ -511,22 +2280,21 @@ func (s *server) PopJudgeTask(ctx context.Context, in *pb.PopJudgeTaskRequest) (
 }
 
 func (s *server) SyncJudgeTaskStatus(ctx context.Context, in *pb.SyncJudgeTaskStatusRequest) (*pb.SyncJudgeTaskStatusResponse, error) {
-	currentUserName := getCurrentUserName(ctx)
-	currentUser, _ := fetchUser(s.db, currentUserName)
-	if !currentUser.Admin {
-		return nil, errors.New("permission denied")
+	// not checkWritable, the tasks popped before the maintenance are judged until the end
+	if err := s.checkJudge(ctx, in.JudgeName); err != nil {
+		return nil, err
 	}
-	if in.JudgeName == "" {
-		return nil, errors.New("JudgeName is empty")
+	if err := checkJudgeTaskID(ctx, in.JudgeName, in.TaskId); err != nil {
+		return nil, err
 	}
 	id := in.SubmissionId
 
-	expectedTime := in.ExpectedTime.AsDuration()
-	if !in.ExpectedTime.IsValid() {
-		expectedTime = time.Minute
+	expectedTime, err := s.judgeTaskLease(in.ExpectedTime)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := updateSubmissionRegistration(s.db, id, in.JudgeName, expectedTime); err != nil {
+	if err := updateSubmissionRegistration(s.db, id, in.JudgeName, expectedTime, in.TaskId); err != nil {
 		log.Println(err)
 		return nil, err
 	}
@@ -543,64 +2311,116 @@ func (s *server) SyncJudgeTaskStatus(ctx context.Context, in *pb.SyncJudgeTaskSt
 			return nil, errors.New("DB update failed")
 		}
 	}
+	compileError := truncateCompileError(in.CompileError, s.config.MaxCompileErrorLength)
+	if len(compileError) < len(in.CompileError) {
+		log.Printf("truncate compile error of %v: %v -> %v bytes", id, len(in.CompileError), len(compileError))
+	}
 	if err := s.db.Model(&Submission{
 		ID: id,
 	}).Updates(&Submission{
 		Status:       in.Status,
 		MaxTime:      int32(in.Time * 1000),
 		MaxMemory:    in.Memory,
-		CompileError: in.CompileError,
+		CompileError: compileError,
 	}).Error; err != nil {
 		return nil, errors.New("update Status Failed")
 	}
+	if values := compileStatsValues(in.CompileCache, in.CompileTime); len(values) != 0 {
+		if err := s.db.Model(&Submission{}).Where("id = ?", id).Updates(values).Error; err != nil {
+			log.Print(err)
+			return nil, errors.New("update compile stats failed")
+		}
+	}
 	return &pb.SyncJudgeTaskStatusResponse{}, nil
 }
 
 func (s *server) FinishJudgeTask(ctx context.Context, in *pb.FinishJudgeTaskRequest) (*pb.FinishJudgeTaskResponse, error) {
-	currentUserName := getCurrentUserName(ctx)
-	currentUser, _ := fetchUser(s.db, currentUserName)
-	if !currentUser.Admin {
-		return nil, errors.New("permission denied")
+	// not checkWritable, the tasks popped before the maintenance are judged until the end
+	if err := s.checkJudge(ctx, in.JudgeName); err != nil {
+		return nil, err
 	}
-	if in.JudgeName == "" {
-		return nil, errors.New("JudgeName is empty")
+	if err := checkJudgeTaskID(ctx, in.JudgeName, in.TaskId); err != nil {
+		return nil, err
 	}
 	id := in.SubmissionId
 
-	if err := updateSubmissionRegistration(s.db, id, in.JudgeName, 10*time.Second); err != nil {
-		log.Println(err)
-		return nil, err
-	}
+	// check the registration and update the result atomically, not to overwrite the result of a newer claim
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		sub := Submission{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(&sub, id).Error; err != nil {
+			log.Print(err)
+			return errors.New("Submission fetch failed")
+		}
+		if current := currentRegistrationStatus(&sub, in.JudgeName); current != JudgingBySelf {
+			log.Printf("Expect(%v) != Actual(%v)", JudgingBySelf, current)
+			return errors.New("actual status does not matched to expected status")
+		}
+		if err := checkJudgeTask(&sub, in.TaskId); err != nil {
+			return err
+		}
 
-	sub, err := fetchSubmission(s.db, id)
-	if err != nil {
-		log.Println(err)
+		hacked := sub.PrevStatus == "AC" && in.Status != "AC"
+		if err := tx.Model(&Submission{
+			ID: id,
+		}).Updates(&Submission{
+			Status:    in.Status,
+			MaxTime:   int32(in.Time * 1000),
+			MaxMemory: in.Memory,
+			Hacked:    hacked,
+		}).Error; err != nil {
+			return errors.New("update Status Failed")
+		}
+		values := compileStatsValues(in.CompileCache, in.CompileTime)
+		if sub.Staging {
+			// keep testhash, not to make the result look up to date before the staging testhash is promoted
+			values["staging_hash"] = in.CaseVersion
+		} else {
+			values["testhash"] = in.CaseVersion
+		}
+		values["last_judge_name"] = in.JudgeName
+		values["judge_name"] = ""
+		values["judge_ping"] = time.Now().Add(-time.Second)
+		if hacked && !sub.Hacked {
+			values["hacked_by"] = sub.RejudgedBy
+		}
+		if err := tx.Model(&Submission{
+			ID: id,
+		}).Updates(values).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to clear judge_name")
+		}
+		return nil
+	}); err != nil {
 		return nil, err
 	}
-
-	if err := s.db.Model(&Submission{
-		ID: id,
-	}).Updates(&Submission{
-		Status:    in.Status,
-		MaxTime:   int32(in.Time * 1000),
-		MaxMemory: in.Memory,
-		Hacked:    sub.PrevStatus == "AC" && in.Status != "AC",
-	}).Error; err != nil {
-		return nil, errors.New("update Status Failed")
-	}
-	if err := s.db.Model(&Submission{
-		ID: id,
-	}).Updates(map[string]interface{}{
-		"testhash": in.CaseVersion,
-	}).Error; err != nil {
+	if err := touchJudge(s.db, in.JudgeName, 1); err != nil {
 		log.Print(err)
-		return nil, errors.New("failed to clear judge_name")
 	}
+	s.notifyFinished(id)
+	return &pb.FinishJudgeTaskResponse{}, nil
+}
 
-	if err := releaseSubmissionRegistration(s.db, id, in.JudgeName); err != nil {
-		return nil, errors.New("failed to release Submission")
+func (s *server) ListInFlightJudgeTasks(ctx context.Context, in *pb.ListInFlightJudgeTasksRequest) (*pb.ListInFlightJudgeTasksResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
 	}
-	return &pb.FinishJudgeTaskResponse{}, nil
+	subs, err := fetchInFlightSubmissions(s.db)
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.ListInFlightJudgeTasksResponse{}
+	for _, sub := range subs {
+		res.Tasks = append(res.Tasks, &pb.InFlightJudgeTask{
+			SubmissionId: sub.ID,
+			ProblemName:  sub.ProblemName,
+			Status:       sub.Status,
+			JudgeName:    sub.JudgeName,
+			LeaseExpiry:  timestamppb.New(sub.JudgePing),
+		})
+	}
+	return res, nil
 }
 
 type Category struct {
@@ -608,22 +2428,48 @@ type Category struct {
 	Problems []string `json:"problems"`
 }
 
-func (s *server) ProblemCategories(ctx context.Context, in *pb.ProblemCategoriesRequest) (*pb.ProblemCategoriesResponse, error) {
-	data, err := fetchMetadata(s.db, "problem_categories")
+func fetchCategories(db *gorm.DB) ([]Category, error) {
+	data, err := fetchMetadata(db, "problem_categories")
 	if err != nil {
 		return nil, err
 	}
 	var categories []Category
-	if json.Unmarshal([]byte(data), &categories); err != nil {
+	if err := json.Unmarshal([]byte(data), &categories); err != nil {
+		log.Print(err)
+		return nil, errors.New("broken problem categories")
+	}
+	return categories, nil
+}
+
+func (s *server) ProblemCategories(ctx context.Context, in *pb.ProblemCategoriesRequest) (*pb.ProblemCategoriesResponse, error) {
+	categories, err := fetchCategories(s.db)
+	if err != nil {
 		return nil, err
 	}
+	hidden := make(map[string]bool)
+	if !s.canSeeUnpublished(ctx) {
+		var names = make([]string, 0)
+		if err := s.db.Model(&Problem{}).Where("unpublished").Pluck("name", &names).Error; err != nil {
+			log.Print(err)
+			return nil, errors.New("failed to fetch problems")
+		}
+		for _, name := range names {
+			hidden[name] = true
+		}
+	}
 
 	var result []*pb.ProblemCategory
 
 	for _, c := range categories {
+		problems := make([]string, 0, len(c.Problems))
+		for _, problem := range c.Problems {
+			if !hidden[problem] {
+				problems = append(problems, problem)
+			}
+		}
 		result = append(result, &pb.ProblemCategory{
 			Title:    c.Title,
-			Problems: c.Problems,
+			Problems: problems,
 		})
 	}
 	return &pb.ProblemCategoriesResponse{
@@ -635,7 +2481,7 @@ func (s *server) ChangeProblemCategories(ctx context.Context, in *pb.ChangeProbl
 	currentUserName := getCurrentUserName(ctx)
 	currentUser, _ := fetchUser(s.db, currentUserName)
 	if !currentUser.Admin {
-		return nil, errors.New("permission denied")
+		return nil, permissionError(currentUser)
 	}
 	var categories []Category
 	for _, c := range in.Categories {
@@ -653,3 +2499,54 @@ func (s *server) ChangeProblemCategories(ctx context.Context, in *pb.ChangeProbl
 	}
 	return &pb.ChangeProblemCategoriesResponse{}, nil
 }
+
+func (s *server) NextUnsolvedInCategory(ctx context.Context, in *pb.NextUnsolvedInCategoryRequest) (*pb.NextUnsolvedInCategoryResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	if currentUserName == "" {
+		return nil, errNotLoggedIn
+	}
+	categories, err := fetchCategories(s.db)
+	if err != nil {
+		return nil, err
+	}
+	var category *Category
+	for i := range categories {
+		if categories[i].Title == in.Category {
+			category = &categories[i]
+			break
+		}
+	}
+	if category == nil {
+		return nil, status.Errorf(codes.NotFound, "unknown category: %v", in.Category)
+	}
+
+	// problems which are not created yet or not visible are skipped
+	var names = make([]string, 0)
+	if err := s.visibleProblems(ctx, s.db).Model(&Problem{}).Where("name in ?", category.Problems).Pluck("name", &names).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch problems")
+	}
+	visible := make(map[string]bool)
+	for _, name := range names {
+		visible[name] = true
+	}
+	solved, err := fetchUserStatistics(s.db, currentUserName)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.NextUnsolvedInCategoryResponse{}
+	for _, name := range category.Problems {
+		if !visible[name] {
+			continue
+		}
+		if _, ok := solved[name]; ok {
+			continue
+		}
+		if res.Problem == "" {
+			res.Problem = name
+		}
+		res.UnsolvedCount++
+	}
+	return res, nil
+}
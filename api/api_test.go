@@ -1,26 +1,40 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
 	clientutil "github.com/yosupo06/library-checker-judge/api/clientutil"
 	pb "github.com/yosupo06/library-checker-judge/api/proto"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"gorm.io/gorm"
 )
@@ -87,13 +101,22 @@ func createTestDB(t *testing.T) *gorm.DB {
 }
 
 func createAPIClient(t *testing.T, db *gorm.DB) (pb.LibraryCheckerServiceClient, func()) {
+	return createAPIClientWithConfig(t, db, DefaultServerConfig())
+}
+
+func createAPIClientWithConfig(t *testing.T, db *gorm.DB, config ServerConfig) (pb.LibraryCheckerServiceClient, func()) {
 	// launch gRPC server
 	listen, err := net.Listen("tcp", ":50053")
 	if err != nil {
 		t.Fatal(err)
 	}
 	autoTokenManager := NewAuthTokenManager("dummy-hmac-secret")
-	s := NewGRPCServer(db, autoTokenManager, "../langs/langs.toml")
+	autoTokenManager.SetJudgeToken("dummy-judge-token")
+	langs, err := ReadLangs("../langs/langs.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewGRPCServer(db, autoTokenManager, langs, config)
 	go func() {
 		if err := s.Serve(listen); err != nil {
 			log.Fatal("Server exited: ", err)
@@ -178,6 +201,39 @@ func assertEqualCases(t *testing.T, expectCases []*pb.SubmissionCaseResult, actu
 	}
 }
 
+func TestPanicRecovery(t *testing.T) {
+	interceptor := newRecoveryInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/librarychecker.LibraryCheckerService/Panic"}
+	_, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("bad handler")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatal("Panic is not converted to Internal: ", err)
+	}
+}
+
+func TestDBConfig(t *testing.T) {
+	t.Setenv("POSTGRE_HOST", "env-host")
+	t.Setenv("POSTGRE_PORT", "15432")
+	config := loadDBConfig(DBConfigSource{
+		Host: "flag-host",
+	})
+	if config.Host != "flag-host" {
+		t.Fatal("flag must override env: ", config.Host)
+	}
+	if config.Port != "15432" {
+		t.Fatal("port is not read from env: ", config.Port)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("POSTGRE_PORT", "dummy")
+	if err := loadDBConfig(DBConfigSource{}).Validate(); err == nil {
+		t.Fatal("invalid port is accepted")
+	}
+}
+
 func TestProblemInfo(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
@@ -203,1124 +259,5632 @@ func TestProblemInfo(t *testing.T) {
 	}
 }
 
-func TestSubmissionSortOrderList(t *testing.T) {
+func TestProblemInfoFields(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
 	ctx := context.Background()
-	for _, order := range []string{"", "-id", "+time"} {
-		_, err := client.SubmissionList(ctx, &pb.SubmissionListRequest{
-			Skip:  0,
-			Limit: 100,
-			Order: order,
-		})
-		if err != nil {
-			t.Fatal("Failed SubmissionList Order: ", order)
-		}
-	}
-	_, err := client.SubmissionList(ctx, &pb.SubmissionListRequest{
-		Skip:  0,
-		Limit: 100,
-		Order: "dummy",
+	problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name:   "aplusb",
+		Fields: []string{"title", "time_limit"},
 	})
-	if err == nil {
-		t.Fatal("Success SubmissionList Dummy Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem.Title != "A + B" {
+		t.Fatal("Differ Title : ", problem.Title)
+	}
+	if math.Abs(problem.TimeLimit-2.0) > 0.01 {
+		t.Fatal("Differ TimeLimit : ", problem.TimeLimit)
+	}
+	if problem.Statement != "" || problem.CaseVersion != "" {
+		t.Fatal("Unrequested fields are filled: ", problem)
+	}
+
+	if _, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name:   "aplusb",
+		Fields: []string{"unknown"},
+	}); err == nil {
+		t.Fatal("Success to request unknown field")
 	}
-	t.Log(err)
 }
 
-func TestLangList(t *testing.T) {
+func TestProblemAuthor(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	ctx := context.Background()
-	list, err := client.LangList(ctx, &pb.LangListRequest{})
-	if err != nil {
+	ctx := loginAsAdmin(t, client)
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:        "aplusb",
+		Title:       "A + B",
+		Author:      "yosupo",
+		TimeLimit:   2.0,
+		Statement:   "Please calculate A + B",
+		CaseVersion: "dummy-initial-version",
+	}); err != nil {
 		t.Fatal(err)
 	}
-	if len(list.Langs) == 0 {
+	problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
+	if problem.Author != "yosupo" {
+		t.Fatal("Differ Author : ", problem.Author)
+	}
 }
 
-func TestSubmitBig(t *testing.T) {
-	client, close := createAPIClient(t, createTestDB(t))
-	defer close()
+func TestProblemCaseData(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	req := &pb.ProblemCaseDataRequest{Problem: "aplusb", Case: "example_00"}
+	if _, err := client.ProblemCaseData(loginAsAdmin(t, client), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatal("Success to fetch case data without storage: ", err)
+	}
+	close()
 
-	ctx := context.Background()
-	bigSrc := strings.Repeat("a", 3*1000*1000) // 3 MB
-	_, err := client.Submit(ctx, &pb.SubmitRequest{
-		Problem: "aplusb",
-		Source:  bigSrc,
-		Lang:    "cpp",
-	})
-	if err == nil {
-		t.Fatal("Success to submit big source")
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "dummy-initial-version.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	largeOutput := strings.Repeat("3\n", caseDataMaxSize)
+	writer := zip.NewWriter(file)
+	for name, data := range map[string]string{
+		"checker.cpp":        "int main() {}",
+		"in/example_00.in":   "1 2\n",
+		"out/example_00.out": "3\n",
+		"in/large_00.in":     "1 2\n",
+		"out/large_00.out":   largeOutput,
+		"in/no_output_00.in": "1 2\n",
+	} {
+		w, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
 	}
-	t.Log(err)
-}
 
-func TestAnonymousRejudge(t *testing.T) {
-	client, close := createAPIClient(t, createTestDB(t))
+	config := DefaultServerConfig()
+	config.CaseDir = dir
+	client, close = createAPIClientWithConfig(t, db, config)
 	defer close()
 
-	ctx := context.Background()
-	src := strings.Repeat("a", 1000)
-	resp, err := client.Submit(ctx, &pb.SubmitRequest{
-		Problem: "aplusb",
-		Source:  src,
-		Lang:    "cpp",
-	})
+	if _, err := client.ProblemCaseData(loginAsTester(t, client), req); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("Success to fetch case data by non-admin: ", err)
+	}
+	ctx := loginAsAdmin(t, client)
+	resp, err := client.ProblemCaseData(ctx, req)
 	if err != nil {
-		t.Fatal("Unsuccess to submit source")
+		t.Fatal(err)
 	}
-	_, err = client.Rejudge(ctx, &pb.RejudgeRequest{
-		Id: resp.Id,
-	})
-	if err == nil {
-		t.Fatal("Success to rejudge")
+	if resp.CaseVersion != "dummy-initial-version" || string(resp.Input) != "1 2\n" || string(resp.Output) != "3\n" || resp.InputSize != 4 || resp.OutputSize != 2 {
+		t.Fatal("Invalid case data: ", resp)
+	}
+
+	resp, err = client.ProblemCaseData(ctx, &pb.ProblemCaseDataRequest{Problem: "aplusb", Case: "large_00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Output) != caseDataMaxSize || resp.OutputSize != int64(len(largeOutput)) {
+		t.Fatal("Output is not truncated: ", len(resp.Output), resp.OutputSize)
+	}
+
+	for _, name := range []string{"unknown_00", "no_output_00"} {
+		if _, err := client.ProblemCaseData(ctx, &pb.ProblemCaseDataRequest{Problem: "aplusb", Case: name}); status.Code(err) != codes.NotFound {
+			t.Fatal("Success to fetch an unknown case: ", name, err)
+		}
+	}
+	if _, err := client.ProblemCaseData(ctx, &pb.ProblemCaseDataRequest{Problem: "aplusb", Case: "../in/example_00"}); err == nil {
+		t.Fatal("Success to fetch a case with an invalid name")
 	}
 }
 
-func TestRejudgeTwice(t *testing.T) {
+func TestProblemByTesthash(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
-	src := strings.Repeat("a", 1000)
-	resp, err := client.Submit(judgeCtx, &pb.SubmitRequest{
-		Problem: "aplusb",
-		Source:  src,
-		Lang:    "cpp",
+	ctx := loginAsAdmin(t, client)
+	problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
 	})
 	if err != nil {
-		t.Fatal("Unsuccess to submit source")
+		t.Fatal(err)
 	}
-
-	task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-		JudgeName:    "judge-test",
-		ExpectedTime: durationpb.New(2 * time.Second),
+	resp, err := client.ProblemByTesthash(ctx, &pb.ProblemByTesthashRequest{
+		Testhash: problem.CaseVersion,
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	id := task.SubmissionId
-	if id == -1 {
-		t.Fatal("Cannot fetch task")
+	if !reflect.DeepEqual(resp.Names, []string{"aplusb"}) {
+		t.Fatal("Invalid problems: ", resp.Names)
 	}
 
-	if id != resp.Id {
-		t.Fatalf("Differ ID %v vs %v", id, resp.Id)
+	if _, err := client.ProblemByTesthash(loginAsTester(t, client), &pb.ProblemByTesthashRequest{
+		Testhash: problem.CaseVersion,
+	}); err == nil {
+		t.Fatal("Success to call ProblemByTesthash by non-admin")
 	}
+}
 
-	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-		JudgeName: "judge-test",
-		Status:    "Judging",
-		CaseResults: []*pb.SubmissionCaseResult{
-			{
-				Case:   "test00",
-				Status: "AC",
-				Time:   1.0,
-				Memory: 1,
-			},
-		},
-		SubmissionId: id,
+func TestFeaturedProblems(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	if _, err := client.ChangeFeaturedProblems(loginAsTester(t, client), &pb.ChangeFeaturedProblemsRequest{
+		Problems: []string{"aplusb"},
+	}); err == nil {
+		t.Fatal("Success to change featured problems by non-admin")
+	}
+	if _, err := client.ChangeFeaturedProblems(ctx, &pb.ChangeFeaturedProblemsRequest{
+		Problems: []string{"aplusb", "unknown-problem"},
+	}); err == nil {
+		t.Fatal("Success to feature unknown problem")
+	}
+	if _, err := client.ChangeFeaturedProblems(ctx, &pb.ChangeFeaturedProblemsRequest{
+		Problems: []string{"aplusb"},
 	}); err != nil {
 		t.Fatal(err)
 	}
-
-	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
-		JudgeName:    "judge-test",
-		Status:       "AC",
-		SubmissionId: id,
-	}); err != nil {
+	resp, err := client.FeaturedProblems(context.Background(), &pb.FeaturedProblemsRequest{})
+	if err != nil {
 		t.Fatal(err)
 	}
+	if len(resp.Problems) != 1 || resp.Problems[0].Name != "aplusb" || resp.Problems[0].Title != "A + B" {
+		t.Fatal("Invalid featured problems: ", resp.Problems)
+	}
 
-	_, err = client.Rejudge(judgeCtx, &pb.RejudgeRequest{
-		Id: resp.Id,
-	})
+	if _, err := client.ChangeFeaturedProblems(ctx, &pb.ChangeFeaturedProblemsRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.FeaturedProblems(context.Background(), &pb.FeaturedProblemsRequest{})
 	if err != nil {
-		t.Fatal("Failed to rejudge")
+		t.Fatal(err)
 	}
-	_, err = client.Rejudge(judgeCtx, &pb.RejudgeRequest{
-		Id: resp.Id,
-	})
-	if err == nil {
-		t.Fatal("Success to rejudge")
+	if len(resp.Problems) != 0 {
+		t.Fatal("Featured problems are not cleared: ", resp.Problems)
 	}
-	t.Log(err)
 }
 
-func TestAdmin(t *testing.T) {
+func TestSubmissionSortOrderList(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	ctx := loginAsAdmin(t, client)
-	resp, err := client.UserInfo(ctx, &pb.UserInfoRequest{})
-	if err != nil {
-		t.Fatal("Failed UserInfo")
+	ctx := context.Background()
+	for _, order := range []string{"", "-id", "+time"} {
+		_, err := client.SubmissionList(ctx, &pb.SubmissionListRequest{
+			Skip:  0,
+			Limit: 100,
+			Order: order,
+		})
+		if err != nil {
+			t.Fatal("Failed SubmissionList Order: ", order)
+		}
 	}
-	if !resp.User.IsAdmin {
-		t.Fatal("isAdmin(admin) = False")
+	_, err := client.SubmissionList(ctx, &pb.SubmissionListRequest{
+		Skip:  0,
+		Limit: 100,
+		Order: "dummy",
+	})
+	if err == nil {
+		t.Fatal("Success SubmissionList Dummy Order")
 	}
+	t.Log(err)
 }
 
-func TestNotAdmin(t *testing.T) {
+func TestRecentSubmissions(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	ctx := loginAsTester(t, client)
-	resp, err := client.UserInfo(ctx, &pb.UserInfoRequest{})
+	var ids []int32
+	for i := 0; i < 3; i++ {
+		ids = append(ids, submitSomething(t, client))
+	}
+
+	ctx := context.Background()
+	resp, err := client.RecentSubmissions(ctx, &pb.RecentSubmissionsRequest{
+		Limit: 2,
+	})
 	if err != nil {
-		t.Fatal("Failed UserInfo")
+		t.Fatal(err)
 	}
-	if resp.User.IsAdmin {
-		t.Fatal("isAdmin(tester) = True")
+	if len(resp.Submissions) != 2 {
+		t.Fatal("Invalid number of submissions: ", len(resp.Submissions))
+	}
+	if resp.Submissions[0].Id != ids[2] || resp.Submissions[1].Id != ids[1] {
+		t.Fatal("Submissions are not newest first: ", resp.Submissions)
 	}
 }
 
-func TestUserList(t *testing.T) {
+func TestSubmissionListDefaultLimit(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	ctx := loginAsAdmin(t, client)
-	_, err := client.UserList(ctx, &pb.UserListRequest{})
+	submitSomething(t, client)
+	list, err := client.SubmissionList(context.Background(), &pb.SubmissionListRequest{})
 	if err != nil {
-		t.Fatal("Failed UserList")
+		t.Fatal(err)
+	}
+	if len(list.Submissions) == 0 {
+		t.Fatal("Empty page for unspecified limit")
 	}
 }
 
-func TestNotAdminUserList(t *testing.T) {
-	client, close := createAPIClient(t, createTestDB(t))
+func TestSubmissionListFirstAC(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
 	defer close()
 
 	ctx := loginAsTester(t, client)
-	_, err := client.UserList(ctx, &pb.UserListRequest{})
-	if err == nil {
-		t.Fatal("Success UserList with tester")
+	var ids []int32
+	for i := 0; i < 3; i++ {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  fmt.Sprintf("source %d", i),
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.Id)
+	}
+	// WA -> AC -> AC
+	for i, status := range []string{"WA", "AC", "AC"} {
+		if err := db.Model(&Submission{}).Where("id = ?", ids[i]).Update("status", status).Error; err != nil {
+			t.Fatal(err)
+		}
 	}
-	t.Log(err)
-}
-
-func TestCreateUser(t *testing.T) {
-	client, close := createAPIClient(t, createTestDB(t))
-	defer close()
 
-	ctx := context.Background()
-	resp, err := client.Register(ctx, &pb.RegisterRequest{
-		Name:     uuid.New().String(),
-		Password: "password",
+	list, err := client.SubmissionList(ctx, &pb.SubmissionListRequest{
+		Limit:   100,
+		User:    "tester",
+		FirstAc: true,
 	})
 	if err != nil {
-		t.Fatal("Failed to Register")
+		t.Fatal(err)
 	}
-	ctx = clientutil.ContextWithToken(ctx, resp.Token)
-	_, err = client.UserInfo(ctx, &pb.UserInfoRequest{})
-	if err != nil {
-		t.Fatal("Failed to UserInfo")
+	if list.Count != 1 || len(list.Submissions) != 1 || list.Submissions[0].Id != ids[1] {
+		t.Fatal("Invalid first AC submissions: ", list)
 	}
 }
 
-func TestChangeUserInfo(t *testing.T) {
-	client, close := createAPIClient(t, createTestDB(t))
+func TestSubmissionStatusCounts(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
 	defer close()
 
-	// admin add bob
-	ctx := context.Background()
-	aliceCtx := loginAsAdmin(t, client)
-	bobName := uuid.New().String()
-	regResp, err := client.Register(ctx, &pb.RegisterRequest{
-		Name:     bobName,
-		Password: "password",
-	})
-	bobCtx := clientutil.ContextWithToken(ctx, regResp.Token)
-	if err != nil {
-		t.Fatal("Failed to Register")
+	ctx := loginAsTester(t, client)
+	for i, status := range []string{"WA", "AC", "AC"} {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  fmt.Sprintf("source %d", i),
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Model(&Submission{}).Where("id = ?", resp.Id).Update("status", status).Error; err != nil {
+			t.Fatal(err)
+		}
 	}
+	// not matched to the filter
+	submitSomething(t, client)
 
-	_, err = client.ChangeUserInfo(aliceCtx, &pb.ChangeUserInfoRequest{
-		User: &pb.User{
-			Name:    bobName,
-			IsAdmin: true,
-		},
+	resp, err := client.SubmissionStatusCounts(ctx, &pb.SubmissionStatusCountsRequest{
+		Filter: &pb.SubmissionListRequest{User: "tester"},
 	})
 	if err != nil {
-		t.Fatal("Failed to add Admin:", err)
+		t.Fatal(err)
 	}
-	resp, err := client.UserInfo(bobCtx, &pb.UserInfoRequest{})
+	if resp.Total != 3 || len(resp.Counts) != 2 ||
+		resp.Counts[0].Status != "AC" || resp.Counts[0].Count != 2 ||
+		resp.Counts[1].Status != "WA" || resp.Counts[1].Count != 1 {
+		t.Fatal("Invalid counts: ", resp)
+	}
+
+	if _, err := client.SubmissionStatusCounts(context.Background(), &pb.SubmissionStatusCountsRequest{
+		Filter: &pb.SubmissionListRequest{MinTime: 1.0, MaxTime: 0.5},
+	}); err == nil {
+		t.Fatal("Success to count with invalid time range")
+	}
+}
+
+func TestLangStatistics(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	for i, c := range []struct {
+		lang   string
+		status string
+	}{
+		{"cpp", "AC"},
+		{"cpp", "WA"},
+		{"cpp", "AC"},
+		{"python3", "AC"},
+	} {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  fmt.Sprintf("lang statistics %d", i),
+			Lang:    c.lang,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Model(&Submission{}).Where("id = ?", resp.Id).Update("status", c.status).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := client.LangStatistics(ctx, &pb.LangStatisticsRequest{})
 	if err != nil {
-		t.Fatal("Failed UserInfo")
+		t.Fatal(err)
 	}
-	if !resp.User.IsAdmin {
-		t.Fatal("Not promote to admin")
+	if resp.Total != 4 || len(resp.Langs) != 2 ||
+		resp.Langs[0].Lang != "cpp" || resp.Langs[0].Count != 3 || len(resp.Langs[0].StatusCounts) != 2 ||
+		resp.Langs[0].StatusCounts[0].Status != "AC" || resp.Langs[0].StatusCounts[0].Count != 2 ||
+		resp.Langs[1].Lang != "python3" || resp.Langs[1].Count != 1 {
+		t.Fatal("Invalid statistics: ", resp)
 	}
 
-	_, err = client.ChangeUserInfo(aliceCtx, &pb.ChangeUserInfoRequest{
-		User: &pb.User{
-			Name:    bobName,
-			IsAdmin: false,
-		},
-	})
+	resp, err = client.LangStatistics(ctx, &pb.LangStatisticsRequest{AcOnly: true})
 	if err != nil {
-		t.Fatal("Failed to add Admin:", err)
+		t.Fatal(err)
 	}
-	resp, err = client.UserInfo(bobCtx, &pb.UserInfoRequest{})
+	if resp.Total != 3 || resp.Langs[0].Count != 2 {
+		t.Fatal("Invalid AC statistics: ", resp)
+	}
+	// statistics are cached
+	submitSomething(t, client)
+	resp, err = client.LangStatistics(ctx, &pb.LangStatisticsRequest{})
 	if err != nil {
-		t.Fatal("Failed UserInfo")
+		t.Fatal(err)
 	}
-	if resp.User.IsAdmin {
-		t.Fatal("Cannot remove admin")
+	if resp.Total != 4 {
+		t.Fatal("Statistics are not cached: ", resp)
 	}
+}
 
-	_, err = client.ChangeUserInfo(aliceCtx, &pb.ChangeUserInfoRequest{
-		User: &pb.User{
-			Name:    "admin",
-			IsAdmin: false,
-		},
-	})
-	if err == nil {
-		t.Fatal("Success to remove myself")
+func TestSourceSimilarity(t *testing.T) {
+	a := "int main() { int a, b; cin >> a >> b; cout << a + b << endl; }"
+	b := "int  main()\n{\n  int a, b;\n  cin >> a >> b;\n  cout << a + b << endl;\n}"
+	c := "print(sum(map(int, input().split())))"
+	if sim := sourceSimilarity(a, b); sim != 1.0 {
+		t.Fatal("Similarity of the same tokens is not 1: ", sim)
+	}
+	if sim := sourceSimilarity(a, c); sim > 0.1 {
+		t.Fatal("Similarity of different sources is too high: ", sim)
 	}
-	t.Log(err)
 }
 
-func TestChangeDummyUserInfo(t *testing.T) {
+func TestUnifiedDiff(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	b := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	expect := "--- old\n+++ new\n" +
+		"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+		"@@ -9,3 +9,4 @@\n i\n j\n k\n+l\n"
+	diff, err := unifiedDiff(a, b, "old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != expect {
+		t.Fatalf("Invalid diff:\n%v", diff)
+	}
+	if diff, err := unifiedDiff(a, a, "old", "new"); err != nil || diff != "" {
+		t.Fatal("Diff of the same sources: ", diff, err)
+	}
+	if diff, err := unifiedDiff("", "x\n", "old", "new"); err != nil || diff != "--- old\n+++ new\n@@ -0,0 +1,1 @@\n+x\n" {
+		t.Fatal("Invalid diff from empty: ", diff, err)
+	}
+}
+
+func TestSubmissionDiff(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	// admin add bob
-	ctx := loginAsAdmin(t, client)
+	ctx := loginAsTester(t, client)
+	var ids []int32
+	for _, src := range []string{"int main() {\n}\n", "int main() {\n    return 0;\n}\n"} {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  src,
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.Id)
+	}
 
-	_, err := client.ChangeUserInfo(ctx, &pb.ChangeUserInfoRequest{
-		User: &pb.User{
-			Name:    "this_is_dummy_user_name",
-			IsAdmin: true,
-		},
-	})
-	if err == nil {
-		t.Fatal("Success to change unknown user")
+	resp, err := client.SubmissionDiff(ctx, &pb.SubmissionDiffRequest{Id: ids[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PreviousId != 0 || resp.Diff != "" {
+		t.Fatal("Invalid diff of the first submission: ", resp)
+	}
+	resp, err = client.SubmissionDiff(ctx, &pb.SubmissionDiffRequest{Id: ids[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PreviousId != ids[0] || !strings.Contains(resp.Diff, "+    return 0;\n") {
+		t.Fatal("Invalid diff: ", resp)
+	}
+
+	// only the submitter (or admin) can see the diff
+	if _, err := client.SubmissionDiff(context.Background(), &pb.SubmissionDiffRequest{Id: ids[1]}); err == nil {
+		t.Fatal("Success to get diff without login")
 	}
-	t.Log(err)
 }
 
-func TestAddAdminByNotAdmin(t *testing.T) {
+func TestSearchSubmissionSource(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	// admin add bob
-	ctx := context.Background()
-
-	aliceCtx := loginAsTester(t, client)
+	ctx := loginAsAdmin(t, client)
+	var ids []int32
+	for _, src := range []string{"int main() { return 0; } // MAGIC_100%", "int main() { return 1; } // magic", "print(1) # MAGIC_100%"} {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  src,
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.Id)
+	}
 
-	bobName := uuid.New().String()
-	regResp, err := client.Register(ctx, &pb.RegisterRequest{
-		Name:     bobName,
-		Password: "password",
+	resp, err := client.SearchSubmissionSource(ctx, &pb.SearchSubmissionSourceRequest{
+		Query: "magic_100%",
 	})
 	if err != nil {
-		t.Fatal("Failed to Register")
+		t.Fatal(err)
 	}
-	bobCtx := clientutil.ContextWithToken(context.Background(), regResp.Token)
-
-	_, err = client.ChangeUserInfo(aliceCtx, &pb.ChangeUserInfoRequest{
-		User: &pb.User{
-			Name:    bobName,
-			IsAdmin: true,
-		},
-	})
-	if err == nil {
-		t.Fatal("Success to add Admin")
+	if len(resp.Submissions) != 2 || resp.Submissions[0].Id != ids[2] || resp.Submissions[1].Id != ids[0] {
+		t.Fatal("Invalid search result: ", resp.Submissions)
 	}
-	t.Log(err)
-	resp, err := client.UserInfo(bobCtx, &pb.UserInfoRequest{})
+	resp, err = client.SearchSubmissionSource(ctx, &pb.SearchSubmissionSourceRequest{
+		Query: "magic",
+		Limit: 1,
+	})
 	if err != nil {
-		t.Fatal("Failed UserInfo")
+		t.Fatal(err)
 	}
-	if resp.User.IsAdmin {
-		t.Fatal("Promote to admin")
+	if len(resp.Submissions) != 1 {
+		t.Fatal("Limit is ignored: ", resp.Submissions)
+	}
+
+	if _, err := client.SearchSubmissionSource(ctx, &pb.SearchSubmissionSourceRequest{Query: "ma"}); err == nil {
+		t.Fatal("Success to search by too short query")
+	}
+	if _, err := client.SearchSubmissionSource(loginAsTester(t, client), &pb.SearchSubmissionSourceRequest{Query: "magic"}); err == nil {
+		t.Fatal("Success to search by non-admin")
 	}
 }
 
-func TestOtherJudge(t *testing.T) {
+func TestCompareSubmissions(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
-	id := submitSomething(t, client)
-	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-		JudgeName: "judge-test",
-	})
+	id1 := submitSomething(t, client)
+	id2 := submitSomething(t, client)
+
+	req := &pb.CompareSubmissionsRequest{Id1: id1, Id2: id2}
+	if _, err := client.CompareSubmissions(loginAsTester(t, client), req); err == nil {
+		t.Fatal("Success to compare by non admin")
+	}
+	resp, err := client.CompareSubmissions(loginAsAdmin(t, client), req)
 	if err != nil {
-		t.Fatal("Failed to PopJudgeTask:", err)
+		t.Fatal(err)
 	}
-
-	if id != resp.SubmissionId {
-		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	if resp.Overview1.Id != id1 || resp.Overview2.Id != id2 || resp.Source1 != resp.Source2 {
+		t.Fatal("Invalid response: ", resp)
 	}
-
-	_, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-		JudgeName:    "judge-other",
-		Status:       "Judging",
-		SubmissionId: id,
-	})
-	if err == nil {
-		t.Fatal("Success to SyncJudgeTaskStatus")
+	if resp.Similarity != 1.0 {
+		t.Fatal("Similarity is not 1: ", resp.Similarity)
 	}
-	t.Log(err)
 }
 
-func TestJudgeSyncAfterFinished(t *testing.T) {
-	client, close := createAPIClient(t, createTestDB(t))
+func TestScanPlagiarism(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
-	id := submitSomething(t, client)
+	var ids []int32
+	for _, src := range []string{
+		"int main() { int a, b; cin >> a >> b; cout << a + b << endl; }",
+		"int main() {\n  int a, b;\n  cin >> a >> b;\n  cout << a + b << endl;\n}",
+		"print(sum(map(int, input().split())))",
+	} {
+		resp, err := client.Submit(context.Background(), &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  src,
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.Id)
+	}
+	if err := db.Model(&Submission{}).Where("id in ?", ids).Update("status", "AC").Error; err != nil {
+		t.Fatal(err)
+	}
 
-	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-		JudgeName: "judge-test",
-	})
+	req := &pb.ScanPlagiarismRequest{Problem: "aplusb"}
+	if _, err := client.ScanPlagiarism(loginAsTester(t, client), req); err == nil {
+		t.Fatal("Success to scan by non admin")
+	}
+	resp, err := client.ScanPlagiarism(loginAsAdmin(t, client), req)
 	if err != nil {
-		t.Fatal("Failed to PopJudgeTask:", err)
+		t.Fatal(err)
 	}
-
-	if id != resp.SubmissionId {
-		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	if resp.Count != 3 || len(resp.Pairs) != 1 || resp.Pairs[0].Id1 != ids[0] || resp.Pairs[0].Id2 != ids[1] {
+		t.Fatal("Invalid pairs: ", resp)
 	}
+}
 
-	_, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
-		JudgeName:    "judge-test",
-		Status:       "AC",
-		SubmissionId: id,
+func TestSourceClusters(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	id1 := submitSomething(t, client)
+	id2 := submitSomething(t, client)
+	resp, err := client.Submit(loginAsTester(t, client), &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "this is a test source",
+		Lang:    "cpp",
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id3 := resp.Id
+	// submitted before the column is added
+	legacy := Submission{
+		ProblemName: "aplusb",
+		Lang:        "cpp",
+		Status:      "AC",
+		Source:      "this is a test source",
+		SubmitTime:  time.Now(),
+	}
+	if err := db.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := fillSourceHash(db); err != nil {
+		t.Fatal(err)
+	}
+	// fillSourceHash runs only once
+	if err := db.Model(&Submission{}).Where("id = ?", legacy.ID).Update("source_hash", "").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := fillSourceHash(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Select("source_hash").Take(&legacy, legacy.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if legacy.SourceHash != "" {
+		t.Fatal("fillSourceHash runs twice")
+	}
+	if err := db.Model(&Submission{}).Where("id = ?", legacy.ID).Update("source_hash", sourceHash(legacy.Source)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Submit(context.Background(), &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "unique source",
+		Lang:    "cpp",
+	}); err != nil {
+		t.Fatal(err)
+	}
 
+	req := &pb.SourceClustersRequest{Problem: "aplusb"}
+	if _, err := client.SourceClusters(loginAsTester(t, client), req); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("Success to fetch clusters by non admin: ", err)
+	}
+	clusters, err := client.SourceClusters(loginAsAdmin(t, client), req)
 	if err != nil {
-		t.Fatal("JudgeSync Failed:", err)
+		t.Fatal(err)
+	}
+	if len(clusters.Clusters) != 1 {
+		t.Fatal("Invalid clusters: ", clusters)
+	}
+	cluster := clusters.Clusters[0]
+	if cluster.SourceHash != sourceHash("this is a test source") || cluster.Size != 4 || cluster.UserCount != 1 ||
+		!reflect.DeepEqual(cluster.Ids, []int32{id1, id2, id3, legacy.ID}) {
+		t.Fatal("Invalid cluster: ", cluster)
 	}
 
-	_, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
-		JudgeName:    "judge-test",
-		Status:       "AC",
-		SubmissionId: id,
-	})
-	if err == nil {
-		t.Fatal("Success to FinishJudgeTask Twice")
+	req.MinSize = 5
+	clusters, err = client.SourceClusters(loginAsAdmin(t, client), req)
+	if err != nil {
+		t.Fatal(err)
 	}
-	t.Log(err)
-	_, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-		JudgeName:    "judge-test",
-		Status:       "AC",
-		SubmissionId: id,
-	})
-	if err == nil {
-		t.Fatal("Success to SyncJudgeTaskStatus after finished")
+	if len(clusters.Clusters) != 0 {
+		t.Fatal("Invalid clusters: ", clusters)
 	}
-	t.Log(err)
 }
 
-func TestSimulateJudge(t *testing.T) {
+func TestSubmissionNote(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
 	id := submitSomething(t, client)
+	adminCtx := loginAsAdmin(t, client)
+	testerCtx := loginAsTester(t, client)
 
-	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-		JudgeName: "judge-test",
-	})
-	if err != nil {
-		t.Fatal("Failed to PopJudgeTask:", err)
+	req := &pb.ChangeSubmissionNoteRequest{
+		Id:   id,
+		Note: "same as #1",
+		Tags: []string{"suspicious", "copied"},
 	}
-
-	if id != resp.SubmissionId {
-		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	if _, err := client.ChangeSubmissionNote(testerCtx, req); err == nil {
+		t.Fatal("Success to change note by non admin")
 	}
-
-	cases := []*pb.SubmissionCaseResult{
-		{
-			Case:   "test00",
-			Status: "AC",
-			Time:   1.0,
-			Memory: 1,
-		},
-		{
-			Case:   "test01",
-			Status: "WA",
-			Time:   1.0,
-			Memory: 1,
-		},
-		{
-			Case:   "test02",
-			Status: "TLE",
-			Time:   1.0,
-			Memory: 1,
-		},
-	}
-	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-		JudgeName:    "judge-test",
-		Status:       "Judging",
-		CaseResults:  cases[0:2],
-		SubmissionId: id,
-	}); err != nil {
-		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	if _, err := client.ChangeSubmissionNote(adminCtx, req); err != nil {
+		t.Fatal(err)
 	}
 
-	sub := testFetchSubmission(t, id, client)
-	if sub.Overview.Status != "Judging" {
-		t.Fatal("Status is not changed: ", sub.Overview.Status)
+	if _, err := client.SubmissionNote(testerCtx, &pb.SubmissionNoteRequest{Id: id}); err == nil {
+		t.Fatal("Success to read note by non admin")
 	}
-	assertEqualCases(t, cases[0:2], sub.CaseResults)
-
+	resp, err := client.SubmissionNote(adminCtx, &pb.SubmissionNoteRequest{Id: id})
 	if err != nil {
-		t.Fatal("Failed to PopJudgeTask:", err)
+		t.Fatal(err)
 	}
-
-	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-		JudgeName:    "judge-test",
-		Status:       "TLE",
-		Time:         1.234,
-		Memory:       5678,
-		CaseResults:  cases[2:3],
-		SubmissionId: id,
-	}); err != nil {
-		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	if resp.Note != req.Note || !reflect.DeepEqual(resp.Tags, req.Tags) {
+		t.Fatal("Note is not changed: ", resp)
 	}
+}
 
-	sub = testFetchSubmission(t, id, client)
-	if sub.Overview.Status != "TLE" {
-		t.Fatal("Status is not changed")
+func TestProblemFastestSubmissions(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	testerCtx := loginAsTester(t, client)
+	adminCtx := loginAsAdmin(t, client)
+	var ids []int32
+	for i, ctx := range []context.Context{testerCtx, testerCtx, adminCtx} {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  fmt.Sprintf("source %d", i),
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.Id)
+	}
+	// time: 300ms, 100ms, 200ms
+	for i, maxTime := range []int32{300, 100, 200} {
+		if err := db.Model(&Submission{}).Where("id = ?", ids[i]).Updates(map[string]interface{}{
+			"status":     "AC",
+			"max_time":   maxTime,
+			"max_memory": 100 - maxTime/100,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
 	}
-	if math.Abs(sub.Overview.Time-1.234) >= 0.00001 {
-		t.Fatal("Time is not changed:", sub.Overview.Time)
+
+	resp, err := client.ProblemFastestSubmissions(context.Background(), &pb.ProblemFastestSubmissionsRequest{
+		Problem: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if sub.Overview.Memory != 5678 {
-		t.Fatal("Memory is not changed")
+	if len(resp.Submissions) != 2 || resp.Submissions[0].Id != ids[1] || resp.Submissions[1].Id != ids[2] {
+		t.Fatal("Invalid fastest submissions: ", resp.Submissions)
 	}
-	assertEqualCases(t, cases[0:3], sub.CaseResults)
 
-	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
-		JudgeName:    "judge-test",
-		Status:       "TLE",
-		Time:         2.345,
-		Memory:       6789,
-		SubmissionId: id,
-		CaseVersion:  "test-version",
-	}); err != nil {
-		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	resp, err = client.ProblemFastestSubmissions(context.Background(), &pb.ProblemFastestSubmissionsRequest{
+		Problem:        "aplusb",
+		Order:          "memory",
+		AllSubmissions: true,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
+	if len(resp.Submissions) != 3 || resp.Submissions[0].Id != ids[0] {
+		t.Fatal("Invalid lowest memory submissions: ", resp.Submissions)
+	}
+}
 
-	sub = testFetchSubmission(t, id, client)
-	if sub.Overview.Status != "TLE" {
-		t.Fatal("Status is not changed")
+func TestPublicServer(t *testing.T) {
+	config := DefaultServerConfig()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
 	}
-	if math.Abs(sub.Overview.Time-2.345) >= 0.00001 {
-		t.Fatal("Time is not changed:", sub.Overview.Time)
+	config.InternalMethods = []string{"UnknownMethod"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("Unknown internal method is accepted")
 	}
-	if sub.Overview.Memory != 6789 {
-		t.Fatal("Memory is not changed")
+
+	config = DefaultServerConfig()
+	config.Public = true
+	client, close := createAPIClientWithConfig(t, createTestDB(t), config)
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	if _, err := client.PopJudgeTask(ctx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("Judge RPC is available on the public server: ", err)
+	}
+	if _, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestSimulateRejudge(t *testing.T) {
+func TestAuthErrorCodes(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
 	id := submitSomething(t, client)
+	anonymous := context.Background()
+	tester := loginAsTester(t, client)
+
+	for _, c := range []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"UserList (anonymous)", func() error {
+			_, err := client.UserList(anonymous, &pb.UserListRequest{})
+			return err
+		}, codes.Unauthenticated},
+		{"UserList (tester)", func() error {
+			_, err := client.UserList(tester, &pb.UserListRequest{})
+			return err
+		}, codes.PermissionDenied},
+		{"ChangeUserInfo (anonymous)", func() error {
+			_, err := client.ChangeUserInfo(anonymous, &pb.ChangeUserInfoRequest{User: &pb.User{Name: "tester"}})
+			return err
+		}, codes.Unauthenticated},
+		{"ChangeUserInfo (tester)", func() error {
+			_, err := client.ChangeUserInfo(tester, &pb.ChangeUserInfoRequest{User: &pb.User{Name: "admin"}})
+			return err
+		}, codes.PermissionDenied},
+		{"Rejudge (anonymous)", func() error {
+			_, err := client.Rejudge(anonymous, &pb.RejudgeRequest{Id: id})
+			return err
+		}, codes.Unauthenticated},
+		{"Rejudge (tester)", func() error {
+			_, err := client.Rejudge(tester, &pb.RejudgeRequest{Id: id})
+			return err
+		}, codes.PermissionDenied},
+		{"PopJudgeTask (anonymous)", func() error {
+			_, err := client.PopJudgeTask(anonymous, &pb.PopJudgeTaskRequest{JudgeName: "judge-test"})
+			return err
+		}, codes.Unauthenticated},
+		{"PopJudgeTask (tester)", func() error {
+			_, err := client.PopJudgeTask(tester, &pb.PopJudgeTaskRequest{JudgeName: "judge-test"})
+			return err
+		}, codes.PermissionDenied},
+		{"RegisterJudge (tester)", func() error {
+			_, err := client.RegisterJudge(tester, &pb.RegisterJudgeRequest{Name: "judge-test"})
+			return err
+		}, codes.PermissionDenied},
+	} {
+		if code := status.Code(c.call()); code != c.code {
+			t.Fatalf("%s: code %v, expected %v", c.name, code, c.code)
+		}
+	}
+}
 
-	for i := 0; i < 3; i++ {
-		log.Printf("Start %v/3", i+1)
-		if i > 0 {
-			if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{
-				Id: id,
-			}); err != nil {
-				t.Fatal("Failed to Rejudge:", err)
-			}
+func TestServerMetadata(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := context.Background()
+	resp, err := client.ServerMetadata(ctx, &pb.ServerMetadataRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Statuses) == 0 || resp.Statuses[0] != "AC" || len(resp.Langs) == 0 {
+		t.Fatal("Invalid metadata: ", resp)
+	}
+	for _, status := range resp.PendingStatuses {
+		if status == "Draft" {
+			t.Fatal("Draft is pending: ", resp.PendingStatuses)
 		}
-		resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-			JudgeName: "judge-test",
-		})
-		if err != nil {
-			t.Fatal("Failed to PopJudgeTask:", err)
+	}
+	// all orders are accepted
+	for _, order := range resp.SubmissionListOrders {
+		if _, err := client.SubmissionList(ctx, &pb.SubmissionListRequest{Order: order}); err != nil {
+			t.Fatal("Failed SubmissionList Order: ", order)
 		}
-
-		if id != resp.SubmissionId {
-			t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	}
+	for _, order := range resp.ProblemListOrders {
+		if _, err := client.ProblemList(ctx, &pb.ProblemListRequest{Order: order}); err != nil {
+			t.Fatal("Failed ProblemList Order: ", order)
 		}
-
-		if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-			JudgeName: "judge-test",
-			Status:    "Judging",
-			CaseResults: []*pb.SubmissionCaseResult{
-				{
-					Case:   "test00",
-					Status: "AC",
-					Time:   1.0,
-					Memory: 1,
-				},
-			},
-			SubmissionId: id,
-		}); err != nil {
-			t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	}
+	for _, order := range resp.FastestSubmissionsOrders {
+		if _, err := client.ProblemFastestSubmissions(ctx, &pb.ProblemFastestSubmissionsRequest{Problem: "aplusb", Order: order}); err != nil {
+			t.Fatal("Failed ProblemFastestSubmissions Order: ", order)
 		}
+	}
+}
 
-		if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
-			JudgeName:    "judge-test",
-			Status:       "AC",
-			SubmissionId: id,
-		}); err != nil {
-			t.Fatal("Failed to FinishJudgeTaskStatus:", err)
-		}
+func TestServerStatus(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	resp, err := client.ServerStatus(context.Background(), &pb.ServerStatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version == "" || !resp.Uptime.IsValid() || len(resp.Features) == 0 {
+		t.Fatal("Invalid server status: ", resp)
+	}
+	if resp.Maintenance {
+		t.Fatal("Server is under maintenance")
 	}
 }
 
-func TestSimulateHack(t *testing.T) {
+func TestMaintenance(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
+	adminCtx := loginAsAdmin(t, client)
 	id := submitSomething(t, client)
-
-	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+	submitSomething(t, client)
+	task, err := client.PopJudgeTask(adminCtx, &pb.PopJudgeTaskRequest{
 		JudgeName: "judge-test",
 	})
 	if err != nil {
-		t.Fatal("Failed to PopJudgeTask:", err)
+		t.Fatal(err)
 	}
-
-	if id != resp.SubmissionId {
-		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	if task.SubmissionId != id {
+		t.Fatalf("ID is differ, %v vs %v", id, task.SubmissionId)
 	}
-
-	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-		JudgeName: "judge-test",
-		Status:    "Judging",
-		CaseResults: []*pb.SubmissionCaseResult{
-			{
-				Case:   "test00",
-				Status: "AC",
-				Time:   1.0,
-				Memory: 1,
-			},
-		},
-		SubmissionId: id,
-	}); err != nil {
-		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	if _, err := client.ChangeMaintenance(loginAsTester(t, client), &pb.ChangeMaintenanceRequest{
+		Maintenance: true,
+	}); err == nil {
+		t.Fatal("Success to change maintenance by non admin")
 	}
-
-	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
-		JudgeName:    "judge-test",
-		Status:       "AC",
-		SubmissionId: id,
+	if _, err := client.ChangeMaintenance(adminCtx, &pb.ChangeMaintenanceRequest{
+		Maintenance: true,
+		Message:     "migrating testcases",
 	}); err != nil {
-		t.Fatal("Failed to FinishJudgeTaskStatus:", err)
+		t.Fatal(err)
 	}
 
-	// AC -> WA
-	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{
-		Id: id,
-	}); err != nil {
-		t.Fatal("Failed to Rejudge:", err)
+	serverStatus, err := client.ServerStatus(context.Background(), &pb.ServerStatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serverStatus.Maintenance || serverStatus.MaintenanceMessage != "migrating testcases" {
+		t.Fatal("Maintenance is not changed: ", serverStatus)
 	}
 
-	resp, err = client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-		JudgeName: "judge-test",
+	_, err = client.Submit(adminCtx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "source",
+		Lang:    "cpp",
 	})
-	if err != nil {
-		t.Fatal("Failed to PopJudgeTask:", err)
+	if status.Code(err) != codes.Unavailable {
+		t.Fatal("Submit is not Unavailable: ", err)
 	}
-
-	if id != resp.SubmissionId {
-		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	if _, err := client.ProblemInfo(context.Background(), &pb.ProblemInfoRequest{Name: "aplusb"}); err != nil {
+		t.Fatal(err)
 	}
-
-	if testFetchSubmission(t, id, client).Overview.Hacked {
-		t.Fatal("Hacked should not be true")
+	if _, err := client.ChangeFeaturedProblems(adminCtx, &pb.ChangeFeaturedProblemsRequest{
+		Problems: []string{"aplusb"},
+	}); status.Code(err) != codes.Unavailable {
+		t.Fatal("ChangeFeaturedProblems is not Unavailable: ", err)
 	}
-
-	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+	// no new judge tasks, but the popped one can be finished
+	if _, err := client.PopJudgeTask(adminCtx, &pb.PopJudgeTaskRequest{
 		JudgeName: "judge-test",
-		Status:    "Judging",
-		CaseResults: []*pb.SubmissionCaseResult{
-			{
-				Case:   "test00",
-				Status: "WA",
-				Time:   1.0,
-				Memory: 1,
-			},
-		},
+	}); status.Code(err) != codes.Unavailable {
+		t.Fatal("PopJudgeTask is not Unavailable: ", err)
+	}
+	if _, err := client.SyncJudgeTaskStatus(adminCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
 		SubmissionId: id,
+		TaskId:       task.TaskId,
+		Status:       "Executing",
 	}); err != nil {
-		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+		t.Fatal(err)
 	}
-
-	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+	if _, err := client.FinishJudgeTask(adminCtx, &pb.FinishJudgeTaskRequest{
 		JudgeName:    "judge-test",
-		Status:       "WA",
 		SubmissionId: id,
+		TaskId:       task.TaskId,
+		Status:       "AC",
 	}); err != nil {
-		t.Fatal("Failed to FinishJudgeTaskStatus:", err)
-	}
-
-	if !testFetchSubmission(t, id, client).Overview.Hacked {
-		t.Fatal("Hacked should be true")
+		t.Fatal(err)
 	}
 
-	// WA -> TLE
-	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{
-		Id: id,
+	if _, err := client.ChangeMaintenance(adminCtx, &pb.ChangeMaintenanceRequest{
+		Maintenance: false,
 	}); err != nil {
-		t.Fatal("Failed to Rejudge:", err)
+		t.Fatal(err)
 	}
+	submitSomething(t, client)
+}
 
-	resp, err = client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-		JudgeName: "judge-test",
-	})
-	if err != nil {
-		t.Fatal("Failed to PopJudgeTask:", err)
-	}
+func TestRankingExcludeAdmins(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
 
-	if id != resp.SubmissionId {
-		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	for _, ctx := range []context.Context{loginAsAdmin(t, client), loginAsTester(t, client)} {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  "ac source",
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Model(&Submission{}).Where("id = ?", resp.Id).Update("status", "AC").Error; err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	if !testFetchSubmission(t, id, client).Overview.Hacked {
-		t.Fatal("Hacked should be true")
+	ranking, err := client.Ranking(context.Background(), &pb.RankingRequest{})
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-		JudgeName: "judge-test",
-		Status:    "Judging",
-		CaseResults: []*pb.SubmissionCaseResult{
-			{
-				Case:   "test00",
-				Status: "TLE",
-				Time:   1.0,
-				Memory: 1,
-			},
-		},
-		SubmissionId: id,
-	}); err != nil {
-		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	if len(ranking.Statistics) != 2 {
+		t.Fatal("Invalid ranking: ", ranking.Statistics)
 	}
-
-	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
-		JudgeName:    "judge-test",
-		Status:       "TLE",
-		SubmissionId: id,
-	}); err != nil {
-		t.Fatal("Failed to FinishJudgeTaskStatus:", err)
+	ranking, err = client.Ranking(context.Background(), &pb.RankingRequest{ExcludeAdmins: true})
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if !testFetchSubmission(t, id, client).Overview.Hacked {
-		t.Fatal("Hacked should be true")
+	if len(ranking.Statistics) != 1 || ranking.Statistics[0].Name != "tester" {
+		t.Fatal("Admin is not excluded: ", ranking.Statistics)
 	}
+}
 
-	subList, err := client.SubmissionList(judgeCtx, &pb.SubmissionListRequest{
-		Hacked: true,
-		Skip:   0,
-		Limit:  1000,
+func TestRankingProblems(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	resp, err := client.Submit(loginAsTester(t, client), &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "ac source",
+		Lang:    "cpp",
 	})
 	if err != nil {
-		t.Fatal("Failed to SubmissionList", err)
+		t.Fatal(err)
 	}
-	if subList.Count == 0 {
-		t.Fatal("Cannot get hacked submission")
+	if err := db.Model(&Submission{}).Where("id = ?", resp.Id).Update("status", "AC").Error; err != nil {
+		t.Fatal(err)
 	}
-	for _, sub := range subList.Submissions {
-		if !sub.Hacked {
-			t.Fatal("List unhacked submission")
-		}
+
+	ranking, err := client.Ranking(context.Background(), &pb.RankingRequest{Problems: []string{"aplusb", "unionfind"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranking.Statistics) != 1 || ranking.Statistics[0].Name != "tester" || ranking.Statistics[0].Count != 1 {
+		t.Fatal("Invalid ranking: ", ranking.Statistics)
+	}
+	ranking, err = client.Ranking(context.Background(), &pb.RankingRequest{Problems: []string{"unionfind"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranking.Statistics) != 0 {
+		t.Fatal("Other problems are counted: ", ranking.Statistics)
 	}
 }
 
-func TestSimulateJudgeDown(t *testing.T) {
+func TestSiteStatistics(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
-	id := submitSomething(t, client)
+	submitSomething(t, client)
+	resp, err := client.SiteStatistics(context.Background(), &pb.SiteStatisticsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProblemCount != 1 || resp.UserCount < 2 || resp.SubmissionCount != 1 || resp.AcSubmissionCount != 0 {
+		t.Fatal("Invalid statistics: ", resp)
+	}
+}
 
-	for i := 0; i < 3; i++ {
-		log.Printf("Start %v/3", i+1)
-		resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-			JudgeName:    "judge-test",
-			ExpectedTime: durationpb.New(2 * time.Second),
-		})
-		if err != nil {
-			t.Fatal(err)
-		}
-		if id != resp.SubmissionId {
-			t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
-		}
-		time.Sleep(time.Second * 4)
+func TestLangList(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := context.Background()
+	list, err := client.LangList(ctx, &pb.LangListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Langs) == 0 {
+		t.Fatal(err)
 	}
 }
 
-func TestParallelJudge(t *testing.T) {
+func TestLangInfo(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
-	ids := make([]int, 100)
-	tasks := make([]int, 100)
-	for i := 0; i < 100; i++ {
-		ids[i] = -1
-		tasks[i] = -1
+	ctx := context.Background()
+	resp, err := client.LangInfo(ctx, &pb.LangInfoRequest{Id: "cpp"})
+	if err != nil {
+		t.Fatal(err)
 	}
-	var g errgroup.Group
-	for i := 0; i < 100; i++ {
-		i := i
-		g.Go(func() error {
-			ids[i] = int(submitSomething(t, client))
-			return nil
-		})
+	if resp.Lang.Id != "cpp" || resp.Lang.Name == "" {
+		t.Fatal("Invalid lang: ", resp.Lang)
 	}
-	if err := g.Wait(); err != nil {
+	if resp.Lang.SourceExtension != ".cpp" || resp.Lang.CommentPrefix != "//" {
+		t.Fatal("Invalid source extension or comment prefix: ", resp.Lang)
+	}
+	if _, err := client.LangInfo(ctx, &pb.LangInfoRequest{Id: "dummy-lang"}); err == nil {
+		t.Fatal("Success to fetch unknown lang")
+	}
+}
+
+func TestReadLangs(t *testing.T) {
+	langs, err := ReadLangs("../langs/langs.toml")
+	if err != nil {
 		t.Fatal(err)
 	}
-	for i := 0; i < 100; i++ {
-		i := i
-		g.Go(func() error {
-			resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-				JudgeName:    "judge-test",
-				ExpectedTime: durationpb.New(time.Minute),
-			})
-			if err != nil {
-				return err
+	for _, lang := range langs {
+		if lang.Id == "cpp" {
+			if len(lang.CompileCommand) == 0 || lang.CompileCommand[0] != "g++" ||
+				!reflect.DeepEqual(lang.RunCommand, []string{"./main"}) {
+				t.Fatal("Invalid commands: ", lang)
 			}
-			if resp.SubmissionId == -1 {
-				return errors.New("Cannot fetch tasks")
+			if !strings.HasPrefix(lang.Template, "#include") {
+				t.Fatal("Invalid template: ", lang.Template)
 			}
-			log.Print("Returned ", i, resp.SubmissionId)
-			tasks[i] = int(resp.SubmissionId)
-			return nil
-		})
+		}
+		if lang.Id == "rust" && lang.Template != "" {
+			t.Fatal("Template of rust is not defined: ", lang.Template)
+		}
 	}
-	if err := g.Wait(); err != nil {
+
+	for name, data := range map[string]string{
+		"empty": "",
+		"duplicated": `
+[[langs]]
+    id = "cpp"
+    name = "C++"
+    version = "g++"
+    source = "main.cpp"
+    exec = ["./main"]
+[[langs]]
+    id = "cpp"
+    name = "C++"
+    version = "g++"
+    source = "main.cpp"
+    exec = ["./main"]
+`,
+		"no name": `
+[[langs]]
+    id = "cpp"
+    version = "g++"
+    source = "main.cpp"
+    exec = ["./main"]
+`,
+		"no id": `
+[[langs]]
+    name = "C++"
+    version = "g++"
+    source = "main.cpp"
+    exec = ["./main"]
+`,
+	} {
+		path := filepath.Join(t.TempDir(), "langs.toml")
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadLangs(path); err == nil {
+			t.Fatal("Success to read invalid langs: ", name)
+		}
+	}
+
+	// exec is optional
+	path := filepath.Join(t.TempDir(), "langs.toml")
+	if err := os.WriteFile(path, []byte(`
+[[langs]]
+    id = "cpp"
+    name = "C++"
+    version = "g++"
+    source = "main.cpp"
+`), 0644); err != nil {
 		t.Fatal(err)
 	}
-	sort.Ints(ids)
-	sort.Ints(tasks)
-	t.Log(ids)
-	t.Log(tasks)
-	for i := 0; i < 100; i++ {
-		if ids[i] != tasks[i] {
-			t.Fatal(i)
-		}
+	langs, err = ReadLangs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(langs) != 1 || len(langs[0].RunCommand) != 0 {
+		t.Fatal("Invalid langs: ", langs)
 	}
 }
 
-func TestSimulateParallelRejudge(t *testing.T) {
+func TestSubmitBig(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	judgeCtx := loginAsAdmin(t, client)
+	ctx := context.Background()
+	bigSrc := strings.Repeat("a", 3*1000*1000) // 3 MB
+	_, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  bigSrc,
+		Lang:    "cpp",
+	})
+	if err == nil {
+		t.Fatal("Success to submit big source")
+	}
+	t.Log(err)
+}
 
-	ids := make([]int, 50)
-	for i := 0; i < 50; i++ {
-		ids[i] = -1
+func TestMaxSourceLength(t *testing.T) {
+	db := createTestDB(t)
+	config := DefaultServerConfig()
+	config.MaxSourceLength = 100
+	client, close := createAPIClientWithConfig(t, db, config)
+	defer close()
+
+	ctx := context.Background()
+	if _, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  strings.Repeat("a", 101),
+		Lang:    "cpp",
+	}); err == nil {
+		t.Fatal("Success to submit source longer than MaxSourceLength")
 	}
-	var g errgroup.Group
-	for i := 0; i < 50; i++ {
-		i := i
-		g.Go(func() error {
-			ids[i] = int(submitSomething(t, client))
-			return nil
-		})
+	src := strings.Repeat("あ", 33) // 99 bytes
+	resp, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  src,
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := g.Wait(); err != nil {
+
+	info, err := client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{
+		Id:          resp.Id,
+		SourceLimit: 10,
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
-	sort.Ints(ids)
-	t.Log(ids)
+	if !info.SourceTruncated || info.Source != strings.Repeat("あ", 3) {
+		t.Fatal("Invalid truncated source: ", info.Source)
+	}
+	info, err = client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{
+		Id: resp.Id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SourceTruncated || info.Source != src {
+		t.Fatal("Source is truncated: ", info.Source)
+	}
+}
 
-	for phase := 0; phase < 3; phase++ {
-		log.Printf("Start %v/3", phase+1)
-		if phase > 0 {
-			for _, id := range ids {
-				id := id
-				g.Go(func() error {
-					if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{
-						Id: int32(id),
-					}); err != nil {
-						return err
-					}
-					return nil
-				})
+func TestDailySubmissionQuota(t *testing.T) {
+	config := DefaultServerConfig()
+	config.DailySubmissionQuota = 2
+	client, close := createAPIClientWithConfig(t, createTestDB(t), config)
+	defer close()
+
+	for _, c := range []struct {
+		ctx       context.Context
+		remaining []int32
+	}{
+		{loginAsTester(t, client), []int32{1, 0, -2}},
+		{loginAsAdmin(t, client), []int32{-1, -1, -1}},
+	} {
+		for i, remaining := range c.remaining {
+			resp, err := client.Submit(c.ctx, &pb.SubmitRequest{
+				Problem: "aplusb",
+				Source:  fmt.Sprintf("quota %d", i),
+				Lang:    "cpp",
+			})
+			if remaining == -2 {
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Fatal("Success to submit over the quota: ", err)
+				}
+				continue
 			}
-			if err := g.Wait(); err != nil {
+			if err != nil {
 				t.Fatal(err)
 			}
+			if resp.RemainingQuota != remaining {
+				t.Fatalf("Invalid remaining quota: %v, expect %v", resp.RemainingQuota, remaining)
+			}
 		}
-		tasks := make([]int, 50)
-		for i := 0; i < 50; i++ {
-			tasks[i] = -1
-		}
-		for i := 0; i < 50; i++ {
-			i := i
-			g.Go(func() error {
-				resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-					JudgeName:    "judge-test",
-					ExpectedTime: durationpb.New(2 * time.Second),
-				})
+	}
+}
+
+func TestSubmitDuplicate(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	for _, c := range []struct {
+		ctx     context.Context
+		success bool
+	}{
+		{loginAsTester(t, client), false},
+		{loginAsAdmin(t, client), true},
+	} {
+		for i := 0; i < 2; i++ {
+			_, err := client.Submit(c.ctx, &pb.SubmitRequest{
+				Problem: "aplusb",
+				Source:  "duplicate source",
+				Lang:    "cpp",
+			})
+			if i == 0 || c.success {
 				if err != nil {
-					return err
+					t.Fatal(err)
 				}
+			} else if err == nil {
+				t.Fatal("Success to submit the same source twice")
+			}
+		}
+	}
+}
 
-				id := resp.SubmissionId
-				if id == -1 {
-					return errors.New("Cannot fetch task")
-				}
+func TestSubmitEnqueueFailure(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
 
-				if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
-					JudgeName: "judge-test",
-					Status:    "Judging",
-					CaseResults: []*pb.SubmissionCaseResult{
-						{
-							Case:   "test00",
-							Status: "AC",
-							Time:   1.0,
-							Memory: 1,
-						},
-					},
-					SubmissionId: id,
-				}); err != nil {
-					return err
-				}
+	// make inserting into the judge queue fail
+	if err := db.Callback().Create().Before("gorm:create").Register("test:fail_task", func(db *gorm.DB) {
+		if db.Statement.Table == "tasks" {
+			db.AddError(errors.New("injected error"))
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-				if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
-					JudgeName:    "judge-test",
-					Status:       "AC",
-					SubmissionId: id,
-				}); err != nil {
-					return err
-				}
-				tasks[i] = int(id)
-				return nil
-			})
+	ctx := loginAsTester(t, client)
+	if _, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "enqueue failure",
+		Lang:    "cpp",
+	}); err == nil {
+		t.Fatal("Success to submit without enqueue")
+	}
+
+	var count int64
+	if err := db.Model(&Submission{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("Orphaned submission remains: ", count)
+	}
+}
+
+func TestSubmissionQueuePosition(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := context.Background()
+	ids := []int32{}
+	for i := 0; i < 3; i++ {
+		ids = append(ids, submitSomething(t, client))
+	}
+	for i, id := range ids {
+		resp, err := client.SubmissionQueuePosition(ctx, &pb.SubmissionQueuePositionRequest{Id: id})
+		if err != nil {
+			t.Fatal(err)
 		}
-		if err := g.Wait(); err != nil {
+		if resp.Position != int32(i) {
+			t.Fatalf("Invalid position of %v: %v", id, resp.Position)
+		}
+		if wait := resp.EstimatedWait.AsDuration(); wait != time.Duration(i)*DefaultServerConfig().EstimatedJudgeTime {
+			t.Fatal("Invalid estimated wait: ", wait)
+		}
+	}
+
+	judgeCtx := loginAsAdmin(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// ids[0] is judging now
+	for i, id := range ids {
+		resp, err := client.SubmissionQueuePosition(ctx, &pb.SubmissionQueuePositionRequest{Id: id})
+		if err != nil {
 			t.Fatal(err)
 		}
-		time.Sleep(4 * time.Second)
+		if resp.Position != int32(i-1) {
+			t.Fatalf("Invalid position of %v: %v", id, resp.Position)
+		}
+	}
+}
 
-		for i := 0; i < 50; i++ {
-			g.Go(func() error {
-				resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
-					JudgeName:    "judge-test",
-					ExpectedTime: durationpb.New(2 * time.Second),
-				})
-				if err != nil {
-					return err
-				}
+func TestSubmitTemplate(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
 
-				id := resp.SubmissionId
-				if id != -1 {
-					return errors.New(fmt.Sprint("Fetch new task", id))
-				}
-				return nil
-			})
+	ctx := loginAsAdmin(t, client)
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:        "aplusb",
+		Title:       "A + B",
+		TimeLimit:   2.0,
+		Statement:   "Please calculate A + B",
+		CaseVersion: "dummy-initial-version",
+		Template:    "int main() {\n    // write here\n}\n",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "int main() { // write here\n}",
+		Lang:    "cpp",
+	}); err == nil {
+		t.Fatal("Success to submit the template")
+	}
+	if _, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "int main() { return 0; }",
+		Lang:    "cpp",
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmitExcludedLang(t *testing.T) {
+	db := createTestDB(t)
+	config := DefaultServerConfig()
+	for _, block := range []bool{false, true} {
+		config.BlockExcludedLangs = block
+		client, close := createAPIClientWithConfig(t, db, config)
+		defer close()
+
+		ctx := loginAsAdmin(t, client)
+		if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+			Name:          "aplusb",
+			Title:         "A + B",
+			TimeLimit:     2.0,
+			Statement:     "Please calculate A + B",
+			CaseVersion:   "dummy-initial-version",
+			ExcludedLangs: []string{"python3"},
+		}); err != nil {
+			t.Fatal(err)
 		}
-		if err := g.Wait(); err != nil {
+		problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+			Name: "aplusb",
+		})
+		if err != nil {
 			t.Fatal(err)
 		}
+		if !reflect.DeepEqual(problem.ExcludedLangs, []string{"python3"}) {
+			t.Fatal("Differ ExcludedLangs : ", problem.ExcludedLangs)
+		}
 
-		sort.Ints(tasks)
-		t.Log(tasks)
-		for i := 0; i < 50; i++ {
-			if ids[i] != tasks[i] {
-				t.Fatal(i)
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  fmt.Sprintf("print(%v)", block),
+			Lang:    "python3",
+		})
+		if block {
+			if err == nil {
+				t.Fatal("Success to submit in excluded lang")
 			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Warning == "" {
+			t.Fatal("No warning for excluded lang")
+		}
+	}
+}
+
+func TestClearExcludedLangs(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	for _, langs := range [][]string{{"python3"}, nil} {
+		if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+			Name:          "aplusb",
+			Title:         "A + B",
+			TimeLimit:     2.0,
+			ExcludedLangs: langs,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+			Name:   "aplusb",
+			Fields: []string{"excluded_langs"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problem.ExcludedLangs) != len(langs) {
+			t.Fatal("Differ ExcludedLangs : ", problem.ExcludedLangs, langs)
+		}
+	}
+}
+
+func TestCloneSubmission(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	id := submitSomething(t, client)
+	if _, err := client.CloneSubmission(context.Background(), &pb.CloneSubmissionRequest{Id: id}); err == nil {
+		t.Fatal("Success to clone submission by anonymous user")
+	}
+
+	ctx := loginAsTester(t, client)
+	resp, err := client.CloneSubmission(ctx, &pb.CloneSubmissionRequest{Id: id, Lang: "cpp17"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: resp.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.Source != original.Source || clone.Overview.Lang != "cpp17" || clone.Overview.UserName != "tester" {
+		t.Fatal("Invalid clone: ", clone)
+	}
+	if clone.Overview.Status != "Draft" {
+		t.Fatal("Draft is judged: ", clone.Overview.Status)
+	}
+	recent, err := client.RecentSubmissions(context.Background(), &pb.RecentSubmissionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent.Submissions) != 1 || recent.Submissions[0].Id != id {
+		t.Fatal("Draft is in recent submissions: ", recent.Submissions)
+	}
+
+	// the draft is judged by Rejudge
+	if _, err := client.Rejudge(ctx, &pb.RejudgeRequest{Id: resp.Id}); err != nil {
+		t.Fatal(err)
+	}
+	clone, err = client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: resp.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.Overview.Status != "WJ" {
+		t.Fatal("Draft is not queued: ", clone.Overview.Status)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, time.Minute)
+	now := time.Now()
+	if !limiter.allow("a", now) || !limiter.allow("a", now.Add(time.Second)) {
+		t.Fatal("Rejected within the limit")
+	}
+	if limiter.allow("a", now.Add(2*time.Second)) {
+		t.Fatal("Allowed over the limit")
+	}
+	if !limiter.allow("b", now.Add(2*time.Second)) {
+		t.Fatal("Rejected another key")
+	}
+	if !limiter.allow("a", now.Add(time.Minute+time.Second)) {
+		t.Fatal("Rejected after the window")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345},
+	})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", "198.51.100.1, 203.0.113.1"))
+
+	if ip := clientIP(ctx, ""); ip != "192.0.2.1" {
+		t.Fatal("Invalid peer IP: ", ip)
+	}
+	if ip := clientIP(ctx, "x-forwarded-for"); ip != "203.0.113.1" {
+		t.Fatal("Invalid forwarded IP: ", ip)
+	}
+	if hashIP([]byte("key"), "192.0.2.1") == hashIP([]byte("key"), "192.0.2.2") {
+		t.Fatal("Hash collision")
+	}
+}
+
+func TestSubmissionClientIPHash(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	id := submitSomething(t, client)
+	info, err := client.SubmissionInfo(loginAsAdmin(t, client), &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ClientIpHash == "" {
+		t.Fatal("Client IP hash is not recorded")
+	}
+	info, err = client.SubmissionInfo(loginAsTester(t, client), &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ClientIpHash != "" {
+		t.Fatal("Client IP hash is exposed to non-admin")
+	}
+}
+
+func TestSubmissionSourceHash(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	id := submitSomething(t, client)
+	info, err := client.SubmissionInfo(loginAsAdmin(t, client), &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256 of "this is a test source"
+	if info.SourceHash != "9d7ba14831d2a9c9519cf19081245e9b032cdc0d28e0221ab07b3cf3e8e607b3" {
+		t.Fatal("Invalid source hash: ", info.SourceHash)
+	}
+	info, err = client.SubmissionInfo(loginAsTester(t, client), &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SourceHash != "" {
+		t.Fatal("Source hash is exposed to non-admin")
+	}
+}
+
+func TestAnonymousSubmission(t *testing.T) {
+	db := createTestDB(t)
+	config := DefaultServerConfig()
+	config.AnonymousSubmissionLimit = 1
+	client, close := createAPIClientWithConfig(t, db, config)
+
+	req := &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "anonymous source",
+		Lang:    "cpp",
+	}
+	// rejected submissions do not consume the limit
+	if _, err := client.Submit(context.Background(), &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "anonymous source",
+		Lang:    "unknown-lang",
+	}); err == nil {
+		t.Fatal("Success to submit with unknown lang")
+	}
+	if _, err := client.Submit(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Submit(context.Background(), req); status.Code(err) != codes.ResourceExhausted {
+		t.Fatal("Anonymous submission is not limited: ", err)
+	}
+	// logged in user is not limited
+	if _, err := client.Submit(loginAsTester(t, client), req); err != nil {
+		t.Fatal(err)
+	}
+	close()
+
+	config.DisableAnonymousSubmission = true
+	client, close = createAPIClientWithConfig(t, db, config)
+	defer close()
+	if _, err := client.Submit(context.Background(), req); status.Code(err) != codes.Unauthenticated {
+		t.Fatal("Anonymous submission is not disabled: ", err)
+	}
+}
+
+func TestAnonymousRejudge(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := context.Background()
+	src := strings.Repeat("a", 1000)
+	resp, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  src,
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal("Unsuccess to submit source")
+	}
+	_, err = client.Rejudge(ctx, &pb.RejudgeRequest{
+		Id: resp.Id,
+	})
+	if err == nil {
+		t.Fatal("Success to rejudge")
+	}
+}
+
+func TestRejudgeCooldown(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	testerCtx := loginAsTester(t, client)
+	resp, err := client.Submit(testerCtx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "rejudge cooldown source",
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	judge := func() {
+		if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+			JudgeName: "judge-test",
+		}); err != nil {
+			t.Fatal(err)
 		}
+		if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+			JudgeName:    "judge-test",
+			SubmissionId: resp.Id,
+			Status:       "AC",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	judge()
+	if _, err := client.Rejudge(testerCtx, &pb.RejudgeRequest{Id: resp.Id}); err != nil {
+		t.Fatal(err)
+	}
+	judge()
+	_, err = client.Rejudge(testerCtx, &pb.RejudgeRequest{Id: resp.Id})
+	if err == nil || !strings.Contains(err.Error(), "please wait") {
+		t.Fatal("Success to rejudge within cooldown: ", err)
+	}
+	// admin bypasses the cooldown
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{Id: resp.Id}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRejudgeNoDuplicateTask(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	// the retry task pushed by PopJudgeTask is still pending after finish
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	if err := db.Model(&Task{}).Where("submission = ?", id).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("Invalid number of tasks: ", count)
+	}
+	task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != id {
+		t.Fatal("Rejudged submission is not popped: ", task.SubmissionId)
+	}
+}
+
+func TestRejudgeStaleSubmissions(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	problem, err := client.ProblemInfo(judgeCtx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := submitSomething(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+		CaseVersion:  problem.CaseVersion,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.RejudgeStaleSubmissions(judgeCtx, &pb.RejudgeStaleSubmissionsRequest{Problem: "aplusb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 0 {
+		t.Fatal("Latest submission is rejudged: ", resp.Count)
+	}
+
+	// update the test data
+	if err := db.Model(&Problem{}).Where("name = ?", "aplusb").Update("testhash", "new-version").Error; err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.RejudgeStaleSubmissions(judgeCtx, &pb.RejudgeStaleSubmissionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 1 {
+		t.Fatal("Stale submission is not rejudged: ", resp.Count)
+	}
+	if status := testFetchSubmission(t, id, client).Overview.Status; status != "WJ" {
+		t.Fatal("Invalid status: ", status)
+	}
+}
+
+func TestRejudgeTwice(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	src := strings.Repeat("a", 1000)
+	resp, err := client.Submit(judgeCtx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  src,
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal("Unsuccess to submit source")
+	}
+
+	task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		ExpectedTime: durationpb.New(2 * time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := task.SubmissionId
+	if id == -1 {
+		t.Fatal("Cannot fetch task")
+	}
+
+	if id != resp.Id {
+		t.Fatalf("Differ ID %v vs %v", id, resp.Id)
+	}
+
+	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName: "judge-test",
+		Status:    "Judging",
+		CaseResults: []*pb.SubmissionCaseResult{
+			{
+				Case:   "test00",
+				Status: "AC",
+				Time:   1.0,
+				Memory: 1,
+			},
+		},
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		Status:       "AC",
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Rejudge(judgeCtx, &pb.RejudgeRequest{
+		Id: resp.Id,
+	})
+	if err != nil {
+		t.Fatal("Failed to rejudge")
+	}
+	_, err = client.Rejudge(judgeCtx, &pb.RejudgeRequest{
+		Id: resp.Id,
+	})
+	if err == nil {
+		t.Fatal("Success to rejudge")
+	}
+	t.Log(err)
+}
+
+func TestAdmin(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	resp, err := client.UserInfo(ctx, &pb.UserInfoRequest{})
+	if err != nil {
+		t.Fatal("Failed UserInfo")
+	}
+	if !resp.User.IsAdmin {
+		t.Fatal("isAdmin(admin) = False")
+	}
+}
+
+func TestNotAdmin(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsTester(t, client)
+	resp, err := client.UserInfo(ctx, &pb.UserInfoRequest{})
+	if err != nil {
+		t.Fatal("Failed UserInfo")
+	}
+	if resp.User.IsAdmin {
+		t.Fatal("isAdmin(tester) = True")
+	}
+}
+
+func TestHasSolved(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	ctx := loginAsTester(t, client)
+	req := &pb.HasSolvedRequest{User: "tester", Problem: "aplusb"}
+	resp, err := client.HasSolved(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Solved {
+		t.Fatal("Solved before submit")
+	}
+
+	submitResp, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "ac source",
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Submission{}).Where("id = ?", submitResp.Id).Update("status", "AC").Error; err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.HasSolved(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Solved {
+		t.Fatal("Not solved after AC")
+	}
+
+	userInfo, err := client.UserInfo(ctx, &pb.UserInfoRequest{Name: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.SolvedCount != 1 {
+		t.Fatal("Invalid solved count: ", userInfo.SolvedCount)
+	}
+}
+
+func TestUserSolveTimeline(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	ctx := loginAsTester(t, client)
+	var ids []int32
+	for i := 0; i < 2; i++ {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  fmt.Sprintf("ac source %d", i),
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.Id)
+	}
+	if err := db.Model(&Submission{}).Where("id in ?", ids).Update("status", "AC").Error; err != nil {
+		t.Fatal(err)
+	}
+	first, err := fetchSubmission(db, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.UserSolveTimeline(ctx, &pb.UserSolveTimelineRequest{Name: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Events) != 1 || resp.Events[0].Problem != "aplusb" {
+		t.Fatal("Invalid events: ", resp.Events)
+	}
+	if !resp.Events[0].FirstAcTime.AsTime().Equal(first.SubmitTime) {
+		t.Fatal("Invalid first AC time: ", resp.Events[0].FirstAcTime.AsTime(), first.SubmitTime)
+	}
+}
+
+func TestUserInfoBatch(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	resp, err := client.UserInfoBatch(context.Background(), &pb.UserInfoBatchRequest{
+		Names: []string{"tester", "dummy-user", "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Users) != 2 || resp.Users[0].User.Name != "tester" || resp.Users[1].User.Name != "admin" {
+		t.Fatal("Invalid users: ", resp.Users)
+	}
+
+	var names []string
+	for i := 0; i < 101; i++ {
+		names = append(names, fmt.Sprintf("user%d", i))
+	}
+	if _, err := client.UserInfoBatch(context.Background(), &pb.UserInfoBatchRequest{
+		Names: names,
+	}); err == nil {
+		t.Fatal("Success to fetch too many users")
+	}
+}
+
+func TestUserList(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	_, err := client.UserList(ctx, &pb.UserListRequest{})
+	if err != nil {
+		t.Fatal("Failed UserList")
+	}
+}
+
+func TestNotAdminUserList(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsTester(t, client)
+	_, err := client.UserList(ctx, &pb.UserListRequest{})
+	if err == nil {
+		t.Fatal("Success UserList with tester")
+	}
+	t.Log(err)
+}
+
+func TestCreateUser(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := context.Background()
+	resp, err := client.Register(ctx, &pb.RegisterRequest{
+		Name:     uuid.New().String(),
+		Password: "password",
+	})
+	if err != nil {
+		t.Fatal("Failed to Register")
+	}
+	ctx = clientutil.ContextWithToken(ctx, resp.Token)
+	_, err = client.UserInfo(ctx, &pb.UserInfoRequest{})
+	if err != nil {
+		t.Fatal("Failed to UserInfo")
+	}
+}
+
+func TestChangeUserInfo(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	// admin add bob
+	ctx := context.Background()
+	aliceCtx := loginAsAdmin(t, client)
+	bobName := uuid.New().String()
+	regResp, err := client.Register(ctx, &pb.RegisterRequest{
+		Name:     bobName,
+		Password: "password",
+	})
+	bobCtx := clientutil.ContextWithToken(ctx, regResp.Token)
+	if err != nil {
+		t.Fatal("Failed to Register")
+	}
+
+	_, err = client.ChangeUserInfo(aliceCtx, &pb.ChangeUserInfoRequest{
+		User: &pb.User{
+			Name:    bobName,
+			IsAdmin: true,
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to add Admin:", err)
+	}
+	resp, err := client.UserInfo(bobCtx, &pb.UserInfoRequest{})
+	if err != nil {
+		t.Fatal("Failed UserInfo")
+	}
+	if !resp.User.IsAdmin {
+		t.Fatal("Not promote to admin")
+	}
+
+	_, err = client.ChangeUserInfo(aliceCtx, &pb.ChangeUserInfoRequest{
+		User: &pb.User{
+			Name:    bobName,
+			IsAdmin: false,
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to add Admin:", err)
+	}
+	resp, err = client.UserInfo(bobCtx, &pb.UserInfoRequest{})
+	if err != nil {
+		t.Fatal("Failed UserInfo")
+	}
+	if resp.User.IsAdmin {
+		t.Fatal("Cannot remove admin")
+	}
+
+	_, err = client.ChangeUserInfo(aliceCtx, &pb.ChangeUserInfoRequest{
+		User: &pb.User{
+			Name:    "admin",
+			IsAdmin: false,
+		},
+	})
+	if err == nil {
+		t.Fatal("Success to remove myself")
+	}
+	t.Log(err)
+}
+
+func TestChangeOtherUserEmail(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	adminCtx := loginAsAdmin(t, client)
+	bobName := uuid.New().String()
+	if _, err := client.Register(context.Background(), &pb.RegisterRequest{
+		Name:     bobName,
+		Password: "password",
+	}); err != nil {
+		t.Fatal("Failed to Register")
+	}
+
+	if _, err := client.ChangeUserInfo(adminCtx, &pb.ChangeUserInfoRequest{
+		User: &pb.User{
+			Name:       bobName,
+			IsAdmin:    true,
+			LibraryUrl: "https://example.com/library",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// change only email
+	if _, err := client.ChangeUserInfo(adminCtx, &pb.ChangeUserInfoRequest{
+		User: &pb.User{
+			Name:  bobName,
+			Email: "bob@example.com",
+		},
+		UpdateFields: []string{"email"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.UserInfo(adminCtx, &pb.UserInfoRequest{Name: bobName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.User.Email != "bob@example.com" {
+		t.Fatal("Email is not changed: ", resp.User)
+	}
+	if !resp.User.IsAdmin || resp.User.LibraryUrl != "https://example.com/library" {
+		t.Fatal("Other fields are reset: ", resp.User)
+	}
+
+	if _, err := client.ChangeUserInfo(adminCtx, &pb.ChangeUserInfoRequest{
+		User:         &pb.User{Name: bobName},
+		UpdateFields: []string{"passhash"},
+	}); err == nil {
+		t.Fatal("Success to update unknown field")
+	}
+}
+
+func TestRemoveLastAdmin(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	// only "admin" and bob are admins
+	if err := db.Model(&User{}).Where("name <> ?", "admin").Update("admin", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	bobName := uuid.New().String()
+	if err := registerUser(db, bobName, "password", true); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := loginAsAdmin(t, client)
+	if _, err := client.ChangeUserInfo(ctx, &pb.ChangeUserInfoRequest{
+		User:         &pb.User{Name: bobName, IsAdmin: false},
+		UpdateFields: []string{"is_admin"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// now "admin" is the last admin
+	if err := updateUser(db, User{Name: "admin", Admin: false}, []string{"admin"}); err == nil {
+		t.Fatal("Success to remove the last admin")
+	}
+}
+
+func TestChangeDummyUserInfo(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	// admin add bob
+	ctx := loginAsAdmin(t, client)
+
+	_, err := client.ChangeUserInfo(ctx, &pb.ChangeUserInfoRequest{
+		User: &pb.User{
+			Name:    "this_is_dummy_user_name",
+			IsAdmin: true,
+		},
+	})
+	if err == nil {
+		t.Fatal("Success to change unknown user")
+	}
+	t.Log(err)
+}
+
+func TestAddAdminByNotAdmin(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	// admin add bob
+	ctx := context.Background()
+
+	aliceCtx := loginAsTester(t, client)
+
+	bobName := uuid.New().String()
+	regResp, err := client.Register(ctx, &pb.RegisterRequest{
+		Name:     bobName,
+		Password: "password",
+	})
+	if err != nil {
+		t.Fatal("Failed to Register")
+	}
+	bobCtx := clientutil.ContextWithToken(context.Background(), regResp.Token)
+
+	_, err = client.ChangeUserInfo(aliceCtx, &pb.ChangeUserInfoRequest{
+		User: &pb.User{
+			Name:    bobName,
+			IsAdmin: true,
+		},
+	})
+	if err == nil {
+		t.Fatal("Success to add Admin")
+	}
+	t.Log(err)
+	resp, err := client.UserInfo(bobCtx, &pb.UserInfoRequest{})
+	if err != nil {
+		t.Fatal("Failed UserInfo")
+	}
+	if resp.User.IsAdmin {
+		t.Fatal("Promote to admin")
+	}
+}
+
+func TestOtherJudge(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal("Failed to PopJudgeTask:", err)
+	}
+
+	if id != resp.SubmissionId {
+		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	}
+
+	_, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-other",
+		Status:       "Judging",
+		SubmissionId: id,
+	})
+	if err == nil {
+		t.Fatal("Success to SyncJudgeTaskStatus")
+	}
+	t.Log(err)
+}
+
+func TestJudgeSyncAfterFinished(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal("Failed to PopJudgeTask:", err)
+	}
+
+	if id != resp.SubmissionId {
+		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	}
+
+	_, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		Status:       "AC",
+		SubmissionId: id,
+	})
+
+	if err != nil {
+		t.Fatal("JudgeSync Failed:", err)
+	}
+
+	_, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		Status:       "AC",
+		SubmissionId: id,
+	})
+	if err == nil {
+		t.Fatal("Success to FinishJudgeTask Twice")
+	}
+	t.Log(err)
+	_, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		Status:       "AC",
+		SubmissionId: id,
+	})
+	if err == nil {
+		t.Fatal("Success to SyncJudgeTaskStatus after finished")
+	}
+	t.Log(err)
+}
+
+func TestSimulateJudge(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal("Failed to PopJudgeTask:", err)
+	}
+
+	if id != resp.SubmissionId {
+		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	}
+
+	cases := []*pb.SubmissionCaseResult{
+		{
+			Case:   "test00",
+			Status: "AC",
+			Time:   1.0,
+			Memory: 1,
+		},
+		{
+			Case:   "test01",
+			Status: "WA",
+			Time:   1.0,
+			Memory: 1,
+		},
+		{
+			Case:   "test02",
+			Status: "TLE",
+			Time:   1.0,
+			Memory: 1,
+		},
+	}
+	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		Status:       "Judging",
+		CaseResults:  cases[0:2],
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	}
+
+	sub := testFetchSubmission(t, id, client)
+	if sub.Overview.Status != "Judging" {
+		t.Fatal("Status is not changed: ", sub.Overview.Status)
+	}
+	assertEqualCases(t, cases[0:2], sub.CaseResults)
+
+	if err != nil {
+		t.Fatal("Failed to PopJudgeTask:", err)
+	}
+
+	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		Status:       "TLE",
+		Time:         1.234,
+		Memory:       5678,
+		CaseResults:  cases[2:3],
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	}
+
+	sub = testFetchSubmission(t, id, client)
+	if sub.Overview.Status != "TLE" {
+		t.Fatal("Status is not changed")
+	}
+	if math.Abs(sub.Overview.Time-1.234) >= 0.00001 {
+		t.Fatal("Time is not changed:", sub.Overview.Time)
+	}
+	if sub.Overview.Memory != 5678 {
+		t.Fatal("Memory is not changed")
+	}
+	assertEqualCases(t, cases[0:3], sub.CaseResults)
+
+	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		Status:       "TLE",
+		Time:         2.345,
+		Memory:       6789,
+		SubmissionId: id,
+		CaseVersion:  "test-version",
+	}); err != nil {
+		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	}
+
+	sub = testFetchSubmission(t, id, client)
+	if sub.Overview.Status != "TLE" {
+		t.Fatal("Status is not changed")
+	}
+	if math.Abs(sub.Overview.Time-2.345) >= 0.00001 {
+		t.Fatal("Time is not changed:", sub.Overview.Time)
+	}
+	if sub.Overview.Memory != 6789 {
+		t.Fatal("Memory is not changed")
+	}
+	if sub.JudgeName != "" {
+		t.Fatal("JudgeName is visible for non admin: ", sub.JudgeName)
+	}
+
+	adminSub, err := client.SubmissionInfo(judgeCtx, &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adminSub.JudgeName != "judge-test" {
+		t.Fatal("JudgeName is not recorded: ", adminSub.JudgeName)
+	}
+}
+
+func TestSimulateRejudge(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	for i := 0; i < 3; i++ {
+		log.Printf("Start %v/3", i+1)
+		if i > 0 {
+			if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{
+				Id: id,
+			}); err != nil {
+				t.Fatal("Failed to Rejudge:", err)
+			}
+		}
+		resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+			JudgeName: "judge-test",
+		})
+		if err != nil {
+			t.Fatal("Failed to PopJudgeTask:", err)
+		}
+
+		if id != resp.SubmissionId {
+			t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+		}
+
+		if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+			JudgeName: "judge-test",
+			Status:    "Judging",
+			CaseResults: []*pb.SubmissionCaseResult{
+				{
+					Case:   "test00",
+					Status: "AC",
+					Time:   1.0,
+					Memory: 1,
+				},
+			},
+			SubmissionId: id,
+		}); err != nil {
+			t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+		}
+
+		if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+			JudgeName:    "judge-test",
+			Status:       "AC",
+			SubmissionId: id,
+		}); err != nil {
+			t.Fatal("Failed to FinishJudgeTaskStatus:", err)
+		}
+	}
+}
+
+func TestSimulateHack(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal("Failed to PopJudgeTask:", err)
+	}
+
+	if id != resp.SubmissionId {
+		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	}
+
+	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName: "judge-test",
+		Status:    "Judging",
+		CaseResults: []*pb.SubmissionCaseResult{
+			{
+				Case:   "test00",
+				Status: "AC",
+				Time:   1.0,
+				Memory: 1,
+			},
+		},
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	}
+
+	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		Status:       "AC",
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal("Failed to FinishJudgeTaskStatus:", err)
+	}
+
+	// AC -> WA
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{
+		Id: id,
+	}); err != nil {
+		t.Fatal("Failed to Rejudge:", err)
+	}
+
+	resp, err = client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal("Failed to PopJudgeTask:", err)
+	}
+
+	if id != resp.SubmissionId {
+		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	}
+
+	if testFetchSubmission(t, id, client).Overview.Hacked {
+		t.Fatal("Hacked should not be true")
+	}
+
+	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName: "judge-test",
+		Status:    "Judging",
+		CaseResults: []*pb.SubmissionCaseResult{
+			{
+				Case:   "test00",
+				Status: "WA",
+				Time:   1.0,
+				Memory: 1,
+			},
+		},
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	}
+
+	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		Status:       "WA",
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal("Failed to FinishJudgeTaskStatus:", err)
+	}
+
+	if !testFetchSubmission(t, id, client).Overview.Hacked {
+		t.Fatal("Hacked should be true")
+	}
+
+	// WA -> TLE
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{
+		Id: id,
+	}); err != nil {
+		t.Fatal("Failed to Rejudge:", err)
+	}
+
+	resp, err = client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal("Failed to PopJudgeTask:", err)
+	}
+
+	if id != resp.SubmissionId {
+		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	}
+
+	if !testFetchSubmission(t, id, client).Overview.Hacked {
+		t.Fatal("Hacked should be true")
+	}
+
+	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName: "judge-test",
+		Status:    "Judging",
+		CaseResults: []*pb.SubmissionCaseResult{
+			{
+				Case:   "test00",
+				Status: "TLE",
+				Time:   1.0,
+				Memory: 1,
+			},
+		},
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal("Failed to SyncJudgeTaskStatus:", err)
+	}
+
+	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		Status:       "TLE",
+		SubmissionId: id,
+	}); err != nil {
+		t.Fatal("Failed to FinishJudgeTaskStatus:", err)
+	}
+
+	if !testFetchSubmission(t, id, client).Overview.Hacked {
+		t.Fatal("Hacked should be true")
+	}
+
+	subList, err := client.SubmissionList(judgeCtx, &pb.SubmissionListRequest{
+		Hacked: true,
+		Skip:   0,
+		Limit:  1000,
+	})
+	if err != nil {
+		t.Fatal("Failed to SubmissionList", err)
+	}
+	if subList.Count == 0 {
+		t.Fatal("Cannot get hacked submission")
+	}
+	for _, sub := range subList.Submissions {
+		if !sub.Hacked {
+			t.Fatal("List unhacked submission")
+		}
+	}
+
+	// the rejudge by admin hacked the submission
+	userInfo, err := client.UserInfo(judgeCtx, &pb.UserInfoRequest{Name: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.HacksFound != 1 {
+		t.Fatal("Invalid hacks found: ", userInfo.HacksFound)
+	}
+}
+
+func TestHackedByAfterReset(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+	judge := func(status string) {
+		task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+			JudgeName: "judge-test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.SubmissionId != id {
+			t.Fatalf("ID is differ, %v vs %v", id, task.SubmissionId)
+		}
+		if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+			JudgeName:    "judge-test",
+			SubmissionId: id,
+			Status:       status,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	judge("AC")
+
+	// the rejudge by admin does not hack the submission
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	judge("AC")
+
+	// the reset hacks it, but it is not a rejudge by admin
+	if _, err := client.ResetSubmission(judgeCtx, &pb.ResetSubmissionRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	judge("WA")
+	if !testFetchSubmission(t, id, client).Overview.Hacked {
+		t.Fatal("Hacked should be true")
+	}
+	userInfo, err := client.UserInfo(judgeCtx, &pb.UserInfoRequest{Name: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userInfo.HacksFound != 0 {
+		t.Fatal("Invalid hacks found: ", userInfo.HacksFound)
+	}
+}
+
+func TestSimulateJudgeDown(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	for i := 0; i < 3; i++ {
+		log.Printf("Start %v/3", i+1)
+		resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+			JudgeName:    "judge-test",
+			ExpectedTime: durationpb.New(2 * time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != resp.SubmissionId {
+			t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+		}
+		time.Sleep(time.Second * 4)
+	}
+}
+
+func TestJudgeTaskLeaseTooLong(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		ExpectedTime: durationpb.New(DefaultServerConfig().JudgeTaskLeaseMax + time.Second),
+	}); err == nil {
+		t.Fatal("Success to lease a task for too long time")
+	}
+
+	// the task is not consumed by the rejected request
+	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != resp.SubmissionId {
+		t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+	}
+}
+
+func TestJudgePriority(t *testing.T) {
+	config := DefaultServerConfig()
+	config.RejudgePriority = staleRejudgePriority
+	if err := config.Validate(); err == nil {
+		t.Fatal("RejudgePriority lower than stale rejudges is accepted")
+	}
+
+	config = DefaultServerConfig()
+	config.RejudgePriority = config.SubmitPriority + 10
+	client, close := createAPIClientWithConfig(t, createTestDB(t), config)
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id1 := submitSomething(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id1,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	submitSomething(t, client)
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{Id: id1}); err != nil {
+		t.Fatal(err)
+	}
+	// the rejudge is prior to the new submission
+	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.SubmissionId != id1 {
+		t.Fatalf("ID is differ, %v vs %v", id1, resp.SubmissionId)
+	}
+}
+
+func TestRetryCompile(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+	if _, err := client.RetryCompile(judgeCtx, &pb.RetryCompileRequest{Id: id}); err == nil {
+		t.Fatal("Success to retry compile of the submission in judging")
+	}
+
+	task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.RetryCompile {
+		t.Fatal("RetryCompile flag for the normal task")
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "ICE",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.RetryCompile(loginAsTester(t, client), &pb.RetryCompileRequest{Id: id}); err == nil {
+		t.Fatal("Success to retry compile by tester")
+	}
+	if _, err := client.RetryCompile(judgeCtx, &pb.RetryCompileRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	task, err = client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != id || !task.RetryCompile {
+		t.Fatal("Invalid retry compile task: ", task)
+	}
+
+	// a normal rejudge clears the flag
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "CE",
+		TaskId:       task.TaskId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	task, err = client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != id || task.RetryCompile {
+		t.Fatal("RetryCompile flag for the rejudge task: ", task)
+	}
+}
+
+func TestStaleFinishJudgeTask(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	// the same judge claims the submission again after its lease expired
+	task1, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		ExpectedTime: durationpb.New(time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	task2, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task1.SubmissionId != id || task2.SubmissionId != id || task1.TaskId == task2.TaskId {
+		t.Fatal("Invalid tasks: ", task1, task2)
+	}
+
+	if _, err := client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "Executing",
+		TaskId:       task1.TaskId,
+	}); err == nil {
+		t.Fatal("Success to sync by the stale task")
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "WA",
+		TaskId:       task1.TaskId,
+	}); err == nil {
+		t.Fatal("Success to finish by the stale task")
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+		TaskId:       task2.TaskId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if status := testFetchSubmission(t, id, client).Overview.Status; status != "AC" {
+		t.Fatal("Invalid status: ", status)
+	}
+}
+
+func TestListInFlightJudgeTasks(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+	submitSomething(t, client)
+
+	if _, err := client.ListInFlightJudgeTasks(loginAsTester(t, client), &pb.ListInFlightJudgeTasksRequest{}); err == nil {
+		t.Fatal("Success to list in-flight tasks by tester")
+	}
+
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		ExpectedTime: durationpb.New(time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.ListInFlightJudgeTasks(judgeCtx, &pb.ListInFlightJudgeTasksRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Tasks) != 1 {
+		t.Fatal("Invalid in-flight tasks: ", resp.Tasks)
+	}
+	task := resp.Tasks[0]
+	if task.SubmissionId != id || task.JudgeName != "judge-test" || !task.LeaseExpiry.AsTime().After(time.Now()) {
+		t.Fatal("Invalid in-flight task: ", task)
+	}
+}
+
+func TestResetSubmission(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName:    "judge-dead",
+		ExpectedTime: durationpb.New(time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-dead",
+		SubmissionId: id,
+		Status:       "Executing",
+		CaseResults: []*pb.SubmissionCaseResult{
+			{Case: "test00", Status: "AC", Time: 1.0, Memory: 1},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.ResetSubmission(loginAsTester(t, client), &pb.ResetSubmissionRequest{Id: id}); err == nil {
+		t.Fatal("Success to reset submission by tester")
+	}
+	if _, err := client.ResetSubmission(judgeCtx, &pb.ResetSubmissionRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := client.SubmissionInfo(judgeCtx, &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Overview.Status != "WJ" || len(info.CaseResults) != 0 {
+		t.Fatal("Submission is not reset: ", info)
+	}
+
+	// another judge can take the task immediately
+	task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-alive",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != id {
+		t.Fatalf("ID is differ, %v vs %v", id, task.SubmissionId)
+	}
+}
+
+func TestSubmissionCaseCount(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	if err := db.Model(&Problem{}).Where("name = ?", "aplusb").Update("case_count", 3).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "Executing",
+		CaseResults: []*pb.SubmissionCaseResult{
+			{Case: "test00", Status: "AC", Time: 1.0, Memory: 1},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := client.SubmissionInfo(context.Background(), &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.CaseResults) != 1 || info.CaseCount != 3 {
+		t.Fatalf("Invalid progress: %v/%v", len(info.CaseResults), info.CaseCount)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	payloads := make(chan WebhookPayload, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		payloads <- payload
+	}))
+	defer hook.Close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	if _, err := client.ChangeWebhooks(loginAsTester(t, client), &pb.ChangeWebhooksRequest{Urls: []string{hook.URL}}); err == nil {
+		t.Fatal("Success to change webhooks by tester")
+	}
+	if _, err := client.ChangeWebhooks(judgeCtx, &pb.ChangeWebhooksRequest{Urls: []string{"ftp://example.com"}}); err == nil {
+		t.Fatal("Success to register non-http webhook")
+	}
+	if _, err := client.ChangeWebhooks(judgeCtx, &pb.ChangeWebhooksRequest{Urls: []string{hook.URL}}); err != nil {
+		t.Fatal(err)
+	}
+
+	id := submitSomething(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case payload := <-payloads:
+		if payload.ID != id || payload.Problem != "aplusb" || payload.Status != "AC" {
+			t.Fatal("Invalid payload: ", payload)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Webhook is not called")
+	}
+}
+
+func TestJudgeToken(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	id := submitSomething(t, client)
+
+	invalidCtx := clientutil.ContextWithToken(context.Background(), "invalid-judge-token")
+	if _, err := client.PopJudgeTask(invalidCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err == nil {
+		t.Fatal("Success to pop task with invalid token")
+	}
+
+	judgeCtx := clientutil.ContextWithToken(context.Background(), "dummy-judge-token")
+	task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != id {
+		t.Fatalf("ID is differ, %v vs %v", id, task.SubmissionId)
+	}
+	// a stale judge cannot finish without task_id
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatal("Success to finish without task_id by judge token: ", err)
+	}
+	if _, err := client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "Executing",
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatal("Success to sync without task_id by judge token: ", err)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+		TaskId:       task.TaskId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// judge token cannot be used for admin RPCs
+	if _, err := client.UserList(judgeCtx, &pb.UserListRequest{}); err == nil {
+		t.Fatal("Success to call admin RPC with judge token")
+	}
+}
+
+func TestRegisterJudge(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	if _, err := client.RegisterJudge(loginAsTester(t, client), &pb.RegisterJudgeRequest{Name: "judge-test"}); err == nil {
+		t.Fatal("Success to register judge by tester")
+	}
+
+	sharedCtx := clientutil.ContextWithToken(context.Background(), "dummy-judge-token")
+	resp, err := client.RegisterJudge(sharedCtx, &pb.RegisterJudgeRequest{Name: "judge-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	judgeCtx := clientutil.ContextWithToken(context.Background(), resp.Token)
+
+	if _, err := client.RegisterJudge(judgeCtx, &pb.RegisterJudgeRequest{Name: "judge-other"}); err == nil {
+		t.Fatal("Success to register another judge by judge scoped token")
+	}
+
+	id := submitSomething(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-other",
+	}); err == nil {
+		t.Fatal("Success to pop task as another judge")
+	}
+	task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != id {
+		t.Fatalf("ID is differ, %v vs %v", id, task.SubmissionId)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+	}); err == nil {
+		t.Fatal("Success to finish without task_id by judge scoped token")
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+		TaskId:       task.TaskId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.ExpiresAt.AsTime().After(time.Now()) {
+		t.Fatal("Token is already expired: ", resp.ExpiresAt.AsTime())
+	}
+
+	// registering again revokes the old token
+	newResp, err := client.RegisterJudge(sharedCtx, &pb.RegisterJudgeRequest{Name: "judge-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err == nil {
+		t.Fatal("Success to pop task by revoked token")
+	}
+	newJudgeCtx := clientutil.ContextWithToken(context.Background(), newResp.Token)
+	if _, err := client.PopJudgeTask(newJudgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.UnregisterJudge(loginAsTester(t, client), &pb.UnregisterJudgeRequest{Name: "judge-test"}); err == nil {
+		t.Fatal("Success to unregister judge by tester")
+	}
+	if _, err := client.UnregisterJudge(loginAsAdmin(t, client), &pb.UnregisterJudgeRequest{Name: "judge-test"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PopJudgeTask(newJudgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err == nil {
+		t.Fatal("Success to pop task by unregistered judge")
+	}
+}
+
+func TestJudgeList(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// empty queue
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-idle",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.JudgeList(loginAsTester(t, client), &pb.JudgeListRequest{}); err == nil {
+		t.Fatal("Success to list judges by tester")
+	}
+	resp, err := client.JudgeList(judgeCtx, &pb.JudgeListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Judges) != 2 {
+		t.Fatal("Invalid judges: ", resp.Judges)
+	}
+	idle, test := resp.Judges[0], resp.Judges[1]
+	if idle.Name != "judge-idle" || idle.ProcessedCount != 0 || idle.Registered {
+		t.Fatal("Invalid idle judge: ", idle)
+	}
+	if test.Name != "judge-test" || test.ProcessedCount != 1 || time.Since(test.LastSeen.AsTime()) > time.Minute {
+		t.Fatal("Invalid judge: ", test)
+	}
+
+	// last_seen is not updated on each poll
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-idle",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.JudgeList(judgeCtx, &pb.JudgeListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Judges[0].LastSeen.AsTime().Equal(idle.LastSeen.AsTime()) {
+		t.Fatal("last_seen is updated: ", resp.Judges[0], idle)
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	submit := func(ctx context.Context, source string) int32 {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  source,
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Id
+	}
+	testerCtx := loginAsTester(t, client)
+	tester1 := submit(testerCtx, "source 1")
+	tester2 := submit(testerCtx, "source 2")
+	tester3 := submit(testerCtx, "source 3")
+	admin1 := submit(loginAsAdmin(t, client), "source 4")
+
+	expect := []int32{tester1, admin1, tester2, tester3}
+	for _, id := range expect {
+		task, err := popTask(db, true, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Submission != id {
+			t.Fatalf("Invalid order: expect %v, actual %v", id, task.Submission)
+		}
+	}
+}
+
+func TestPopTaskConcurrently(t *testing.T) {
+	for _, fair := range []bool{false, true} {
+		db := createTestDB(t)
+		client, close := createAPIClient(t, db)
+
+		submitted := map[int32]bool{}
+		for i := 0; i < 50; i++ {
+			submitted[submitSomething(t, client)] = true
+		}
+		close()
+
+		popped := make([][]int32, 20)
+		g := errgroup.Group{}
+		for i := 0; i < 20; i++ {
+			i := i
+			g.Go(func() error {
+				for {
+					task, err := popTask(db, fair, 0)
+					if err != nil {
+						return err
+					}
+					if task.Submission == -1 {
+						return nil
+					}
+					popped[i] = append(popped[i], task.Submission)
+				}
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		count := map[int32]int{}
+		for _, ids := range popped {
+			for _, id := range ids {
+				count[id]++
+			}
+		}
+		for id := range submitted {
+			if count[id] != 1 {
+				t.Fatalf("fair=%v: submission %v is popped %v times", fair, id, count[id])
+			}
+		}
+		if len(count) != len(submitted) {
+			t.Fatalf("fair=%v: unknown tasks are popped: %v", fair, count)
+		}
+	}
+}
+
+func TestDeadLetterSubmission(t *testing.T) {
+	db := createTestDB(t)
+	config := DefaultServerConfig()
+	config.JudgeTaskMaxAttempts = 2
+	client, close := createAPIClientWithConfig(t, db, config)
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+
+	// judges die twice
+	for i := 0; i < 2; i++ {
+		resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+			JudgeName:    "judge-test",
+			ExpectedTime: durationpb.New(time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.SubmissionId != id {
+			t.Fatalf("ID is differ, %v vs %v", id, resp.SubmissionId)
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.SubmissionId != -1 {
+		t.Fatal("Dead letter submission is popped: ", resp.SubmissionId)
+	}
+	if status := testFetchSubmission(t, id, client).Overview.Status; status != "IE" {
+		t.Fatal("Invalid status: ", status)
+	}
+
+	list, err := client.DeadLetterSubmissions(judgeCtx, &pb.DeadLetterSubmissionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Submissions) != 1 || list.Submissions[0].Id != id {
+		t.Fatal("Invalid dead letter submissions: ", list.Submissions)
+	}
+
+	// rejudge makes it alive
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	list, err = client.DeadLetterSubmissions(judgeCtx, &pb.DeadLetterSubmissionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Submissions) != 0 {
+		t.Fatal("Rejudged submission is dead letter: ", list.Submissions)
+	}
+}
+
+func TestParallelJudge(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	ids := make([]int, 100)
+	tasks := make([]int, 100)
+	for i := 0; i < 100; i++ {
+		ids[i] = -1
+		tasks[i] = -1
+	}
+	var g errgroup.Group
+	for i := 0; i < 100; i++ {
+		i := i
+		g.Go(func() error {
+			ids[i] = int(submitSomething(t, client))
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		i := i
+		g.Go(func() error {
+			resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+				JudgeName:    "judge-test",
+				ExpectedTime: durationpb.New(time.Minute),
+			})
+			if err != nil {
+				return err
+			}
+			if resp.SubmissionId == -1 {
+				return errors.New("Cannot fetch tasks")
+			}
+			log.Print("Returned ", i, resp.SubmissionId)
+			tasks[i] = int(resp.SubmissionId)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ids)
+	sort.Ints(tasks)
+	t.Log(ids)
+	t.Log(tasks)
+	for i := 0; i < 100; i++ {
+		if ids[i] != tasks[i] {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestSimulateParallelRejudge(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+
+	ids := make([]int, 50)
+	for i := 0; i < 50; i++ {
+		ids[i] = -1
+	}
+	var g errgroup.Group
+	for i := 0; i < 50; i++ {
+		i := i
+		g.Go(func() error {
+			ids[i] = int(submitSomething(t, client))
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ids)
+	t.Log(ids)
+
+	for phase := 0; phase < 3; phase++ {
+		log.Printf("Start %v/3", phase+1)
+		if phase > 0 {
+			for _, id := range ids {
+				id := id
+				g.Go(func() error {
+					if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{
+						Id: int32(id),
+					}); err != nil {
+						return err
+					}
+					return nil
+				})
+			}
+			if err := g.Wait(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tasks := make([]int, 50)
+		for i := 0; i < 50; i++ {
+			tasks[i] = -1
+		}
+		for i := 0; i < 50; i++ {
+			i := i
+			g.Go(func() error {
+				resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+					JudgeName:    "judge-test",
+					ExpectedTime: durationpb.New(2 * time.Second),
+				})
+				if err != nil {
+					return err
+				}
+
+				id := resp.SubmissionId
+				if id == -1 {
+					return errors.New("Cannot fetch task")
+				}
+
+				if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+					JudgeName: "judge-test",
+					Status:    "Judging",
+					CaseResults: []*pb.SubmissionCaseResult{
+						{
+							Case:   "test00",
+							Status: "AC",
+							Time:   1.0,
+							Memory: 1,
+						},
+					},
+					SubmissionId: id,
+				}); err != nil {
+					return err
+				}
+
+				if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+					JudgeName:    "judge-test",
+					Status:       "AC",
+					SubmissionId: id,
+				}); err != nil {
+					return err
+				}
+				tasks[i] = int(id)
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(4 * time.Second)
+
+		for i := 0; i < 50; i++ {
+			g.Go(func() error {
+				resp, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+					JudgeName:    "judge-test",
+					ExpectedTime: durationpb.New(2 * time.Second),
+				})
+				if err != nil {
+					return err
+				}
+
+				id := resp.SubmissionId
+				if id != -1 {
+					return errors.New(fmt.Sprint("Fetch new task", id))
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Ints(tasks)
+		t.Log(tasks)
+		for i := 0; i < 50; i++ {
+			if ids[i] != tasks[i] {
+				t.Fatal(i)
+			}
+		}
+	}
+}
+
+func TestChangeProblemInfo(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+
+	oldProblem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:         "aplusb",
+		Title:        "dummy-title",
+		TimeLimit:    123.0,
+		Statement:    "dummy-statement",
+		CaseVersion:  "dummy-version",
+		Author:       "dummy-author",
+		Template:     "dummy-template",
+		SourceUrl:    "https://example.com/source",
+		SolutionUrl:  "https://example.com/sol/correct.cpp",
+		CheckerUrl:   "https://example.com/checker.cpp",
+		GeneratorUrl: "https://example.com/gen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if problem.Title != "dummy-title" {
+		t.Fatal("Title is not changed")
+	}
+	if problem.TimeLimit != 123.0 {
+		t.Fatalf("TimeLimit is not changed: %v", problem.TimeLimit)
+	}
+	if problem.Statement != "dummy-statement" {
+		t.Fatal("statement is not changed")
+	}
+	if problem.CaseVersion != "dummy-version" {
+		t.Fatal("CaseVersion is not changed: ", problem.CaseVersion)
+	}
+	if problem.Author != "dummy-author" || problem.Template != "dummy-template" {
+		t.Fatal("Author or template is not changed: ", problem)
+	}
+	if problem.SourceUrl != "https://example.com/source" ||
+		problem.SolutionUrl != "https://example.com/sol/correct.cpp" ||
+		problem.CheckerUrl != "https://example.com/checker.cpp" ||
+		problem.GeneratorUrl != "https://example.com/gen" {
+		t.Fatal("URLs are not changed: ", problem)
+	}
+
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:        "aplusb",
+		Title:       oldProblem.Title,
+		TimeLimit:   oldProblem.TimeLimit,
+		Statement:   oldProblem.Statement,
+		CaseVersion: oldProblem.CaseVersion,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	nowProblem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nowProblem.Title != oldProblem.Title {
+		t.Fatal("Title is not recovered")
+	}
+	if nowProblem.TimeLimit != oldProblem.TimeLimit {
+		t.Fatalf("TimeLimit is not recovered: %v vs %v", nowProblem.TimeLimit, problem.TimeLimit)
+	}
+	if nowProblem.Statement != oldProblem.Statement {
+		t.Fatal("Statement is not changed")
+	}
+	if nowProblem.CaseVersion != oldProblem.CaseVersion {
+		t.Fatal("CaseVersion is not changed")
+	}
+	// empty fields clear them
+	if nowProblem.Author != "" || nowProblem.Template != "" {
+		t.Fatal("Author or template is not cleared: ", nowProblem)
+	}
+	if nowProblem.SourceUrl != "" || nowProblem.SolutionUrl != "" || nowProblem.CheckerUrl != "" || nowProblem.GeneratorUrl != "" {
+		t.Fatal("URLs are not cleared: ", nowProblem)
+	}
+}
+
+func TestChangeProblemInfoByTester(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsTester(t, client)
+
+	_, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:        "aplusb",
+		Title:       "dummy-title",
+		TimeLimit:   123.0,
+		Statement:   "dummy-statement",
+		CaseVersion: "dummy-version",
+	})
+	if err == nil {
+		t.Fatal("success to ChangeProblemInfo")
+	}
+	t.Log(err)
+}
+
+func TestProblemListOrderBySolvers(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:        "unionfind",
+		Title:       "Union Find",
+		TimeLimit:   5.0,
+		Statement:   "Union Find",
+		CaseVersion: "dummy-version",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "unionfind",
+		Source:  "ac source",
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Submission{}).Where("id = ?", resp.Id).Update("status", "AC").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := client.ProblemList(ctx, &pb.ProblemListRequest{Order: "solvers_desc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Problems) != 2 || list.Problems[0].Name != "unionfind" || list.Problems[0].SolverCount != 1 {
+		t.Fatal("Invalid order: ", list.Problems)
+	}
+	if _, err := client.ProblemList(ctx, &pb.ProblemListRequest{Order: "dummy"}); err == nil {
+		t.Fatal("Success to list with unknown order")
+	}
+}
+
+func TestCreateProblem(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+
+	name := uuid.New().String()
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:        name,
+		Title:       "dummy-title-x",
+		TimeLimit:   1234.0,
+		Statement:   "dummy-statement-x",
+		CaseVersion: "dummy-version-x",
+	}); err != nil {
+		t.Fatal("Failed to create problem")
+	}
+
+	problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if problem.Title != "dummy-title-x" {
+		t.Fatal("Title is invalid")
+	}
+	if problem.TimeLimit != 1234.0 {
+		t.Fatalf("TimeLimit is invalid: %v", problem.TimeLimit)
+	}
+	if problem.Statement != "dummy-statement-x" {
+		t.Fatal("statement is invalid")
+	}
+	if problem.CaseVersion != "dummy-version-x" {
+		t.Fatal("CaseVersion is invalid")
+	}
+}
+
+func TestProblemCategories(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	testData := []*pb.ProblemCategory{
+		{
+			Title:    "a",
+			Problems: []string{"x", "y"},
+		},
+		{
+			Title:    "b",
+			Problems: []string{"z"},
+		},
+	}
+
+	for phase := 0; phase <= 1; phase++ {
+
+		if _, err := client.ChangeProblemCategories(ctx, &pb.ChangeProblemCategoriesRequest{
+			Categories: testData,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.ProblemCategories(ctx, &pb.ProblemCategoriesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := testData
+		actual := res.Categories
+
+		if len(expect) != len(actual) {
+			t.Fatal("len is differ")
+		}
+
+		for i := 0; i < len(expect); i++ {
+			if expect[i].Title != actual[i].Title {
+				t.Fatal("title is differ")
+			}
+			if !reflect.DeepEqual(expect[i].Problems, actual[i].Problems) {
+				t.Fatal("problems is differ")
+			}
+		}
+
+		testData = append(testData, &pb.ProblemCategory{
+			Title:    "c",
+			Problems: []string{"w"},
+		})
+	}
+}
+
+func TestStagingTestdata(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	req := &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "staging source",
+		Lang:    "cpp",
+		Staging: true,
+	}
+	if _, err := client.Submit(ctx, req); err == nil {
+		t.Fatal("Success to submit to staging without staging testdata")
+	}
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:               "aplusb",
+		StagingCaseVersion: "staging-hash",
+		StagingCaseCount:   3,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Submit(loginAsTester(t, client), req); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("Success to submit to staging by tester: ", err)
+	}
+	stagingSub, err := client.Submit(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := client.PopJudgeTask(ctx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != stagingSub.Id || task.CaseVersion != "staging-hash" {
+		t.Fatal("Invalid staging task: ", task)
+	}
+
+	id := submitSomething(t, client)
+	task, err = client.PopJudgeTask(ctx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != id || task.CaseVersion != "" {
+		t.Fatal("Invalid normal task: ", task)
+	}
+
+	if _, err := client.PromoteStagingTestdata(loginAsTester(t, client), &pb.PromoteStagingTestdataRequest{
+		Problem: "aplusb",
+	}); err == nil {
+		t.Fatal("Success to promote by tester")
+	}
+	promoted, err := client.PromoteStagingTestdata(ctx, &pb.PromoteStagingTestdataRequest{
+		Problem: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted.CaseVersion != "staging-hash" {
+		t.Fatal("Invalid promoted case version: ", promoted.CaseVersion)
+	}
+	problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem.CaseVersion != "staging-hash" || problem.CaseCount != 3 || problem.StagingCaseVersion != "" {
+		t.Fatal("Invalid problem after promotion: ", problem)
+	}
+	if _, err := client.PromoteStagingTestdata(ctx, &pb.PromoteStagingTestdataRequest{
+		Problem: "aplusb",
+	}); err == nil {
+		t.Fatal("Success to promote twice")
+	}
+}
+
+func TestStagingSubmissionNotCounted(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:               "aplusb",
+		StagingCaseVersion: "staging-hash",
+		StagingCaseCount:   3,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	problem, err := client.ProblemInfo(loginAsTester(t, client), &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem.StagingCaseVersion != "" || problem.StagingCaseCount != 0 {
+		t.Fatal("Staging testdata is visible to tester: ", problem)
+	}
+
+	countAdmin := func() int32 {
+		ranking, err := client.Ranking(context.Background(), &pb.RankingRequest{Problems: []string{"aplusb"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stat := range ranking.Statistics {
+			if stat.Name == "admin" {
+				return stat.Count
+			}
+		}
+		return 0
+	}
+	before := countAdmin()
+
+	sub, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "staging source",
+		Lang:    "cpp",
+		Staging: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := client.PopJudgeTask(ctx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(ctx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: sub.Id,
+		Status:       "AC",
+		CaseVersion:  task.CaseVersion,
+		TaskId:       task.TaskId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if after := countAdmin(); after != before {
+		t.Fatalf("Staging AC is counted in ranking: %v -> %v", before, after)
+	}
+	info, err := client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: sub.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Overview.IsLatest {
+		t.Fatal("Staging submission is latest before promotion")
+	}
+
+	if _, err := client.ClearStagingTestdata(loginAsTester(t, client), &pb.ClearStagingTestdataRequest{
+		Problem: "aplusb",
+	}); err == nil {
+		t.Fatal("Success to clear staging testdata by tester")
+	}
+	if _, err := client.ClearStagingTestdata(ctx, &pb.ClearStagingTestdataRequest{
+		Problem: "aplusb",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	problem, err = client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem.StagingCaseVersion != "" || problem.CaseVersion == "staging-hash" {
+		t.Fatal("Invalid problem after clear: ", problem)
+	}
+	if _, err := client.ClearStagingTestdata(ctx, &pb.ClearStagingTestdataRequest{
+		Problem: "aplusb",
+	}); err == nil {
+		t.Fatal("Success to clear staging testdata twice")
+	}
+	if after := countAdmin(); after != before {
+		t.Fatalf("Staging AC is counted in ranking after clear: %v -> %v", before, after)
+	}
+}
+
+func TestProblemStatementRaw(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:            "aplusb",
+		Statement:       "# A + B",
+		StatementFormat: "rtf",
+	}); err == nil {
+		t.Fatal("Success to set an unknown statement format")
+	}
+	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+		Name:            "aplusb",
+		Statement:       "# A + B",
+		StatementFormat: "markdown",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.ProblemStatementRaw(context.Background(), &pb.ProblemStatementRawRequest{
+		Name: "aplusb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Statement) != "# A + B" || resp.Format != "markdown" || resp.ContentType != "text/markdown; charset=utf-8" {
+		t.Fatal("Invalid raw statement: ", resp)
+	}
+	if _, err := client.ProblemStatementRaw(context.Background(), &pb.ProblemStatementRawRequest{
+		Name: "unknown",
+	}); err == nil {
+		t.Fatal("Success to get the statement of an unknown problem")
+	}
+}
+
+func TestExportSubmissions(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	anonymousID := submitSomething(t, client)
+	testerSub, err := client.Submit(loginAsTester(t, client), &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "tester's <source>",
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(ctx context.Context, in *pb.ExportSubmissionsRequest) ([]map[string]interface{}, error) {
+		stream, err := client.ExportSubmissions(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		records := []map[string]interface{}{}
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				return records, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			decoder := json.NewDecoder(bytes.NewReader(resp.Records))
+			for decoder.More() {
+				record := map[string]interface{}{}
+				if err := decoder.Decode(&record); err != nil {
+					return nil, err
+				}
+				records = append(records, record)
+			}
+		}
+	}
+
+	if _, err := export(loginAsTester(t, client), &pb.ExportSubmissionsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("Success to export by tester: ", err)
+	}
+
+	ctx := loginAsAdmin(t, client)
+	records, err := export(ctx, &pb.ExportSubmissionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0]["id"] != float64(anonymousID) || records[1]["id"] != float64(testerSub.Id) {
+		t.Fatal("Invalid records: ", records)
+	}
+	if _, ok := records[1]["source"]; ok {
+		t.Fatal("Source is exported without include_source")
+	}
+	if records[0]["user"] != "" || records[1]["user"] == "" || records[1]["user"] == "tester" {
+		t.Fatal("User names are not pseudonymized: ", records)
+	}
+
+	records, err = export(ctx, &pb.ExportSubmissionsRequest{
+		Filter:          &pb.SubmissionListRequest{User: "tester"},
+		IncludeSource:   true,
+		IncludeUserName: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0]["user"] != "tester" || records[0]["source"] != "tester's <source>" {
+		t.Fatal("Invalid records: ", records)
+	}
+}
+
+func TestPendingSubmissionCount(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := context.Background()
+	count := func() int32 {
+		resp, err := client.PendingSubmissionCount(ctx, &pb.PendingSubmissionCountRequest{
+			Problem: "aplusb",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Count
+	}
+	if c := count(); c != 0 {
+		t.Fatal("Invalid pending count: ", c)
+	}
+	submitSomething(t, client)
+	submitSomething(t, client)
+	if c := count(); c != 2 {
+		t.Fatal("Invalid pending count: ", c)
+	}
+
+	judgeCtx := loginAsAdmin(t, client)
+	task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := count(); c != 2 {
+		t.Fatal("Invalid pending count: ", c)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: task.SubmissionId,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if c := count(); c != 1 {
+		t.Fatal("Invalid pending count: ", c)
+	}
+}
+
+func TestUserBestSubmission(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	best := func() *pb.SubmissionOverview {
+		resp, err := client.UserBestSubmission(context.Background(), &pb.UserBestSubmissionRequest{
+			User:    "tester",
+			Problem: "aplusb",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Submission
+	}
+	if sub := best(); sub != nil {
+		t.Fatal("Best submission without submissions: ", sub)
+	}
+
+	testerCtx := loginAsTester(t, client)
+	judgeCtx := loginAsAdmin(t, client)
+	judge := func(source, result string, time float64) int32 {
+		sub, err := client.Submit(testerCtx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  source,
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+			JudgeName: "judge-test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.SubmissionId != sub.Id {
+			t.Fatal("Invalid task: ", task)
+		}
+		if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+			JudgeName:    "judge-test",
+			SubmissionId: sub.Id,
+			Status:       result,
+			Time:         time,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return sub.Id
+	}
+
+	wa := judge("wa", "WA", 0.1)
+	if sub := best(); sub == nil || sub.Id != wa {
+		t.Fatal("Invalid best submission: ", sub)
+	}
+	judge("slow ac", "AC", 0.5)
+	fast := judge("fast ac", "AC", 0.2)
+	judge("ce", "CE", 0)
+	if sub := best(); sub == nil || sub.Id != fast {
+		t.Fatal("Invalid best submission: ", sub)
+	}
+}
+
+func TestHTTPGuard(t *testing.T) {
+	if _, err := newHTTPGuard("", []string{"10.0.0.0/33"}, ""); err == nil {
+		t.Fatal("Invalid CIDR is accepted")
+	}
+	ok := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.WriteString(resp, "ok")
+	})
+	serve := func(guard *httpGuard, remoteAddr, authorization string) int {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = remoteAddr
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		guard.wrap(ok).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	open, err := newHTTPGuard("", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(open, "192.0.2.1:1234", ""); code != http.StatusOK {
+		t.Fatal("Unconfigured guard rejects: ", code)
+	}
+
+	guard, err := newHTTPGuard("secret", []string{"10.0.0.0/8", "127.0.0.1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remoteAddr    string
+		authorization string
+		code          int
+	}{
+		{"192.0.2.1:1234", "", http.StatusUnauthorized},
+		{"192.0.2.1:1234", "Bearer wrong", http.StatusUnauthorized},
+		{"192.0.2.1:1234", "Bearer secret", http.StatusOK},
+		{"10.1.2.3:1234", "", http.StatusOK},
+		{"127.0.0.1:1234", "", http.StatusOK},
+		{"127.0.0.2:1234", "", http.StatusUnauthorized},
+	} {
+		if code := serve(guard, c.remoteAddr, c.authorization); code != c.code {
+			t.Fatalf("%v %q: code %d, expected %d", c.remoteAddr, c.authorization, code, c.code)
+		}
+	}
+
+	originFunc := newOriginFunc([]string{"https://judge.yosupo.jp/"})
+	if !originFunc("https://judge.yosupo.jp") || originFunc("https://example.com") {
+		t.Fatal("Invalid origin func")
+	}
+	if !newOriginFunc(nil)("https://example.com") {
+		t.Fatal("Any origin must be allowed by default")
+	}
+}
+
+func TestGiantCompileError(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxCompileErrorLength = 1000
+	client, close := createAPIClientWithConfig(t, createTestDB(t), config)
+	defer close()
+
+	id := submitSomething(t, client)
+	judgeCtx := loginAsAdmin(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 3MB of 3-byte characters, under the default message size limit of gRPC
+	compileError := []byte(strings.Repeat("エラー", 1024*1024/3))
+	if _, err := client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "CE",
+		CompileError: compileError,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := client.SubmissionInfo(context.Background(), &pb.SubmissionInfoRequest{
+		Id: id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.CompileError) > 1000 || !utf8.Valid(info.CompileError) ||
+		!bytes.HasSuffix(info.CompileError, []byte(compileErrorTruncatedSuffix)) ||
+		!bytes.HasPrefix(compileError, bytes.TrimSuffix(info.CompileError, []byte(compileErrorTruncatedSuffix))) {
+		t.Fatal("Invalid truncated compile error: ", len(info.CompileError))
+	}
+}
+
+func TestCompileStats(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	id := submitSomething(t, client)
+	judgeCtx := loginAsAdmin(t, client)
+	pop := func() {
+		if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+			JudgeName: "judge-test",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := func(ctx context.Context) *pb.SubmissionInfoResponse {
+		resp, err := client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{
+			Id: id,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	pop()
+	if _, err := client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "Executing",
+		CompileCache: pb.CompileCacheStatus_COMPILE_CACHE_MISS,
+		CompileTime:  durationpb.New(1500 * time.Millisecond),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// legacy judges don't report the compile stats
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp := info(judgeCtx)
+	if resp.CompileCache != pb.CompileCacheStatus_COMPILE_CACHE_MISS || resp.CompileTime.AsDuration() != 1500*time.Millisecond {
+		t.Fatal("Invalid compile stats: ", resp.CompileCache, resp.CompileTime)
+	}
+	if resp := info(context.Background()); resp.CompileCache != pb.CompileCacheStatus_COMPILE_CACHE_UNKNOWN || resp.CompileTime != nil {
+		t.Fatal("Compile stats are shown to non-admin: ", resp.CompileCache, resp.CompileTime)
+	}
+
+	// rejudge resets the compile stats
+	if _, err := client.Rejudge(judgeCtx, &pb.RejudgeRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	pop()
+	if resp := info(judgeCtx); resp.CompileCache != pb.CompileCacheStatus_COMPILE_CACHE_UNKNOWN || resp.CompileTime != nil {
+		t.Fatal("Compile stats are not reset: ", resp.CompileCache, resp.CompileTime)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+		CompileCache: pb.CompileCacheStatus_COMPILE_CACHE_HIT,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := info(judgeCtx); resp.CompileCache != pb.CompileCacheStatus_COMPILE_CACHE_HIT || resp.CompileTime != nil {
+		t.Fatal("Invalid compile stats: ", resp.CompileCache, resp.CompileTime)
+	}
+}
+
+func TestUnpublishedProblemSubmissions(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	adminCtx := loginAsAdmin(t, client)
+	testerCtx := loginAsTester(t, client)
+	sub, err := client.Submit(adminCtx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "admin source",
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PopJudgeTask(adminCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(adminCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: sub.Id,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// in the queue
+	queued := submitSomething(t, client)
+	if _, err := client.ChangeProblemPublished(adminCtx, &pb.ChangeProblemPublishedRequest{Name: "aplusb", Published: false}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SubmissionInfo(testerCtx, &pb.SubmissionInfoRequest{Id: sub.Id}); status.Code(err) != codes.NotFound {
+		t.Fatal("Submission to unpublished problem is visible: ", err)
+	}
+	if _, err := client.SubmissionInfo(adminCtx, &pb.SubmissionInfoRequest{Id: sub.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SubmissionQueuePosition(testerCtx, &pb.SubmissionQueuePositionRequest{Id: queued}); status.Code(err) != codes.NotFound {
+		t.Fatal("Queue position of submission to unpublished problem is visible: ", err)
+	}
+	if _, err := client.SubmissionQueuePosition(adminCtx, &pb.SubmissionQueuePositionRequest{Id: queued}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := client.SubmissionList(testerCtx, &pb.SubmissionListRequest{Problem: "aplusb", Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Count != 0 || len(list.Submissions) != 0 {
+		t.Fatal("Submissions to unpublished problem are listed: ", list)
+	}
+	counts, err := client.SubmissionStatusCounts(testerCtx, &pb.SubmissionStatusCountsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Total != 0 {
+		t.Fatal("Submissions to unpublished problem are counted: ", counts)
+	}
+	recent, err := client.RecentSubmissions(testerCtx, &pb.RecentSubmissionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent.Submissions) != 0 {
+		t.Fatal("Submissions to unpublished problem are recent: ", recent.Submissions)
+	}
+	fastest, err := client.ProblemFastestSubmissions(testerCtx, &pb.ProblemFastestSubmissionsRequest{Problem: "aplusb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fastest.Submissions) != 0 {
+		t.Fatal("Fastest submissions of unpublished problem are visible: ", fastest.Submissions)
+	}
+	pending, err := client.PendingSubmissionCount(testerCtx, &pb.PendingSubmissionCountRequest{Problem: "aplusb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Fatal("Pending submissions of unpublished problem are counted: ", pending.Count)
+	}
+	best, err := client.UserBestSubmission(testerCtx, &pb.UserBestSubmissionRequest{User: "admin", Problem: "aplusb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Submission != nil {
+		t.Fatal("Best submission of unpublished problem is visible: ", best.Submission)
+	}
+	solved, err := client.HasSolved(testerCtx, &pb.HasSolvedRequest{User: "admin", Problem: "aplusb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if solved.Solved {
+		t.Fatal("Unpublished problem is solved")
+	}
+	user, err := client.UserInfo(testerCtx, &pb.UserInfoRequest{Name: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := user.SolvedMap["aplusb"]; ok {
+		t.Fatal("Unpublished problem is in the solved map: ", user.SolvedMap)
+	}
+	ranking, err := client.Ranking(testerCtx, &pb.RankingRequest{Problems: []string{"aplusb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranking.Statistics) != 0 {
+		t.Fatal("Unpublished problem is ranked: ", ranking.Statistics)
+	}
+}
+
+func TestProblemListOrder(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := loginAsAdmin(t, client)
+	for _, name := range []string{"zzz", "aaa", "mmm"} {
+		if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
+			Name:      name,
+			Title:     name,
+			TimeLimit: 2.0,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, order := range []string{"", "name"} {
+		list, err := client.ProblemList(ctx, &pb.ProblemListRequest{Order: order})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sort.SliceIsSorted(list.Problems, func(i, j int) bool {
+			return list.Problems[i].Name < list.Problems[j].Name
+		}) {
+			t.Fatal("Problems are not ordered by name: ", order, list.Problems)
+		}
+	}
+}
+
+func TestUnpublishedProblem(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	adminCtx := loginAsAdmin(t, client)
+	testerCtx := loginAsTester(t, client)
+	if _, err := client.ChangeProblemInfo(adminCtx, &pb.ChangeProblemInfoRequest{
+		Name:        "draft",
+		Title:       "Draft",
+		TimeLimit:   2.0,
+		Unpublished: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	hasDraft := func(ctx context.Context, includeUnpublished bool) bool {
+		list, err := client.ProblemList(ctx, &pb.ProblemListRequest{IncludeUnpublished: includeUnpublished})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, problem := range list.Problems {
+			if problem.Name == "draft" {
+				return true
+			}
+		}
+		return false
+	}
+	if hasDraft(testerCtx, true) || hasDraft(adminCtx, false) || !hasDraft(adminCtx, true) {
+		t.Fatal("Invalid visibility of the unpublished problem in ProblemList")
+	}
+	if _, err := client.ProblemInfo(testerCtx, &pb.ProblemInfoRequest{Name: "draft"}); err == nil {
+		t.Fatal("Tester can see the unpublished problem")
+	}
+	info, err := client.ProblemInfo(adminCtx, &pb.ProblemInfoRequest{Name: "draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Unpublished {
+		t.Fatal("Problem is not unpublished: ", info)
+	}
+	req := &pb.SubmitRequest{
+		Problem: "draft",
+		Source:  "draft source",
+		Lang:    "cpp",
+	}
+	if _, err := client.Submit(testerCtx, req); err == nil {
+		t.Fatal("Tester can submit to the unpublished problem")
+	}
+	if _, err := client.Submit(adminCtx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.ChangeProblemPublished(testerCtx, &pb.ChangeProblemPublishedRequest{Name: "draft", Published: true}); err == nil {
+		t.Fatal("Tester can publish the problem")
+	}
+	if _, err := client.ChangeProblemPublished(adminCtx, &pb.ChangeProblemPublishedRequest{Name: "draft", Published: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !hasDraft(testerCtx, false) {
+		t.Fatal("Published problem is not listed")
+	}
+	if _, err := client.ProblemInfo(testerCtx, &pb.ProblemInfoRequest{Name: "draft"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmissionListWaitingLongerThan(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	stuck := submitSomething(t, client)
+	submitSomething(t, client) // submitted just now
+	judged := submitSomething(t, client)
+	rejudged := submitSomething(t, client)
+	old := time.Now().Add(-time.Hour)
+	if err := db.Model(&Submission{}).Where("id in ?", []int32{stuck, judged, rejudged}).Update("submit_time", old).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Submission{}).Where("id = ?", judged).Update("status", "AC").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Submission{}).Where("id = ?", rejudged).Update("rejudge_time", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := client.SubmissionList(context.Background(), &pb.SubmissionListRequest{
+		WaitingLongerThan: durationpb.New(30 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Count != 1 || list.Submissions[0].Id != stuck {
+		t.Fatal("Invalid stuck submissions: ", list.Submissions)
+	}
+
+	if _, err := client.SubmissionList(context.Background(), &pb.SubmissionListRequest{
+		WaitingLongerThan: durationpb.New(-time.Minute),
+	}); err == nil {
+		t.Fatal("Success to list with negative duration")
+	}
+}
+
+func TestSubmissionListTimeMemoryFilter(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	judgeCtx := loginAsAdmin(t, client)
+	ids := make(map[int32]bool)
+	for i, result := range []struct {
+		time   float64
+		memory int64
+	}{
+		{0.1, 1000},
+		{0.5, 2000},
+		{1.0, 3000},
+	} {
+		sub, err := client.Submit(context.Background(), &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  fmt.Sprintf("source %d", i),
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[sub.Id] = true
+		task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+			JudgeName: "judge-test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+			JudgeName:    "judge-test",
+			SubmissionId: task.SubmissionId,
+			Status:       "AC",
+			Time:         result.time,
+			Memory:       result.memory,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// still waiting for judging, so it has neither time nor memory
+	submitSomething(t, client)
+
+	for _, c := range []struct {
+		req   *pb.SubmissionListRequest
+		count int32
+	}{
+		{&pb.SubmissionListRequest{}, 4},
+		{&pb.SubmissionListRequest{MaxTime: 0.5}, 2},
+		{&pb.SubmissionListRequest{MinTime: 0.5}, 2},
+		{&pb.SubmissionListRequest{MinTime: 0.2, MaxTime: 0.9}, 1},
+		{&pb.SubmissionListRequest{MaxMemory: 1000}, 1},
+		{&pb.SubmissionListRequest{MinMemory: 1500, MaxTime: 0.5}, 1},
+	} {
+		c.req.Limit = 1
+		list, err := client.SubmissionList(context.Background(), c.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Count != c.count {
+			t.Fatal("Invalid count: ", c.req, list.Count)
+		}
+		for _, sub := range list.Submissions {
+			if c.req.MaxTime > 0 && !ids[sub.Id] {
+				t.Fatal("Submission without time is listed: ", sub)
+			}
+		}
+	}
+	if _, err := client.SubmissionList(context.Background(), &pb.SubmissionListRequest{MinTime: 1.0, MaxTime: 0.5}); err == nil {
+		t.Fatal("Success to list with an invalid time range")
+	}
+}
+
+func TestSubmissionInfoNotFound(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := context.Background()
+	if _, err := client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: 12345}); status.Code(err) != codes.NotFound {
+		t.Fatal("Invalid error for an unknown submission: ", err)
+	}
+	// not a permission error even for users who cannot rejudge
+	if _, err := client.Rejudge(loginAsTester(t, client), &pb.RejudgeRequest{Id: 12345}); status.Code(err) != codes.NotFound {
+		t.Fatal("Invalid error for an unknown submission: ", err)
+	}
+	id := submitSomething(t, client)
+	if _, err := client.SubmissionInfo(ctx, &pb.SubmissionInfoRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBookmark(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	if _, err := client.ListBookmarks(context.Background(), &pb.ListBookmarksRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatal("Success to list bookmarks without login: ", err)
+	}
+
+	ctx := loginAsTester(t, client)
+	id1 := submitSomething(t, client)
+	sub2, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "bookmarked source",
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2 := sub2.Id
+	if _, err := client.AddBookmark(ctx, &pb.AddBookmarkRequest{Id: 12345}); status.Code(err) != codes.NotFound {
+		t.Fatal("Success to bookmark an unknown submission: ", err)
+	}
+	for _, id := range []int32{id1, id2, id2} {
+		if _, err := client.AddBookmark(ctx, &pb.AddBookmarkRequest{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(ctx context.Context) []int32 {
+		resp, err := client.ListBookmarks(ctx, &pb.ListBookmarksRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int32{}
+		for _, bookmark := range resp.Bookmarks {
+			ids = append(ids, bookmark.Submission.Id)
+		}
+		return ids
+	}
+	if got := ids(ctx); !reflect.DeepEqual(got, []int32{id2, id1}) {
+		t.Fatal("Invalid bookmarks: ", got)
+	}
+	// bookmarks are per user
+	if got := ids(loginAsAdmin(t, client)); len(got) != 0 {
+		t.Fatal("Bookmarks of the other user are listed: ", got)
+	}
+
+	// submissions to unpublished problems are hidden
+	if _, err := client.ChangeProblemPublished(loginAsAdmin(t, client), &pb.ChangeProblemPublishedRequest{Name: "aplusb", Published: false}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(ctx); len(got) != 0 {
+		t.Fatal("Submissions to the unpublished problem are listed: ", got)
+	}
+	if _, err := client.ChangeProblemPublished(loginAsAdmin(t, client), &pb.ChangeProblemPublishedRequest{Name: "aplusb", Published: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.RemoveBookmark(ctx, &pb.RemoveBookmarkRequest{Id: id2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(ctx); !reflect.DeepEqual(got, []int32{id1}) {
+		t.Fatal("Invalid bookmarks after removal: ", got)
+	}
+}
+
+func TestEditorialVisibility(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	adminCtx := loginAsAdmin(t, client)
+	testerCtx := loginAsTester(t, client)
+	changeEditorial := func(visibility string) error {
+		_, err := client.ChangeProblemInfo(adminCtx, &pb.ChangeProblemInfoRequest{
+			Name:                "aplusb",
+			Title:               "A + B",
+			TimeLimit:           2.0,
+			EditorialUrl:        "https://example.com/editorial",
+			EditorialVisibility: visibility,
+		})
+		return err
+	}
+	visible := func(ctx context.Context) bool {
+		info, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
+			Name:   "aplusb",
+			Fields: []string{"editorial_url"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (info.EditorialUrl != "") == info.EditorialHidden {
+			t.Fatal("Inconsistent editorial: ", info)
+		}
+		return info.EditorialUrl != ""
+	}
+
+	if err := changeEditorial("unknown"); err == nil {
+		t.Fatal("Success to set an unknown visibility")
+	}
+	if err := changeEditorial(""); err != nil {
+		t.Fatal(err)
+	}
+	if visible(context.Background()) || visible(testerCtx) || !visible(adminCtx) {
+		t.Fatal("Invalid editorial visibility before solving")
+	}
+
+	if err := changeEditorial("attempted"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := client.Submit(testerCtx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "attempt",
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !visible(testerCtx) {
+		t.Fatal("Editorial is hidden after attempting")
+	}
+
+	if err := changeEditorial("solved"); err != nil {
+		t.Fatal(err)
+	}
+	if visible(testerCtx) {
+		t.Fatal("Editorial is visible before solving")
+	}
+	task, err := client.PopJudgeTask(adminCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(adminCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: task.SubmissionId,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if task.SubmissionId != sub.Id || !visible(testerCtx) {
+		t.Fatal("Editorial is hidden after solving")
+	}
+
+	if err := changeEditorial("always"); err != nil {
+		t.Fatal(err)
+	}
+	if !visible(context.Background()) {
+		t.Fatal("Editorial is hidden for always visibility")
+	}
+	// empty visibility keeps the current one
+	if err := changeEditorial(""); err != nil {
+		t.Fatal(err)
+	}
+	if !visible(context.Background()) {
+		t.Fatal("Editorial visibility is reset by empty visibility")
+	}
+
+	if _, err := client.ChangeProblemInfo(adminCtx, &pb.ChangeProblemInfoRequest{
+		Name:      "aplusb",
+		Title:     "A + B",
+		TimeLimit: 2.0,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if visible(adminCtx) {
+		t.Fatal("Editorial url is not cleared")
+	}
+}
+
+func TestSubmissionListLangs(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	ctx := context.Background()
+	for _, lang := range []string{"cpp", "cpp17", "rust"} {
+		if _, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  "source in " + lang,
+			Lang:    lang,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		req   *pb.SubmissionListRequest
+		count int32
+	}{
+		{&pb.SubmissionListRequest{Langs: []string{"cpp", "cpp17"}}, 2},
+		{&pb.SubmissionListRequest{Langs: []string{"rust"}}, 1},
+		{&pb.SubmissionListRequest{Lang: "cpp", Langs: []string{"cpp", "rust"}}, 1},
+		{&pb.SubmissionListRequest{Lang: "cpp17", Langs: []string{"rust"}}, 0},
+	} {
+		list, err := client.SubmissionList(ctx, c.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Count != c.count || len(list.Submissions) != int(c.count) {
+			t.Fatal("Invalid count: ", c.req, list.Count)
+		}
+	}
+}
+
+func TestProblemListUnattempted(t *testing.T) {
+	client, close := createAPIClient(t, createTestDB(t))
+	defer close()
+
+	if _, err := client.ProblemList(context.Background(), &pb.ProblemListRequest{UnattemptedOnly: true}); status.Code(err) != codes.Unauthenticated {
+		t.Fatal("Success to list unattempted problems without login: ", err)
+	}
+	ctx := loginAsTester(t, client)
+	hasAplusb := func() bool {
+		list, err := client.ProblemList(ctx, &pb.ProblemListRequest{UnattemptedOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, problem := range list.Problems {
+			if problem.Name == "aplusb" {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasAplusb() {
+		t.Fatal("Unattempted problem is not listed")
+	}
+	// anonymous submissions are not counted
+	submitSomething(t, client)
+	if !hasAplusb() {
+		t.Fatal("Unattempted problem is not listed")
+	}
+	if _, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "attempt",
+		Lang:    "cpp",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if hasAplusb() {
+		t.Fatal("Attempted problem is listed")
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	db := createTestDB(t)
+	config := DefaultServerConfig()
+	config.DisabledFeatures = []string{"export_submissions"}
+	client, close := createAPIClientWithConfig(t, db, config)
+	defer close()
+
+	features, err := client.Features(context.Background(), &pb.FeaturesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := map[string]bool{"bookmark": true, "submission_diff": true, "export_submissions": false}; !reflect.DeepEqual(features.Flags, expect) {
+		t.Fatal("Invalid features: ", features.Flags)
+	}
+
+	ctx := loginAsTester(t, client)
+	if _, err := client.ChangeFeatureFlags(ctx, &pb.ChangeFeatureFlagsRequest{
+		Flags: map[string]bool{"bookmark": false},
+	}); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("Success to change feature flags by non-admin: ", err)
+	}
+	adminCtx := loginAsAdmin(t, client)
+	if _, err := client.ChangeFeatureFlags(adminCtx, &pb.ChangeFeatureFlagsRequest{
+		Flags: map[string]bool{"unknown_feature": true},
+	}); err == nil {
+		t.Fatal("Success to change an unknown feature")
+	}
+	if _, err := client.ChangeFeatureFlags(adminCtx, &pb.ChangeFeatureFlagsRequest{
+		Flags: map[string]bool{"bookmark": false, "export_submissions": true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	features, err = client.Features(context.Background(), &pb.FeaturesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features.Flags["bookmark"] || features.Flags["export_submissions"] {
+		t.Fatal("Invalid features: ", features.Flags)
+	}
+
+	id := submitSomething(t, client)
+	if _, err := client.AddBookmark(ctx, &pb.AddBookmarkRequest{Id: id}); status.Code(err) != codes.Unimplemented {
+		t.Fatal("Success to use a disabled feature: ", err)
+	}
+	if _, err := client.ListBookmarks(ctx, &pb.ListBookmarksRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Fatal("Success to use a disabled feature: ", err)
+	}
+
+	if _, err := client.ChangeFeatureFlags(adminCtx, &pb.ChangeFeatureFlagsRequest{
+		Reset_: []string{"bookmark"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddBookmark(ctx, &pb.AddBookmarkRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// broken flags are not overwritten by the defaults
+	if err := setMetadata(db, featureFlagsKey, "broken"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ChangeFeatureFlags(adminCtx, &pb.ChangeFeatureFlagsRequest{
+		Flags: map[string]bool{"bookmark": true},
+	}); err == nil {
+		t.Fatal("Success to change broken feature flags")
+	}
+}
+
+func TestRecomputeUserStatistics(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	ctx := loginAsTester(t, client)
+	if _, err := client.RecomputeUserStatistics(ctx, &pb.RecomputeUserStatisticsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("Success to recompute statistics by non-admin: ", err)
+	}
+
+	stats, err := client.SiteStatistics(context.Background(), &pb.SiteStatisticsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SubmissionCount != 0 {
+		t.Fatal("Invalid statistics: ", stats)
+	}
+	if _, err := client.Submit(ctx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "tester source",
+		Lang:    "cpp",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	submitSomething(t, client)
+
+	adminCtx := loginAsAdmin(t, client)
+	if _, err := client.RecomputeUserStatistics(adminCtx, &pb.RecomputeUserStatisticsRequest{Name: "unknown-user"}); err == nil {
+		t.Fatal("Success to recompute statistics of an unknown user")
+	}
+	resp, err := client.RecomputeUserStatistics(adminCtx, &pb.RecomputeUserStatisticsRequest{Name: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.UpdatedUsers != 1 {
+		t.Fatal("Invalid updated users: ", resp.UpdatedUsers)
+	}
+	// anonymous submissions are not counted
+	resp, err = client.RecomputeUserStatistics(adminCtx, &pb.RecomputeUserStatisticsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.UpdatedUsers != 1 {
+		t.Fatal("Invalid updated users: ", resp.UpdatedUsers)
+	}
+
+	stats, err = client.SiteStatistics(context.Background(), &pb.SiteStatisticsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SubmissionCount != 2 {
+		t.Fatal("Statistics are not recomputed: ", stats)
+	}
+
+	// RecomputeUserStatistics on another server drops the caches of this server too
+	submitSomething(t, client)
+	if err := setMetadata(db, statisticsVersionKey, "another-server"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = client.SiteStatistics(context.Background(), &pb.SiteStatisticsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SubmissionCount != 3 {
+		t.Fatal("Statistics are not recomputed by another server: ", stats)
+	}
+}
+
+// readGRPCWebFrame reads a frame of gRPC-web, flag is 0x00 for a message and 0x80 for trailers
+func readGRPCWebFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+func TestSubmissionInfoStreamGRPCWeb(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	id := submitSomething(t, client)
+
+	// same as the gRPC-web server launched by -grpcweb
+	config := DefaultServerConfig()
+	config.Public = true
+	langs, err := ReadLangs("../langs/langs.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewGRPCServer(db, NewAuthTokenManager("dummy-hmac-secret"), langs, config)
+	defer s.Stop()
+	server := httptest.NewServer(grpcweb.WrapServer(s))
+	defer server.Close()
+
+	req, err := proto.Marshal(&pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(req)))
+	body = append(body, req...)
+	httpReq, err := http.NewRequest("POST", server.URL+"/librarychecker.LibraryCheckerService/SubmissionInfoStream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc-web+proto")
+	httpReq.Header.Set("X-Grpc-Web", "1")
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	flag, data, err := readGRPCWebFrame(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &pb.SubmissionInfoResponse{}
+	if err := proto.Unmarshal(data, info); flag != 0 || err != nil || info.Overview.Status != "WJ" {
+		t.Fatal("Invalid first message: ", flag, err, info)
+	}
+
+	judgeCtx := loginAsAdmin(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+		Time:         1.0,
+		Memory:       1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream is closed after the submission is finished
+	for {
+		flag, data, err := readGRPCWebFrame(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flag&0x80 != 0 {
+			if trailer := strings.ReplaceAll(strings.ToLower(string(data)), " ", ""); !strings.Contains(trailer, "grpc-status:0") {
+				t.Fatal("Stream failed: ", string(data))
+			}
+			break
+		}
+		info = &pb.SubmissionInfoResponse{}
+		if err := proto.Unmarshal(data, info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info.Overview.Status != "AC" {
+		t.Fatal("The last message is not finished: ", info)
 	}
 }
 
-func TestChangeProblemInfo(t *testing.T) {
+func TestWaitSubmissionInfo(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	ctx := loginAsAdmin(t, client)
+	id := submitSomething(t, client)
+	ctx := context.Background()
+	resp, err := client.WaitSubmissionInfo(ctx, &pb.WaitSubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Changed || resp.Info.Overview.Status != "WJ" {
+		t.Fatal("Invalid response: ", resp)
+	}
 
-	oldProblem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
-		Name: "aplusb",
+	start := time.Now()
+	resp, err = client.WaitSubmissionInfo(ctx, &pb.WaitSubmissionInfoRequest{
+		Id:      id,
+		Status:  "WJ",
+		Timeout: durationpb.New(2 * time.Second),
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if resp.Changed || time.Since(start) < time.Second {
+		t.Fatal("Invalid response: ", resp, time.Since(start))
+	}
 
-	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
-		Name:        "aplusb",
-		Title:       "dummy-title",
-		TimeLimit:   123.0,
-		Statement:   "dummy-statement",
-		CaseVersion: "dummy-version",
+	judgeCtx := loginAsAdmin(t, client)
+	if _, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
 	}); err != nil {
 		t.Fatal(err)
 	}
-
-	problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
-		Name: "aplusb",
-	})
-	if err != nil {
+	if _, err := client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: id,
+		Status:       "AC",
+		Time:         1.0,
+		Memory:       1,
+	}); err != nil {
 		t.Fatal(err)
 	}
-
-	if problem.Title != "dummy-title" {
-		t.Fatal("Title is not changed")
+	resp, err = client.WaitSubmissionInfo(ctx, &pb.WaitSubmissionInfoRequest{Id: id, Status: "WJ"})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if problem.TimeLimit != 123.0 {
-		t.Fatalf("TimeLimit is not changed: %v", problem.TimeLimit)
+	if !resp.Changed || resp.Info.Overview.Status != "AC" {
+		t.Fatal("Invalid response: ", resp)
 	}
-	if problem.Statement != "dummy-statement" {
-		t.Fatal("statement is not changed")
+	// finished submissions are not updated anymore
+	start = time.Now()
+	resp, err = client.WaitSubmissionInfo(ctx, &pb.WaitSubmissionInfoRequest{Id: id, Status: "AC"})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if problem.CaseVersion != "dummy-version" {
-		t.Fatal("CaseVersion is not changed: ", problem.CaseVersion)
+	if resp.Changed || time.Since(start) > 10*time.Second {
+		t.Fatal("Invalid response: ", resp, time.Since(start))
 	}
 
-	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
-		Name:        "aplusb",
-		Title:       oldProblem.Title,
-		TimeLimit:   oldProblem.TimeLimit,
-		Statement:   oldProblem.Statement,
-		CaseVersion: oldProblem.CaseVersion,
-	}); err != nil {
-		t.Fatal(err)
+	if _, err := client.WaitSubmissionInfo(ctx, &pb.WaitSubmissionInfoRequest{Id: 12345}); status.Code(err) != codes.NotFound {
+		t.Fatal("Success to wait an unknown submission: ", err)
 	}
+}
 
-	nowProblem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
-		Name: "aplusb",
-	})
+func TestSubmissionWatchLimit(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxWatchesPerClient = 1
+	config.TrustedIPHeader = "x-forwarded-for"
+	client, close := createAPIClientWithConfig(t, createTestDB(t), config)
+	defer close()
+
+	id := submitSomething(t, client)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.SubmissionInfoStream(ctx, &pb.SubmissionInfoRequest{Id: id})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if nowProblem.Title != oldProblem.Title {
-		t.Fatal("Title is not recovered")
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
 	}
-	if nowProblem.TimeLimit != oldProblem.TimeLimit {
-		t.Fatalf("TimeLimit is not recovered: %v vs %v", nowProblem.TimeLimit, problem.TimeLimit)
+	req := &pb.WaitSubmissionInfoRequest{Id: id, Timeout: durationpb.New(0)}
+	if _, err := client.WaitSubmissionInfo(context.Background(), req); status.Code(err) != codes.ResourceExhausted {
+		t.Fatal("Success to watch more submissions than the limit: ", err)
 	}
-	if nowProblem.Statement != oldProblem.Statement {
-		t.Fatal("Statement is not changed")
+	// another user has its own limit
+	if _, err := client.WaitSubmissionInfo(loginAsTester(t, client), req); err != nil {
+		t.Fatal(err)
 	}
-	if nowProblem.CaseVersion != oldProblem.CaseVersion {
-		t.Fatal("CaseVersion is not changed")
+
+	// the watch is released after the stream is closed
+	cancel()
+	for i := 0; ; i++ {
+		_, err := client.WaitSubmissionInfo(context.Background(), req)
+		if err == nil {
+			break
+		}
+		if status.Code(err) != codes.ResourceExhausted || i == 10 {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
 	}
 }
 
-func TestChangeProblemInfoByTester(t *testing.T) {
-	client, close := createAPIClient(t, createTestDB(t))
+func TestAnonymousWatchWithoutTrustedIPHeader(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxWatchesPerClient = 1
+	client, close := createAPIClientWithConfig(t, createTestDB(t), config)
 	defer close()
 
-	ctx := loginAsTester(t, client)
-
-	_, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
-		Name: "aplusb",
-	})
+	id := submitSomething(t, client)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.SubmissionInfoStream(ctx, &pb.SubmissionInfoRequest{Id: id})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	// anonymous users may share the address of the proxy, so they are not limited
+	req := &pb.WaitSubmissionInfoRequest{Id: id, Timeout: durationpb.New(0)}
+	if _, err := client.WaitSubmissionInfo(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
 
-	_, err = client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
-		Name:        "aplusb",
-		Title:       "dummy-title",
-		TimeLimit:   123.0,
-		Statement:   "dummy-statement",
-		CaseVersion: "dummy-version",
-	})
-	if err == nil {
-		t.Fatal("success to ChangeProblemInfo")
+	// logged in users are still limited
+	testerCtx, testerCancel := context.WithCancel(loginAsTester(t, client))
+	defer testerCancel()
+	testerStream, err := client.SubmissionInfoStream(testerCtx, &pb.SubmissionInfoRequest{Id: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testerStream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WaitSubmissionInfo(loginAsTester(t, client), req); status.Code(err) != codes.ResourceExhausted {
+		t.Fatal("Success to watch more submissions than the limit: ", err)
 	}
-	t.Log(err)
 }
 
-func TestCreateProblem(t *testing.T) {
-	client, close := createAPIClient(t, createTestDB(t))
+func TestDeleteAnonymousSubmissions(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
 	defer close()
 
-	ctx := loginAsAdmin(t, client)
-
-	name := uuid.New().String()
-	if _, err := client.ChangeProblemInfo(ctx, &pb.ChangeProblemInfoRequest{
-		Name:        name,
-		Title:       "dummy-title-x",
-		TimeLimit:   1234.0,
-		Statement:   "dummy-statement-x",
-		CaseVersion: "dummy-version-x",
+	finished := submitSomething(t, client)
+	queued := submitSomething(t, client)
+	testerCtx := loginAsTester(t, client)
+	named, err := client.Submit(testerCtx, &pb.SubmitRequest{
+		Problem: "aplusb",
+		Source:  "named source",
+		Lang:    "cpp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminCtx := loginAsAdmin(t, client)
+	if _, err := client.PopJudgeTask(adminCtx, &pb.PopJudgeTaskRequest{
+		JudgeName: "judge-test",
 	}); err != nil {
-		t.Fatal("Failed to create problem")
+		t.Fatal(err)
+	}
+	if _, err := client.FinishJudgeTask(adminCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: finished,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&SubmissionTestcaseResult{Submission: finished, Testcase: "example_00", Status: "AC"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Submission{}).Where("id in ?", []int32{finished, queued, named.Id}).Update("submit_time", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
 	}
 
-	problem, err := client.ProblemInfo(ctx, &pb.ProblemInfoRequest{
-		Name: name,
+	if _, err := client.DeleteAnonymousSubmissions(testerCtx, &pb.DeleteAnonymousSubmissionsRequest{
+		OlderThan: durationpb.New(30 * time.Minute),
+	}); status.Code(err) != codes.PermissionDenied {
+		t.Fatal("Success to delete submissions by non-admin: ", err)
+	}
+	// the retention is not configured
+	if _, err := client.DeleteAnonymousSubmissions(adminCtx, &pb.DeleteAnonymousSubmissionsRequest{}); err == nil {
+		t.Fatal("Success to delete submissions without the retention")
+	}
+	resp, err := client.DeleteAnonymousSubmissions(adminCtx, &pb.DeleteAnonymousSubmissionsRequest{
+		OlderThan: durationpb.New(30 * time.Minute),
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if problem.Title != "dummy-title-x" {
-		t.Fatal("Title is invalid")
+	if resp.Deleted != 1 {
+		t.Fatal("Invalid # of deleted submissions: ", resp.Deleted)
 	}
-	if problem.TimeLimit != 1234.0 {
-		t.Fatalf("TimeLimit is invalid: %v", problem.TimeLimit)
+	if _, err := client.SubmissionInfo(context.Background(), &pb.SubmissionInfoRequest{Id: finished}); status.Code(err) != codes.NotFound {
+		t.Fatal("Anonymous submission is not deleted: ", err)
 	}
-	if problem.Statement != "dummy-statement-x" {
-		t.Fatal("statement is invalid")
+	var count int64
+	if err := db.Model(&SubmissionTestcaseResult{}).Where("submission = ?", finished).Count(&count).Error; err != nil {
+		t.Fatal(err)
 	}
-	if problem.CaseVersion != "dummy-version-x" {
-		t.Fatal("CaseVersion is invalid")
+	if count != 0 {
+		t.Fatal("Case results are not deleted: ", count)
+	}
+	for _, id := range []int32{queued, named.Id} {
+		if _, err := client.SubmissionInfo(context.Background(), &pb.SubmissionInfoRequest{Id: id}); err != nil {
+			t.Fatal("Submission is deleted: ", id, err)
+		}
+	}
+
+	// only one server deletes at a time
+	tx := db.Begin()
+	defer tx.Rollback()
+	if err := tx.Exec("select pg_advisory_xact_lock(?)", anonymousSubmissionDeleteLock).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deleteAnonymousSubmissions(db, time.Now()); !errors.Is(err, errAnonymousSubmissionDeleteRunning) {
+		t.Fatal("Success to delete while another server is deleting: ", err)
 	}
 }
 
-func TestProblemCategories(t *testing.T) {
+func TestSubmissionListCursor(t *testing.T) {
 	client, close := createAPIClient(t, createTestDB(t))
 	defer close()
 
-	ctx := loginAsAdmin(t, client)
-	testData := []*pb.ProblemCategory{
-		{
-			Title:    "a",
-			Problems: []string{"x", "y"},
-		},
-		{
-			Title:    "b",
-			Problems: []string{"z"},
-		},
+	var ids []int32
+	for i := 0; i < 5; i++ {
+		ids = append(ids, submitSomething(t, client))
+	}
+	ctx := context.Background()
+	var got []int32
+	beforeID := int32(0)
+	for page := 0; ; page++ {
+		if page > 3 {
+			t.Fatal("Too many pages")
+		}
+		list, err := client.SubmissionList(ctx, &pb.SubmissionListRequest{
+			Limit:    2,
+			BeforeId: beforeID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range list.Submissions {
+			got = append(got, sub.Id)
+		}
+		if page == 0 {
+			if list.Count != 5 {
+				t.Fatal("Invalid count: ", list.Count)
+			}
+			// a new submission doesn't shift the next pages
+			submitSomething(t, client)
+		}
+		if list.NextBeforeId == 0 {
+			break
+		}
+		beforeID = list.NextBeforeId
+	}
+	if expect := []int32{ids[4], ids[3], ids[2], ids[1], ids[0]}; !reflect.DeepEqual(got, expect) {
+		t.Fatal("Invalid pages: ", got, expect)
 	}
 
-	for phase := 0; phase <= 1; phase++ {
+	if _, err := client.SubmissionList(ctx, &pb.SubmissionListRequest{
+		Order:    "+time",
+		BeforeId: ids[2],
+	}); err == nil {
+		t.Fatal("Success to use before_id with +time order")
+	}
+}
 
-		if _, err := client.ChangeProblemCategories(ctx, &pb.ChangeProblemCategoriesRequest{
-			Categories: testData,
-		}); err != nil {
+func TestNextUnsolvedInCategory(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	adminCtx := loginAsAdmin(t, client)
+	if _, err := client.ChangeProblemInfo(adminCtx, &pb.ChangeProblemInfoRequest{
+		Name:        "unionfind",
+		Title:       "Union Find",
+		TimeLimit:   5.0,
+		Statement:   "Union Find",
+		CaseVersion: "dummy-version",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ChangeProblemCategories(adminCtx, &pb.ChangeProblemCategoriesRequest{
+		Categories: []*pb.ProblemCategory{
+			{Title: "Sample", Problems: []string{"not_created", "aplusb", "unionfind"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &pb.NextUnsolvedInCategoryRequest{Category: "Sample"}
+	if _, err := client.NextUnsolvedInCategory(context.Background(), req); status.Code(err) != codes.Unauthenticated {
+		t.Fatal("Success to get the next problem without login: ", err)
+	}
+	ctx := loginAsTester(t, client)
+	if _, err := client.NextUnsolvedInCategory(ctx, &pb.NextUnsolvedInCategoryRequest{Category: "Unknown"}); status.Code(err) != codes.NotFound {
+		t.Fatal("Success to get the next problem of an unknown category: ", err)
+	}
+	next := func() *pb.NextUnsolvedInCategoryResponse {
+		resp, err := client.NextUnsolvedInCategory(ctx, req)
+		if err != nil {
 			t.Fatal(err)
 		}
-		res, err := client.ProblemCategories(ctx, &pb.ProblemCategoriesRequest{})
+		return resp
+	}
+	if resp := next(); resp.Problem != "aplusb" || resp.UnsolvedCount != 2 {
+		t.Fatal("Invalid next problem: ", resp)
+	}
+
+	solve := func(problem string) {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: problem,
+			Source:  "ac source of " + problem,
+			Lang:    "cpp",
+		})
 		if err != nil {
 			t.Fatal(err)
 		}
-		expect := testData
-		actual := res.Categories
-
-		if len(expect) != len(actual) {
-			t.Fatal("len is differ")
+		if err := db.Model(&Submission{}).Where("id = ?", resp.Id).Update("status", "AC").Error; err != nil {
+			t.Fatal(err)
 		}
+	}
+	solve("aplusb")
+	if resp := next(); resp.Problem != "unionfind" || resp.UnsolvedCount != 1 {
+		t.Fatal("Invalid next problem: ", resp)
+	}
+	solve("unionfind")
+	if resp := next(); resp.Problem != "" || resp.UnsolvedCount != 0 {
+		t.Fatal("Invalid next problem: ", resp)
+	}
+}
 
-		for i := 0; i < len(expect); i++ {
-			if expect[i].Title != actual[i].Title {
-				t.Fatal("title is differ")
-			}
-			if !reflect.DeepEqual(expect[i].Problems, actual[i].Problems) {
-				t.Fatal("problems is differ")
-			}
-		}
+func TestMaxInFlightPerUser(t *testing.T) {
+	db := createTestDB(t)
+	config := DefaultServerConfig()
+	config.MaxInFlightPerUser = 1
+	client, close := createAPIClientWithConfig(t, db, config)
+	defer close()
 
-		testData = append(testData, &pb.ProblemCategory{
-			Title:    "c",
-			Problems: []string{"w"},
+	submit := func(ctx context.Context, src string) int32 {
+		resp, err := client.Submit(ctx, &pb.SubmitRequest{
+			Problem: "aplusb",
+			Source:  src,
+			Lang:    "cpp",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Id
+	}
+	testerCtx := loginAsTester(t, client)
+	adminCtx := loginAsAdmin(t, client)
+	tester1 := submit(testerCtx, "source 1")
+	tester2 := submit(testerCtx, "source 2")
+	admin1 := submit(adminCtx, "source 3")
+	admin2 := submit(adminCtx, "source 4")
+	anonymous1 := submit(context.Background(), "source 5")
+	anonymous2 := submit(context.Background(), "source 6")
+
+	pop := func() int32 {
+		resp, err := client.PopJudgeTask(adminCtx, &pb.PopJudgeTaskRequest{
+			JudgeName: "judge-test",
 		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.SubmissionId
+	}
+	// tester2 waits until tester1 is finished, admins are exempt, anonymous submissions are limited together
+	for _, expect := range []int32{tester1, admin1, admin2, anonymous1, -1} {
+		if id := pop(); id != expect {
+			t.Fatalf("Invalid order: expect %v, actual %v", expect, id)
+		}
+	}
+	if _, err := client.FinishJudgeTask(adminCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: tester1,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if id := pop(); id != tester2 {
+		t.Fatalf("Invalid order: expect %v, actual %v", tester2, id)
+	}
+	if _, err := client.FinishJudgeTask(adminCtx, &pb.FinishJudgeTaskRequest{
+		JudgeName:    "judge-test",
+		SubmissionId: anonymous1,
+		Status:       "AC",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if id := pop(); id != anonymous2 {
+		t.Fatalf("Invalid order: expect %v, actual %v", anonymous2, id)
+	}
+}
+
+func TestSubmissionLangVersion(t *testing.T) {
+	db := createTestDB(t)
+	client, close := createAPIClient(t, db)
+	defer close()
+
+	lang, err := client.LangInfo(context.Background(), &pb.LangInfoRequest{Id: "cpp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := submitSomething(t, client)
+	info := testFetchSubmission(t, id, client)
+	if info.LangVersion == "" || info.LangVersion != lang.Lang.Version {
+		t.Fatal("Invalid lang version: ", info.LangVersion, lang.Lang.Version)
+	}
+
+	// the version at submit time is kept after the lang is upgraded
+	if err := db.Model(&Submission{}).Where("id = ?", id).Update("lang_version", "g++(1.0)").Error; err != nil {
+		t.Fatal(err)
+	}
+	if info := testFetchSubmission(t, id, client); info.LangVersion != "g++(1.0)" {
+		t.Fatal("Invalid lang version: ", info.LangVersion)
 	}
 }
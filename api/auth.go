@@ -2,16 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	_ "github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+var (
+	errNotLoggedIn      = status.Error(codes.Unauthenticated, "login required")
+	errPermissionDenied = status.Error(codes.PermissionDenied, "permission denied")
+)
+
+// permissionError returns the error for the user who lacks a permission: errNotLoggedIn if not logged in, errPermissionDenied otherwise
+func permissionError(user User) error {
+	if user.Name == "" {
+		return errNotLoggedIn
+	}
+	return errPermissionDenied
+}
+
 type AuthTokenManager struct {
 	hmacKey []byte
+	// shared secret of judges, which can call only judge RPCs (empty: disabled)
+	judgeToken []byte
 }
 
 func NewAuthTokenManager(hmacKey string) AuthTokenManager {
@@ -23,6 +42,11 @@ func NewAuthTokenManager(hmacKey string) AuthTokenManager {
 	}
 }
 
+// SetJudgeToken enables the authentication of judges by the shared secret token
+func (a *AuthTokenManager) SetJudgeToken(token string) {
+	a.judgeToken = []byte(token)
+}
+
 func (a *AuthTokenManager) IssueToken(user User) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"user": user.Name,
@@ -34,6 +58,26 @@ func (a *AuthTokenManager) IssueToken(user User) (string, error) {
 	return tokenString, nil
 }
 
+// judgeTokenLifetime is the lifetime of the tokens issued by RegisterJudge, judges should register again before it expires
+const judgeTokenLifetime = 24 * time.Hour
+
+// IssueJudgeToken issues the token which can act only as the judge named judgeName, and returns it with its expiry.
+// registeredAt is the registration time of the judge, the token is revoked if the judge is registered again or unregistered.
+func (a *AuthTokenManager) IssueJudgeToken(judgeName string, registeredAt time.Time) (string, time.Time, error) {
+	expiresAt := registeredAt.Add(judgeTokenLifetime)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"judge":         judgeName,
+		"registered_at": registeredAt.UnixMicro(),
+		"iat":           registeredAt.Unix(),
+		"exp":           expiresAt.Unix(),
+	})
+	tokenString, err := token.SignedString(a.hmacKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expiresAt, nil
+}
+
 func (a *AuthTokenManager) authnFunc(ctx context.Context) (context.Context, error) {
 	tokenStr, err := grpc_auth.AuthFromMD(ctx, "bearer")
 	if err != nil {
@@ -41,6 +85,10 @@ func (a *AuthTokenManager) authnFunc(ctx context.Context) (context.Context, erro
 		return ctx, nil
 	}
 
+	if len(a.judgeToken) != 0 && subtle.ConstantTimeCompare([]byte(tokenStr), a.judgeToken) == 1 {
+		return context.WithValue(ctx, JudgeKey{}, true), nil
+	}
+
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -61,6 +109,14 @@ func (a *AuthTokenManager) authnFunc(ctx context.Context) (context.Context, erro
 			ctx = context.WithValue(ctx, UserNameKey{}, name)
 		}
 	}
+	if val, ok := claims["judge"]; ok {
+		if name, ok := val.(string); ok && name != "" {
+			ctx = context.WithValue(ctx, JudgeNameKey{}, name)
+			if registeredAt, ok := claims["registered_at"].(float64); ok {
+				ctx = context.WithValue(ctx, JudgeRegisteredAtKey{}, int64(registeredAt))
+			}
+		}
+	}
 	return ctx, nil
 }
 
@@ -73,3 +129,31 @@ func getCurrentUserName(ctx context.Context) string {
 	}
 	return ""
 }
+
+type JudgeKey struct{}
+
+type JudgeNameKey struct{}
+
+// isJudge returns whether the request is authenticated by the judge token, or the token issued by RegisterJudge
+func isJudge(ctx context.Context) bool {
+	judge, ok := ctx.Value(JudgeKey{}).(bool)
+	return (ok && judge) || getJudgeName(ctx) != ""
+}
+
+// getJudgeName returns the judge name of the token issued by RegisterJudge
+func getJudgeName(ctx context.Context) string {
+	if judgeName, ok := ctx.Value(JudgeNameKey{}).(string); ok {
+		return judgeName
+	}
+	return ""
+}
+
+type JudgeRegisteredAtKey struct{}
+
+// getJudgeRegisteredAt returns the registration time (unix microseconds) in the token issued by RegisterJudge, or 0 if unknown
+func getJudgeRegisteredAt(ctx context.Context) int64 {
+	if registeredAt, ok := ctx.Value(JudgeRegisteredAtKey{}).(int64); ok {
+		return registeredAt
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	pb "github.com/yosupo06/library-checker-judge/api/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxBookmarks is the maximum number of bookmarks of a user
+const maxBookmarks = 1000
+
+func addBookmark(db *gorm.DB, userName string, id int32, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		count := int64(0)
+		if err := tx.Model(&Bookmark{}).Where("user_name = ?", userName).Count(&count).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to count bookmarks")
+		}
+		if maxBookmarks <= count {
+			return errors.New("too many bookmarks")
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Bookmark{
+			UserName:   userName,
+			Submission: id,
+			CreateTime: now,
+		}).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to add bookmark")
+		}
+		return nil
+	})
+}
+
+func (s *server) AddBookmark(ctx context.Context, in *pb.AddBookmarkRequest) (*pb.AddBookmarkResponse, error) {
+	if err := s.checkFeature("bookmark"); err != nil {
+		return nil, err
+	}
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	if currentUserName == "" {
+		return nil, errNotLoggedIn
+	}
+	sub, err := fetchSubmission(s.db, in.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.visibleProblems(ctx, s.db).Select("name").Where("name = ?", sub.ProblemName).Take(&Problem{}).Error; err != nil {
+		return nil, errSubmissionNotFound
+	}
+	if err := addBookmark(s.db, currentUserName, in.Id, time.Now()); err != nil {
+		return nil, err
+	}
+	return &pb.AddBookmarkResponse{}, nil
+}
+
+func (s *server) RemoveBookmark(ctx context.Context, in *pb.RemoveBookmarkRequest) (*pb.RemoveBookmarkResponse, error) {
+	if err := s.checkFeature("bookmark"); err != nil {
+		return nil, err
+	}
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	if currentUserName == "" {
+		return nil, errNotLoggedIn
+	}
+	if err := s.db.Where("user_name = ? and submission = ?", currentUserName, in.Id).Delete(&Bookmark{}).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to remove bookmark")
+	}
+	return &pb.RemoveBookmarkResponse{}, nil
+}
+
+func (s *server) ListBookmarks(ctx context.Context, in *pb.ListBookmarksRequest) (*pb.ListBookmarksResponse, error) {
+	if err := s.checkFeature("bookmark"); err != nil {
+		return nil, err
+	}
+	currentUserName := getCurrentUserName(ctx)
+	if currentUserName == "" {
+		return nil, errNotLoggedIn
+	}
+	bookmarks := make([]Bookmark, 0)
+	if err := s.db.Where("user_name = ?", currentUserName).Order("create_time desc, submission desc").Find(&bookmarks).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch bookmarks")
+	}
+	ids := make([]int32, 0, len(bookmarks))
+	for _, bookmark := range bookmarks {
+		ids = append(ids, bookmark.Submission)
+	}
+
+	var submissions = make([]Submission, 0)
+	if err := s.db.
+		Preload("User", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name")
+		}).
+		Preload("Problem", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name, title, testhash")
+		}).
+		Select("id, user_name, problem_name, lang, status, hacked, testhash, max_time, max_memory").
+		Where("id in ? and problem_name in (?)", ids, s.visibleProblems(ctx, s.db.Model(&Problem{})).Select("name")).
+		Find(&submissions).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch bookmarked submissions")
+	}
+	byID := make(map[int32]*Submission)
+	for i := range submissions {
+		byID[submissions[i].ID] = &submissions[i]
+	}
+
+	res := &pb.ListBookmarksResponse{}
+	for _, bookmark := range bookmarks {
+		sub, ok := byID[bookmark.Submission]
+		if !ok {
+			// deleted or invisible
+			continue
+		}
+		overview, err := toProtoSubmission(sub)
+		if err != nil {
+			log.Print(err)
+			return nil, err
+		}
+		res.Bookmarks = append(res.Bookmarks, &pb.Bookmark{
+			Submission: overview,
+			CreateTime: timestamppb.New(bookmark.CreateTime),
+		})
+	}
+	return res, nil
+}
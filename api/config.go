@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DBConfig is the connection setting of postgre
+type DBConfig struct {
+	Host     string
+	Port     string
+	DBName   string
+	User     string
+	Password string
+	Log      bool
+
+	// PasswordSecret is gcloud secret of Password, and it is re-fetched every PasswordRefresh if PasswordRefresh > 0
+	PasswordSecret  string
+	PasswordRefresh time.Duration
+}
+
+// DBConfigSource is the raw values used to build DBConfig
+// Each setting is resolved with the following precedence:
+// gcloud secret > command line flag > environment variable > default value
+type DBConfigSource struct {
+	Host       string // -pghost
+	HostSecret string // -pghost-secret
+	Pass       string // -pgpass
+	PassSecret string // -pgpass-secret
+
+	PassRefresh time.Duration // -pgpass-refresh
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func resolveSetting(secretKey, flagValue, envKey, defaultValue string) string {
+	if secretKey != "" {
+		return getSecureString(secretKey, "")
+	}
+	if flagValue != "" {
+		return flagValue
+	}
+	return getEnv(envKey, defaultValue)
+}
+
+func loadDBConfig(src DBConfigSource) DBConfig {
+	passSecret := firstNonEmpty(src.PassSecret, os.Getenv("POSTGRE_PASS_SECRET"))
+	passRefresh := src.PassRefresh
+	if passRefresh == 0 {
+		if d, err := time.ParseDuration(getEnv("POSTGRE_PASS_REFRESH", "0s")); err == nil {
+			passRefresh = d
+		} else {
+			passRefresh = -1 // rejected by Validate
+		}
+	}
+	return DBConfig{
+		Host: resolveSetting(
+			firstNonEmpty(src.HostSecret, os.Getenv("POSTGRE_HOST_SECRET")),
+			src.Host, "POSTGRE_HOST", "127.0.0.1"),
+		Port:            getEnv("POSTGRE_PORT", "5432"),
+		DBName:          getEnv("POSTGRE_DB", "librarychecker"),
+		User:            getEnv("POSTGRE_USER", "postgres"),
+		Password:        resolveSetting(passSecret, src.Pass, "POSTGRE_PASS", "passwd"),
+		Log:             getEnv("API_DB_LOG", "") != "",
+		PasswordSecret:  passSecret,
+		PasswordRefresh: passRefresh,
+	}
+}
+
+func (c DBConfig) Validate() error {
+	if c.Host == "" {
+		return errors.New("postgre host is empty")
+	}
+	if c.Port == "" {
+		return errors.New("postgre port is empty")
+	}
+	if _, err := strconv.Atoi(c.Port); err != nil {
+		return fmt.Errorf("invalid postgre port: %v", c.Port)
+	}
+	if c.DBName == "" {
+		return errors.New("postgre db name is empty")
+	}
+	if c.User == "" {
+		return errors.New("postgre user is empty")
+	}
+	if c.Password == "" {
+		return errors.New("postgre password is empty")
+	}
+	if c.PasswordRefresh < 0 {
+		return errors.New("invalid postgre password refresh interval")
+	}
+	if c.PasswordRefresh > 0 && c.PasswordSecret == "" {
+		return errors.New("postgre password refresh requires password secret")
+	}
+	return nil
+}
+
+// maxTaskPriority is the upper bound of the configurable task priorities
+const maxTaskPriority = 1000
+
+// ServerConfig is the tunable parameters of the API server
+type ServerConfig struct {
+	// a user cannot submit the same source to the same problem within this duration (0: disabled)
+	DuplicateSubmissionWindow time.Duration
+	// maximum size of a source in bytes, at most sourceHardLimit (1MiB)
+	MaxSourceLength int
+	// maximum size of a compile error in bytes reported by judges, the rest is truncated
+	MaxCompileErrorLength int
+	// force maintenance (read-only) mode
+	Maintenance bool
+	// page size of SubmissionList if limit is not specified
+	SubmissionListDefaultLimit int
+	// maximum page size of SubmissionList
+	SubmissionListMaxLimit int
+	// lease of a judge task if the judge does not specify expected_time
+	JudgeTaskLeaseDefault time.Duration
+	// maximum lease of a judge task that a judge can request
+	JudgeTaskLeaseMax time.Duration
+	// priority of judge tasks of new submissions and rejudges, a task with higher priority is judged first
+	SubmitPriority  int32
+	RejudgePriority int32
+	// give up judging a submission (status IE) after judges fail to finish it this many times (0: unlimited)
+	JudgeTaskMaxAttempts int
+	// rough judge time of a submission, used to estimate the waiting time in the queue
+	EstimatedJudgeTime time.Duration
+	// reject submissions in the excluded langs of the problem, instead of warning
+	BlockExcludedLangs bool
+	// register gRPC reflection service (for development tools, e.g. grpcurl)
+	Reflection bool
+	// reject judge RPCs with the JudgeName which is not registered by RegisterJudge from the shared judge token and admins
+	// (the tokens issued by RegisterJudge are always rejected after the judge is unregistered)
+	RequireJudgeRegistration bool
+	// interleave judge tasks of the same priority across users, so that one user cannot monopolize the queue
+	FairScheduling bool
+	// max # of submissions of a non-admin user in judging at once, the other tasks of the user wait in the queue (0: unlimited).
+	// All anonymous submissions share this limit.
+	MaxInFlightPerUser int
+	// a non-admin user cannot rejudge the same submission within this duration (0: disabled)
+	RejudgeCooldown time.Duration
+	// max # of submissions of a non-admin user per day (UTC) (0: unlimited)
+	DailySubmissionQuota int
+	// reject submissions by users who don't login
+	DisableAnonymousSubmission bool
+	// max # of anonymous submissions from the same IP address within AnonymousSubmissionWindow (0: unlimited).
+	// Behind a proxy, TrustedIPHeader must be set, otherwise all anonymous users share the address of the proxy.
+	AnonymousSubmissionLimit  int
+	AnonymousSubmissionWindow time.Duration
+	// delete anonymous submissions older than this every AnonymousSubmissionCleanupInterval (0: keep forever)
+	AnonymousSubmissionRetention       time.Duration
+	AnonymousSubmissionCleanupInterval time.Duration
+	// max # of SubmissionInfoStream and WaitSubmissionInfo at once per user, or per IP address if not logged in and TrustedIPHeader is set (0: unlimited)
+	MaxWatchesPerClient int
+	// reject InternalMethods on this server, for the listener exposed to the public (e.g. gRPC-web)
+	Public bool
+	// methods which are not available on the public listener, e.g. "PopJudgeTask"
+	InternalMethods []string
+	// header set by the trusted proxy to get the client IP address, e.g. "x-forwarded-for" (empty: use the peer address)
+	TrustedIPHeader string
+	// bearer token to access the extra HTTP endpoints of the gRPC-web server, e.g. /metrics (empty: not required)
+	HTTPToken string
+	// IP addresses or CIDRs which can access the extra HTTP endpoints without HTTPToken (empty: none)
+	HTTPAllowlist []string
+	// protect /health as well as the other HTTP endpoints, it is open by default for probes
+	ProtectHealth bool
+	// origins which can call gRPC-web, e.g. "https://judge.yosupo.jp" (empty: any)
+	AllowedOrigins []string
+	// features which are disabled regardless of ChangeFeatureFlags, e.g. "bookmark"
+	DisabledFeatures []string
+	// directory which has <testhash>.zip of the test cases, used instead of minio (e.g. for development)
+	CaseDir string
+	// minio which has the test cases uploaded by the deploy script (empty MinioHost and CaseDir: test cases are not available)
+	MinioHost   string
+	MinioID     string
+	MinioKey    string
+	MinioBucket string
+	MinioSecure bool
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		DuplicateSubmissionWindow:          30 * time.Second,
+		MaxSourceLength:                    sourceHardLimit,
+		MaxCompileErrorLength:              64 * 1024,
+		SubmissionListDefaultLimit:         100,
+		SubmissionListMaxLimit:             1000,
+		JudgeTaskLeaseDefault:              time.Minute,
+		JudgeTaskLeaseMax:                  10 * time.Minute,
+		JudgeTaskMaxAttempts:               5,
+		SubmitPriority:                     50,
+		RejudgePriority:                    40,
+		EstimatedJudgeTime:                 10 * time.Second,
+		RejudgeCooldown:                    time.Minute,
+		AnonymousSubmissionWindow:          time.Minute,
+		AnonymousSubmissionCleanupInterval: time.Hour,
+		MaxWatchesPerClient:                5,
+		InternalMethods:                    []string{"RegisterJudge", "PopJudgeTask", "SyncJudgeTaskStatus", "FinishJudgeTask"},
+		MinioBucket:                        "testcase",
+	}
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("invalid integer %s=%s: %v", key, value, err)
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("invalid duration %s=%s: %v", key, value, err)
+	}
+	return d
+}
+
+func loadServerConfig() ServerConfig {
+	config := DefaultServerConfig()
+	config.DuplicateSubmissionWindow = getEnvDuration("API_DUPLICATE_SUBMISSION_WINDOW", config.DuplicateSubmissionWindow)
+	config.MaxSourceLength = getEnvInt("API_MAX_SOURCE_LENGTH", config.MaxSourceLength)
+	config.MaxCompileErrorLength = getEnvInt("API_MAX_COMPILE_ERROR_LENGTH", config.MaxCompileErrorLength)
+	config.Maintenance = getEnv("API_MAINTENANCE", "") != ""
+	config.SubmissionListDefaultLimit = getEnvInt("API_SUBMISSION_LIST_DEFAULT_LIMIT", config.SubmissionListDefaultLimit)
+	config.SubmissionListMaxLimit = getEnvInt("API_SUBMISSION_LIST_MAX_LIMIT", config.SubmissionListMaxLimit)
+	config.JudgeTaskLeaseDefault = getEnvDuration("API_JUDGE_TASK_LEASE_DEFAULT", config.JudgeTaskLeaseDefault)
+	config.JudgeTaskLeaseMax = getEnvDuration("API_JUDGE_TASK_LEASE_MAX", config.JudgeTaskLeaseMax)
+	config.SubmitPriority = int32(getEnvInt("API_SUBMIT_PRIORITY", int(config.SubmitPriority)))
+	config.RejudgePriority = int32(getEnvInt("API_REJUDGE_PRIORITY", int(config.RejudgePriority)))
+	config.JudgeTaskMaxAttempts = getEnvInt("API_JUDGE_TASK_MAX_ATTEMPTS", config.JudgeTaskMaxAttempts)
+	config.EstimatedJudgeTime = getEnvDuration("API_ESTIMATED_JUDGE_TIME", config.EstimatedJudgeTime)
+	config.BlockExcludedLangs = getEnv("API_BLOCK_EXCLUDED_LANGS", "") != ""
+	config.Reflection = getEnv("API_REFLECTION", "") != ""
+	config.RequireJudgeRegistration = getEnv("API_REQUIRE_JUDGE_REGISTRATION", "") != ""
+	config.FairScheduling = getEnv("API_FAIR_SCHEDULING", "") != ""
+	config.MaxInFlightPerUser = getEnvInt("API_MAX_IN_FLIGHT_PER_USER", config.MaxInFlightPerUser)
+	config.RejudgeCooldown = getEnvDuration("API_REJUDGE_COOLDOWN", config.RejudgeCooldown)
+	config.DailySubmissionQuota = getEnvInt("API_DAILY_SUBMISSION_QUOTA", config.DailySubmissionQuota)
+	config.DisableAnonymousSubmission = getEnv("API_DISABLE_ANONYMOUS_SUBMISSION", "") != ""
+	config.AnonymousSubmissionLimit = getEnvInt("API_ANONYMOUS_SUBMISSION_LIMIT", config.AnonymousSubmissionLimit)
+	config.AnonymousSubmissionWindow = getEnvDuration("API_ANONYMOUS_SUBMISSION_WINDOW", config.AnonymousSubmissionWindow)
+	config.AnonymousSubmissionRetention = getEnvDuration("API_ANONYMOUS_SUBMISSION_RETENTION", config.AnonymousSubmissionRetention)
+	config.AnonymousSubmissionCleanupInterval = getEnvDuration("API_ANONYMOUS_SUBMISSION_CLEANUP_INTERVAL", config.AnonymousSubmissionCleanupInterval)
+	config.MaxWatchesPerClient = getEnvInt("API_MAX_WATCHES_PER_CLIENT", config.MaxWatchesPerClient)
+	config.Public = getEnv("API_PUBLIC", "") != ""
+	if methods := getEnv("API_INTERNAL_METHODS", ""); methods != "" {
+		config.InternalMethods = strings.Split(methods, ",")
+	}
+	config.TrustedIPHeader = strings.ToLower(getEnv("API_TRUSTED_IP_HEADER", ""))
+	config.HTTPToken = getEnv("API_HTTP_TOKEN", "")
+	if allowlist := getEnv("API_HTTP_ALLOWLIST", ""); allowlist != "" {
+		config.HTTPAllowlist = strings.Split(allowlist, ",")
+	}
+	config.ProtectHealth = getEnv("API_PROTECT_HEALTH", "") != ""
+	if origins := getEnv("API_ALLOWED_ORIGINS", ""); origins != "" {
+		config.AllowedOrigins = strings.Split(origins, ",")
+	}
+	if features := getEnv("API_DISABLED_FEATURES", ""); features != "" {
+		config.DisabledFeatures = strings.Split(features, ",")
+	}
+	config.CaseDir = getEnv("API_CASE_DIR", "")
+	config.MinioHost = getEnv("API_MINIO_HOST", "")
+	config.MinioID = getEnv("API_MINIO_ID", "")
+	config.MinioKey = getEnv("API_MINIO_KEY", "")
+	config.MinioBucket = getEnv("API_MINIO_BUCKET", config.MinioBucket)
+	config.MinioSecure = getEnv("API_MINIO_SECURE", "") != ""
+	if err := config.Validate(); err != nil {
+		log.Fatal("invalid server config: ", err)
+	}
+	return config
+}
+
+func (c ServerConfig) Validate() error {
+	if c.MaxSourceLength <= 0 || sourceHardLimit < c.MaxSourceLength {
+		return fmt.Errorf("MaxSourceLength must be in [1, %d]", sourceHardLimit)
+	}
+	if c.MaxCompileErrorLength <= 0 {
+		return errors.New("MaxCompileErrorLength must be positive")
+	}
+	if c.SubmissionListMaxLimit <= 0 {
+		return errors.New("SubmissionListMaxLimit must be positive")
+	}
+	if c.SubmissionListDefaultLimit <= 0 || c.SubmissionListMaxLimit < c.SubmissionListDefaultLimit {
+		return errors.New("SubmissionListDefaultLimit must be in [1, SubmissionListMaxLimit]")
+	}
+	if c.DailySubmissionQuota < 0 {
+		return errors.New("DailySubmissionQuota must not be negative")
+	}
+	if c.AnonymousSubmissionLimit < 0 {
+		return errors.New("AnonymousSubmissionLimit must not be negative")
+	}
+	if c.AnonymousSubmissionLimit > 0 && c.AnonymousSubmissionWindow <= 0 {
+		return errors.New("AnonymousSubmissionWindow must be positive")
+	}
+	if c.AnonymousSubmissionRetention < 0 {
+		return errors.New("AnonymousSubmissionRetention must not be negative")
+	}
+	if c.AnonymousSubmissionRetention > 0 && c.AnonymousSubmissionCleanupInterval <= 0 {
+		return errors.New("AnonymousSubmissionCleanupInterval must be positive")
+	}
+	if c.MaxWatchesPerClient < 0 {
+		return errors.New("MaxWatchesPerClient must not be negative")
+	}
+	if c.MaxInFlightPerUser < 0 {
+		return errors.New("MaxInFlightPerUser must not be negative")
+	}
+	if c.RejudgeCooldown < 0 {
+		return errors.New("RejudgeCooldown must not be negative")
+	}
+	if c.SubmitPriority <= staleRejudgePriority || maxTaskPriority < c.SubmitPriority {
+		return fmt.Errorf("SubmitPriority must be in (%d, %d]", staleRejudgePriority, maxTaskPriority)
+	}
+	if c.RejudgePriority <= staleRejudgePriority || maxTaskPriority < c.RejudgePriority {
+		return fmt.Errorf("RejudgePriority must be in (%d, %d]", staleRejudgePriority, maxTaskPriority)
+	}
+	if c.JudgeTaskMaxAttempts < 0 {
+		return errors.New("JudgeTaskMaxAttempts must not be negative")
+	}
+	if c.EstimatedJudgeTime <= 0 {
+		return errors.New("EstimatedJudgeTime must be positive")
+	}
+	for _, method := range c.InternalMethods {
+		if !isServiceMethod(method) {
+			return fmt.Errorf("unknown internal method: %v", method)
+		}
+	}
+	for _, feature := range c.DisabledFeatures {
+		if _, ok := defaultFeatureFlags[feature]; !ok {
+			return fmt.Errorf("unknown feature: %v", feature)
+		}
+	}
+	if _, err := parseIPAllowlist(c.HTTPAllowlist); err != nil {
+		return fmt.Errorf("invalid HTTPAllowlist: %v", err)
+	}
+	if c.CaseDir != "" && c.MinioHost != "" {
+		return errors.New("CaseDir and MinioHost cannot be used together")
+	}
+	if c.MinioHost != "" && c.MinioBucket == "" {
+		return errors.New("MinioBucket is empty")
+	}
+	if c.JudgeTaskLeaseMax <= 0 {
+		return errors.New("JudgeTaskLeaseMax must be positive")
+	}
+	if c.JudgeTaskLeaseDefault <= 0 || c.JudgeTaskLeaseMax < c.JudgeTaskLeaseDefault {
+		return errors.New("JudgeTaskLeaseDefault must be in (0, JudgeTaskLeaseMax]")
+	}
+	return nil
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
 	_ "github.com/lib/pq"
 	pb "github.com/yosupo06/library-checker-judge/api/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -19,12 +25,29 @@ import (
 
 // Problem is db table
 type Problem struct {
-	Name      string `gorm:"primaryKey"`
-	Title     string
-	SourceUrl string
-	Statement string
-	Timelimit int32
-	Testhash  string
+	Name            string `gorm:"primaryKey"`
+	Title           string
+	Author          string // problem setters, e.g. "yosupo, alice"
+	SourceUrl       string
+	SolutionUrl     string
+	CheckerUrl      string
+	GeneratorUrl    string
+	Statement       string
+	StatementFormat string // "html", "markdown" or "latex"
+	Template        string
+	ExcludedLangs   string // comma separated, langs which are too slow to pass
+	Timelimit       int32
+	Testhash        string
+	CaseCount       int32
+	// testdata under preparation, submissions with Staging are judged against it until promoted
+	StagingTesthash  string
+	StagingCaseCount int32
+	Featured         bool
+	FeaturedOrder    int32 // display order in featured problems
+	Unpublished      bool  // hidden from non-admin users, e.g. under preparation
+	EditorialUrl     string
+	// who can see the editorial, "solved", "attempted" or "always"
+	EditorialVisibility string
 }
 
 // User is db table
@@ -38,23 +61,54 @@ type User struct {
 
 // Submission is db table
 type Submission struct {
-	ID           int32 `gorm:"primaryKey"`
-	ProblemName  string
-	Problem      Problem `gorm:"foreignKey:ProblemName"`
-	Lang         string
-	Status       string
-	PrevStatus   string
-	Hacked       bool
-	Source       string
-	Testhash     string
-	MaxTime      int32
-	MaxMemory    int64
-	CompileError []byte
-	JudgePing    time.Time
-	JudgeName    string
-	JudgeTasked  bool
-	UserName     sql.NullString
-	User         User `gorm:"foreignKey:UserName"`
+	ID             int32 `gorm:"primaryKey"`
+	ProblemName    string
+	Problem        Problem `gorm:"foreignKey:ProblemName"`
+	Lang           string
+	LangVersion    string // version of Lang at submit time, e.g. "g++(12.1)"
+	Status         string
+	PrevStatus     string
+	Hacked         bool
+	Source         string
+	SourceHash     string `gorm:"index"` // sourceHash(Source)
+	SubmitTime     time.Time
+	ClientIPHash   string       // hashed IP address of the submitter
+	DeadLetterTime sql.NullTime // set if judges failed to judge this submission too many times
+	RejudgeTime    sql.NullTime
+	RejudgedBy     string // the user who rejudged this submission last
+	HackedBy       string // the user whose rejudge made this submission hacked
+	Testhash       string
+	MaxTime        int32
+	MaxMemory      int64
+	CompileError   []byte
+	CompileCache   int32         // pb.CompileCacheStatus reported by the judge
+	CompileTime    sql.NullInt32 // in milliseconds, reported by the judge
+	JudgePing      time.Time
+	JudgeName      string
+	JudgeTaskID    int32  // id of the task by which the current judge claimed this submission
+	Staging        bool   // judged against the staging testhash of the problem, not counted in the statistics
+	StagingHash    string // the staging testhash which this submission was judged against
+	LastJudgeName  string
+	JudgeTasked    bool
+	RetryCompile   bool // re-enqueued by RetryCompile, the judge should compile from scratch
+	AdminNote      string
+	AdminTags      string // comma separated
+	UserName       sql.NullString
+	User           User `gorm:"foreignKey:UserName"`
+}
+
+// SubmissionQuota is db table, # of submissions of the user in the day (UTC)
+type SubmissionQuota struct {
+	UserName string    `gorm:"primaryKey"`
+	Day      time.Time `gorm:"primaryKey;type:date"`
+	Count    int
+}
+
+// Bookmark is db table, submissions saved by users
+type Bookmark struct {
+	UserName   string `gorm:"primaryKey"`
+	Submission int32  `gorm:"primaryKey"`
+	CreateTime time.Time
 }
 
 // SubmissionTestcaseResult is db table
@@ -69,9 +123,18 @@ type SubmissionTestcaseResult struct {
 // Task is db table
 type Task struct {
 	ID         int32 `gorm:"primaryKey"`
-	Submission int32
+	Submission int32 `gorm:"uniqueIndex"` // all tasks are pending (popped ones are deleted), so at most one task per submission
 	Priority   int32
 	Available  time.Time
+	Attempts   int32 // # of judges which have popped this submission before
+}
+
+// Judge is db table, judge nodes which are registered or have called judge RPCs
+type Judge struct {
+	Name           string       `gorm:"primaryKey"`
+	RegisteredAt   sql.NullTime // null: not registered by RegisterJudge
+	LastSeen       time.Time
+	ProcessedCount int64 // # of finished submissions
 }
 
 type Metadata struct {
@@ -106,34 +169,159 @@ func fetchUser(db *gorm.DB, name string) (User, error) {
 	return user, nil
 }
 
-func updateUser(db *gorm.DB, user User) error {
+// updateUser updates only the specified columns ("admin", "email", "library_url") of user
+func updateUser(db *gorm.DB, user User, columns []string) error {
 	name := user.Name
 	if name == "" {
 		return errors.New("User name is empty")
 	}
-	result := db.Model(&User{}).Where("name = ?", name).Updates(
-		map[string]interface{}{
-			"admin":       user.Admin,
-			"email":       user.Email,
-			"library_url": user.LibraryURL,
-		})
-	if err := result.Error; err != nil {
+	values := map[string]interface{}{}
+	for _, column := range columns {
+		switch column {
+		case "admin":
+			values[column] = user.Admin
+		case "email":
+			values[column] = user.Email
+		case "library_url":
+			values[column] = user.LibraryURL
+		default:
+			return errors.New("unknown column: " + column)
+		}
+	}
+	if len(values) == 0 {
+		return errors.New("no column to update")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if admin, ok := values["admin"]; ok && admin == false {
+			// lock all admins to count them without race
+			admins := []User{}
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Select("name").Where("admin = ?", true).Find(&admins).Error; err != nil {
+				log.Print(err)
+				return errors.New("failed to fetch admins")
+			}
+			isAdmin := false
+			for _, a := range admins {
+				if a.Name == name {
+					isAdmin = true
+				}
+			}
+			if isAdmin && len(admins) <= 1 {
+				return errors.New("cannot remove the last admin")
+			}
+		}
+		result := tx.Model(&User{}).Where("name = ?", name).Updates(values)
+		if err := result.Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to update user")
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("User not found")
+		}
+		return nil
+	})
+}
+
+// registerJudge registers the judge, and returns the registration time
+func registerJudge(db *gorm.DB, name string) (time.Time, error) {
+	// the precision of postgres timestamps
+	now := time.Now().Truncate(time.Microsecond)
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"registered_at": now}),
+	}).Create(&Judge{
+		Name:         name,
+		RegisteredAt: sql.NullTime{Time: now, Valid: true},
+		LastSeen:     now,
+	}).Error; err != nil {
 		log.Print(err)
-		return errors.New("failed to update user")
+		return time.Time{}, errors.New("failed to register judge")
+	}
+	return now, nil
+}
+
+// unregisterJudge cancels the registration of the judge, its tokens issued by RegisterJudge are revoked
+func unregisterJudge(db *gorm.DB, name string) error {
+	result := db.Model(&Judge{}).Where("name = ? and registered_at is not null", name).Update("registered_at", nil)
+	if result.Error != nil {
+		log.Print(result.Error)
+		return errors.New("failed to unregister judge")
 	}
 	if result.RowsAffected == 0 {
-		return errors.New("User not found")
+		return errors.New("judge not found")
+	}
+	return nil
+}
+
+// fetchJudge returns the judge registered by RegisterJudge
+func fetchJudge(db *gorm.DB, name string) (Judge, error) {
+	judge := Judge{}
+	if err := db.Where("name = ? and registered_at is not null", name).Take(&judge).Error; err != nil {
+		return Judge{}, errors.New("judge not found")
+	}
+	return judge, nil
+}
+
+// judgeLastSeenInterval is the precision of last_seen, not to write the row of the judge on each poll
+const judgeLastSeenInterval = 30 * time.Second
+
+// touchJudge updates last_seen of the judge if it is older than judgeLastSeenInterval, and adds processed to its processed_count
+func touchJudge(db *gorm.DB, name string, processed int64) error {
+	now := time.Now()
+	if err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "name"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"last_seen":       now,
+			"processed_count": gorm.Expr("judges.processed_count + ?", processed),
+		}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			gorm.Expr("judges.last_seen < ? or ? <> 0", now.Add(-judgeLastSeenInterval), processed),
+		}},
+	}).Create(&Judge{
+		Name:           name,
+		LastSeen:       now,
+		ProcessedCount: processed,
+	}).Error; err != nil {
+		log.Print(err)
+		return errors.New("failed to update judge")
 	}
 	return nil
 }
 
+func fetchJudges(db *gorm.DB) ([]Judge, error) {
+	var judges = make([]Judge, 0)
+	if err := db.Order("name asc").Find(&judges).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch judges")
+	}
+	return judges, nil
+}
+
+// countActiveJudges returns # of judges which have popped tasks since the given time
+func countActiveJudges(db *gorm.DB, since time.Time) (int64, error) {
+	var count int64
+	if err := db.Model(&Judge{}).Where("last_seen >= ?", since).Count(&count).Error; err != nil {
+		log.Print(err)
+		return 0, errors.New("failed to count judges")
+	}
+	return count, nil
+}
+
+// errMetadataNotFound is returned by fetchMetadata when the key is not set
+var errMetadataNotFound = errors.New("metadata not found")
+
 func fetchMetadata(db *gorm.DB, key string) (string, error) {
 	metadata := Metadata{}
 	if key == "" {
 		return "", errors.New("key is empty")
 	}
-	if err := db.Where("key = ?", key).Take(&metadata).Error; err != nil {
-		return "", errors.New("metadata not found")
+	err := db.Where("key = ?", key).Take(&metadata).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", errMetadataNotFound
+	}
+	if err != nil {
+		log.Print(err)
+		return "", errors.New("failed to fetch metadata")
 	}
 	return metadata.Value, nil
 
@@ -153,16 +341,24 @@ func setMetadata(db *gorm.DB, key string, value string) error {
 	return nil
 }
 
+// errSubmissionNotFound is returned when the requested submission does not exist
+var errSubmissionNotFound = status.Error(codes.NotFound, "submission not found")
+
 func fetchSubmission(db *gorm.DB, id int32) (Submission, error) {
 	sub := Submission{}
-	if err := db.
+	err := db.
 		Preload("User", func(db *gorm.DB) *gorm.DB {
 			return db.Select("name")
 		}).
 		Preload("Problem", func(db *gorm.DB) *gorm.DB {
-			return db.Select("name, title, testhash")
+			return db.Select("name, title, testhash, case_count")
 		}).
-		Where("id = ?", id).First(&sub).Error; err != nil {
+		Where("id = ?", id).First(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Submission{}, errSubmissionNotFound
+	}
+	if err != nil {
+		log.Print(err)
 		return Submission{}, errors.New("Submission fetch failed")
 	}
 	return sub, nil
@@ -178,7 +374,7 @@ func fetchUserStatistics(db *gorm.DB, userName string) (map[string]pb.SolvedStat
 		Model(&Submission{}).
 		Joins("left join problems on submissions.problem_name = problems.name").
 		Select("problem_name, bool_or(submissions.testhash=problems.testhash) as latest_ac").
-		Where("status = 'AC' and user_name = ?", userName).
+		Where("status = 'AC' and user_name = ? and not staging", userName).
 		Group("problem_name").
 		Find(&results).Error; err != nil {
 		log.Print(err)
@@ -195,21 +391,379 @@ func fetchUserStatistics(db *gorm.DB, userName string) (map[string]pb.SolvedStat
 	return stats, nil
 }
 
+// fetchLatestSourceHash returns the source hash of the latest submission of user to problem after since ("" if not exists)
+func fetchLatestSourceHash(db *gorm.DB, userName, problemName string, since time.Time) (string, error) {
+	sub := Submission{}
+	err := db.
+		Select("id, source_hash").
+		Where("user_name = ? and problem_name = ? and submit_time > ?", userName, problemName, since).
+		Order("id desc").
+		Take(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		log.Print(err)
+		return "", errors.New("failed to fetch latest submission")
+	}
+	return sub.SourceHash, nil
+}
+
+// fetchStaleSubmissionIDs returns the finished submissions whose testhash differs from the current testhash of the problem
+func fetchStaleSubmissionIDs(db *gorm.DB, problemName string) ([]int32, error) {
+	query := db.Model(&Submission{}).
+		Joins("join problems on problems.name = submissions.problem_name").
+		Where("submissions.testhash <> problems.testhash and submissions.judge_name = '' and submissions.status <> ? and not submissions.staging", draftStatus)
+	if problemName != "" {
+		query = query.Where("submissions.problem_name = ?", problemName)
+	}
+	ids := make([]int32, 0)
+	if err := query.Order("submissions.id asc").Pluck("submissions.id", &ids).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch stale submissions")
+	}
+	return ids, nil
+}
+
+// countPendingSubmissions returns the number of submissions of the problem which are waiting for or in judging
+func countPendingSubmissions(db *gorm.DB, problemName string) (int64, error) {
+	count := int64(0)
+	if err := db.Model(&Submission{}).
+		Where("problem_name = ? and status in ? and dead_letter_time is null", problemName, pendingStatuses).
+		Count(&count).Error; err != nil {
+		log.Print(err)
+		return 0, errors.New("failed to count pending submissions")
+	}
+	return count, nil
+}
+
+// fetchStagingTesthash returns the staging testhash which the submission is judged against, or "" if it is judged against the current testhash
+func fetchStagingTesthash(db *gorm.DB, id int32) (string, error) {
+	testhashes := make([]string, 0)
+	if err := db.Model(&Submission{}).
+		Joins("join problems on problems.name = submissions.problem_name").
+		Where("submissions.id = ? and submissions.staging", id).
+		Pluck("problems.staging_testhash", &testhashes).Error; err != nil {
+		log.Print(err)
+		return "", errors.New("failed to fetch staging testhash")
+	}
+	if len(testhashes) == 0 {
+		return "", nil
+	}
+	return testhashes[0], nil
+}
+
+// promoteStagingTestdata makes the staging testhash of the problem current, and returns it
+func promoteStagingTestdata(db *gorm.DB, problemName string) (string, error) {
+	problem := Problem{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("name, staging_testhash, staging_case_count").
+			Where("name = ?", problemName).Take(&problem).Error; err != nil {
+			log.Print(err)
+			return errors.New("unknown problem")
+		}
+		if problem.StagingTesthash == "" {
+			return errors.New("no staging testdata")
+		}
+		if err := tx.Model(&Problem{}).Where("name = ?", problemName).Updates(map[string]interface{}{
+			"testhash":           problem.StagingTesthash,
+			"case_count":         problem.StagingCaseCount,
+			"staging_testhash":   "",
+			"staging_case_count": 0,
+		}).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to promote staging testdata")
+		}
+		// the submissions judged against the promoted testhash are up to date, the others are stale and will be rejudged
+		if err := tx.Model(&Submission{}).Where("problem_name = ? and staging", problemName).Updates(map[string]interface{}{
+			"staging":      false,
+			"testhash":     gorm.Expr("case when staging_hash = ? then staging_hash else testhash end", problem.StagingTesthash),
+			"staging_hash": "",
+		}).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to update staging submissions")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return problem.StagingTesthash, nil
+}
+
+// clearStagingTestdata discards the staging testhash of the problem without promoting it
+func clearStagingTestdata(db *gorm.DB, problemName string) error {
+	result := db.Model(&Problem{}).Where("name = ? and staging_testhash <> ''", problemName).Updates(map[string]interface{}{
+		"staging_testhash":   "",
+		"staging_case_count": 0,
+	})
+	if result.Error != nil {
+		log.Print(result.Error)
+		return errors.New("failed to clear staging testdata")
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("no staging testdata")
+	}
+	return nil
+}
+
+// escapeLike escapes the special characters of LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// searchSubmissionSource returns the latest submissions whose source contains query
+func searchSubmissionSource(db *gorm.DB, query, problemName, lang string, limit int) ([]Submission, error) {
+	var subs = make([]Submission, 0)
+	tx := db.
+		Preload("User", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name")
+		}).
+		Preload("Problem", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name, title, testhash")
+		}).
+		Select("id, user_name, problem_name, lang, status, hacked, testhash, max_time, max_memory").
+		Where("source ilike ?", "%"+escapeLike(query)+"%")
+	if problemName != "" {
+		tx = tx.Where("problem_name = ?", problemName)
+	}
+	if lang != "" {
+		tx = tx.Where("lang = ?", lang)
+	}
+	if err := tx.Order("id desc").Limit(limit).Find(&subs).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to search submissions")
+	}
+	return subs, nil
+}
+
+// quotaResetTime returns the time when the daily submission quota at now is reset
+func quotaResetTime(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// consumeSubmissionQuota increments the # of submissions of the user today and returns it,
+// or returns false if it already reaches quota
+func consumeSubmissionQuota(db *gorm.DB, userName string, now time.Time, quota int) (int, bool, error) {
+	day := quotaResetTime(now).AddDate(0, 0, -1).Format("2006-01-02")
+	if err := db.Where("user_name = ? and day < ?", userName, day).Delete(&SubmissionQuota{}).Error; err != nil {
+		log.Print(err)
+		return 0, false, errors.New("failed to update quota")
+	}
+	var counts []int
+	if err := db.Raw(`insert into submission_quotas (user_name, day, count) values (?, ?, 1)
+		on conflict (user_name, day) do update set count = submission_quotas.count + 1
+		where submission_quotas.count < ?
+		returning count`, userName, day, quota).Scan(&counts).Error; err != nil {
+		log.Print(err)
+		return 0, false, errors.New("failed to update quota")
+	}
+	if len(counts) == 0 {
+		return 0, false, nil
+	}
+	return counts[0], true, nil
+}
+
+// fetchPreviousSubmission returns the submission (id and source) just before id by the user to the problem, or nil if not exists
+func fetchPreviousSubmission(db *gorm.DB, userName, problemName string, id int32) (*Submission, error) {
+	sub := Submission{}
+	err := db.
+		Select("id, source").
+		Where("user_name = ? and problem_name = ? and id < ?", userName, problemName, id).
+		Order("id desc").
+		Take(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch previous submission")
+	}
+	return &sub, nil
+}
+
+// fetchBestSubmission returns the best finished submission of the user to the problem, or nil if there is no such submission.
+// AC is preferred, then shorter time, then smaller memory, then older submission.
+func fetchBestSubmission(db *gorm.DB, userName, problemName string) (*Submission, error) {
+	sub := Submission{}
+	err := db.
+		Preload("User", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name")
+		}).
+		Preload("Problem", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name, title, testhash")
+		}).
+		Select("id, user_name, problem_name, lang, status, hacked, testhash, max_time, max_memory").
+		Where("user_name = ? and problem_name = ? and status in ? and not staging", userName, problemName, verdictStatuses).
+		Order("status = 'AC' desc, max_time < 0 asc, max_time asc, max_memory asc, id asc").
+		Take(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch best submission")
+	}
+	return &sub, nil
+}
+
+// fetchSolvedCounts returns # of solved problems for each user
+func fetchSolvedCounts(db *gorm.DB, userNames []string) (map[string]int32, error) {
+	type Result struct {
+		UserName    string
+		SolvedCount int32
+	}
+	var results = make([]Result, 0)
+	if err := db.
+		Model(&Submission{}).
+		Select("user_name, count(distinct problem_name) as solved_count").
+		Where("status = 'AC' and user_name in ? and not staging", userNames).
+		Group("user_name").
+		Find(&results).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed sql query")
+	}
+	counts := make(map[string]int32)
+	for _, result := range results {
+		counts[result.UserName] = result.SolvedCount
+	}
+	return counts, nil
+}
+
+// fetchHacksFound returns # of the submissions of other users hacked by the rejudge of userName
+func fetchHacksFound(db *gorm.DB, userName string) (int32, error) {
+	count := int64(0)
+	if err := db.
+		Model(&Submission{}).
+		Where("hacked and hacked_by = ? and (user_name is null or user_name <> ?)", userName, userName).
+		Count(&count).Error; err != nil {
+		log.Print(err)
+		return 0, errors.New("failed sql query")
+	}
+	return int32(count), nil
+}
+
+type SolveEvent struct {
+	ProblemName string
+	FirstACTime sql.NullTime
+}
+
+// fetchSolveTimeline returns the submit time of the first AC submission for each problem
+func fetchSolveTimeline(db *gorm.DB, userName string) ([]SolveEvent, error) {
+	var events = make([]SolveEvent, 0)
+	if err := db.
+		Model(&Submission{}).
+		Select("problem_name, min(submit_time) as first_ac_time").
+		Where("status = 'AC' and user_name = ? and not staging", userName).
+		Group("problem_name").
+		Order("first_ac_time asc nulls first, problem_name asc").
+		Find(&events).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed sql query")
+	}
+	return events, nil
+}
+
+// markRejudged records that userName rejudges the submission now, unless it was rejudged within cooldown
+func markRejudged(db *gorm.DB, id int32, cooldown time.Duration, userName string) (bool, error) {
+	now := time.Now()
+	result := db.Model(&Submission{}).Where("id = ?", id)
+	if cooldown > 0 {
+		result = result.Where("rejudge_time is null or rejudge_time <= ?", now.Add(-cooldown))
+	}
+	result = result.Updates(map[string]interface{}{
+		"rejudge_time": now,
+		"rejudged_by":  userName,
+	})
+	if result.Error != nil {
+		log.Print(result.Error)
+		return false, errors.New("failed to update rejudge time")
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func hasSolved(db *gorm.DB, userName, problemName string) (bool, error) {
+	solved := false
+	if err := db.Raw(
+		"select exists(select 1 from submissions where user_name = ? and problem_name = ? and status = 'AC' and not staging)",
+		userName, problemName).Scan(&solved).Error; err != nil {
+		log.Print(err)
+		return false, errors.New("failed sql query")
+	}
+	return solved, nil
+}
+
+// hasAttempted returns whether the user submitted to the problem, except drafts
+func hasAttempted(db *gorm.DB, userName, problemName string) (bool, error) {
+	attempted := false
+	if err := db.Raw(
+		"select exists(select 1 from submissions where user_name = ? and problem_name = ? and status <> ?)",
+		userName, problemName, draftStatus).Scan(&attempted).Error; err != nil {
+		log.Print(err)
+		return false, errors.New("failed sql query")
+	}
+	return attempted, nil
+}
+
+// pushTask inserts task into the queue. If the submission already has a pending task, it is replaced by task.
 func pushTask(db *gorm.DB, task Task) error {
 	log.Print("Insert task:", task)
-	if err := db.Create(&task).Error; err != nil {
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "submission"}},
+		DoUpdates: clause.AssignmentColumns([]string{"priority", "available", "attempts"}),
+	}).Create(&task).Error; err != nil {
 		log.Print(err)
 		return errors.New("cannot insert into queue")
 	}
 	return nil
 }
 
-func popTask(db *gorm.DB) (Task, error) {
+// fairTaskRanking ranks the available tasks within each user, for round robin between users
+const fairTaskRanking = `join (
+	select tasks.id as ranked_id, row_number() over (
+		partition by submissions.user_name order by tasks.priority desc, tasks.id) as user_rank
+	from tasks join submissions on submissions.id = tasks.submission
+	where tasks.available <= ?
+) as ranked on ranked.ranked_id = tasks.id`
+
+// userInFlightLimit matches the tasks whose user (not admin) already has at least ? submissions in judging.
+// All anonymous submissions share a limit, as if they were submitted by one user.
+// The submission of the task itself is not counted, it is in judging if the lease of the previous judge expires.
+const userInFlightLimit = `exists (
+	select 1 from submissions s left join users u on u.name = s.user_name
+	where s.id = tasks.submission and not coalesce(u.admin, false) and (
+		select count(*) from submissions f
+		where f.user_name is not distinct from s.user_name and f.id <> s.id and f.judge_name <> '' and f.judge_name <> ? and f.judge_ping > ?
+	) >= ?
+)`
+
+// popTask pops the available task with the highest priority. If fair, tasks of the same priority are interleaved across users.
+// If maxInFlight > 0, tasks of the users who already have maxInFlight submissions in judging are skipped
+// (admins are exempt, anonymous submissions are limited together).
+// It is a soft limit, concurrent calls may exceed it slightly.
+// Tasks locked by other transactions are skipped, so concurrent calls never pop the same task.
+func popTask(db *gorm.DB, fair bool, maxInFlight int) (Task, error) {
 	task := Task{}
 	task.Submission = -1
 
 	err := db.Transaction(func(tx *gorm.DB) error {
-		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("available <= ?", time.Now()).Order("priority desc").First(&task).Error
+		now := time.Now()
+		query := tx.Clauses(clause.Locking{
+			Strength: "UPDATE",
+			Table:    clause.Table{Name: "tasks"},
+			Options:  "SKIP LOCKED",
+		}).Select("tasks.*").Where("tasks.available <= ?", now)
+		if maxInFlight > 0 {
+			query = query.Where("not "+userInFlightLimit, waitingJudgeName, now, maxInFlight)
+		}
+		if fair {
+			query = query.Joins(fairTaskRanking, now).Order("tasks.priority desc, ranked.user_rank, tasks.id")
+		} else {
+			query = query.Order("tasks.priority desc, tasks.id")
+		}
+		err := query.Take(&task).Error
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil
 		}
@@ -226,17 +780,84 @@ func popTask(db *gorm.DB) (Task, error) {
 	return task, err
 }
 
+// dedupTasks removes the duplicated tasks of the same submission except the latest one, to create the unique index
+func dedupTasks(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&Task{}) || db.Migrator().HasIndex(&Task{}, "Submission") {
+		return nil
+	}
+	return db.Exec("delete from tasks a using tasks b where a.submission = b.submission and a.id < b.id").Error
+}
+
+// sourceHashFilledKey is the metadata key which is set after fillSourceHash is done
+const sourceHashFilledKey = "source_hash_filled"
+
+// fillSourceHash computes SourceHash of the submissions created before the column is added.
+// It scans all submissions, so it runs only once and later calls do nothing.
+func fillSourceHash(db *gorm.DB) error {
+	_, err := fetchMetadata(db, sourceHashFilledKey)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, errMetadataNotFound) {
+		return err
+	}
+	if err := db.Exec("update submissions set source_hash = encode(sha256(convert_to(source, 'UTF8')), 'hex') where source_hash = ''").Error; err != nil {
+		log.Print(err)
+		return errors.New("failed to fill source hash")
+	}
+	return setMetadata(db, sourceHashFilledKey, "true")
+}
+
+// fetchQueuePosition returns # of available tasks which will be popped before the task of the submission, or -1 if it has no task.
+// The order of FairScheduling is not considered.
+func fetchQueuePosition(db *gorm.DB, id int32) (int64, error) {
+	task := Task{}
+	err := db.Where("submission = ?", id).Take(&task).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return -1, nil
+	}
+	if err != nil {
+		log.Print(err)
+		return 0, errors.New("failed to fetch task")
+	}
+	var count int64
+	if err := db.Model(&Task{}).
+		Where("available <= ?", time.Now()).
+		Where("priority > ? or (priority = ? and id < ?)", task.Priority, task.Priority, task.ID).
+		Count(&count).Error; err != nil {
+		log.Print(err)
+		return 0, errors.New("failed to count tasks")
+	}
+	return count, nil
+}
+
 func dbConnect(host, port, dbname, user, pass string, enableLogger bool) *gorm.DB {
+	return dbConnectWithPassword(host, port, dbname, user, func() string { return pass }, enableLogger)
+}
+
+// dbConnectWithPassword connects to db. password is called every time a new connection is opened,
+// so a rotated password is used by new connections while the existing ones keep running.
+func dbConnectWithPassword(host, port, dbname, user string, password func() string, enableLogger bool) *gorm.DB {
 	connStr := fmt.Sprintf(
-		"host=%s port=%s dbname=%s user=%s password=%s sslmode=disable",
-		host, port, dbname, user, pass)
+		"host=%s port=%s dbname=%s user=%s sslmode=disable",
+		host, port, dbname, user)
 	log.Printf("Try connect %s", connStr)
+	connConfig, err := pgx.ParseConfig(connStr)
+	if err != nil {
+		log.Fatal("failed to parse db config: ", err)
+	}
+	beforeConnect := stdlib.OptionBeforeConnect(func(ctx context.Context, config *pgx.ConnConfig) error {
+		config.Password = password()
+		return nil
+	})
 	for i := 0; i < 3; i++ {
 		config := gorm.Config{}
 		if enableLogger {
 			config.Logger = logger.Default.LogMode(logger.Info)
 		}
-		db, err := gorm.Open(postgres.Open(connStr), &config)
+		db, err := gorm.Open(postgres.New(postgres.Config{
+			Conn: stdlib.OpenDB(*connConfig, beforeConnect),
+		}), &config)
 		if err != nil {
 			log.Printf("Cannot connect db %d/3", i)
 			time.Sleep(5 * time.Second)
@@ -250,8 +871,17 @@ func dbConnect(host, port, dbname, user, pass string, enableLogger bool) *gorm.D
 		db.AutoMigrate(User{})
 		db.AutoMigrate(Submission{})
 		db.AutoMigrate(SubmissionTestcaseResult{})
+		if err := dedupTasks(db); err != nil {
+			log.Print(err)
+		}
 		db.AutoMigrate(Task{})
 		db.AutoMigrate(Metadata{})
+		if err := fillSourceHash(db); err != nil {
+			log.Print(err)
+		}
+		db.AutoMigrate(Judge{})
+		db.AutoMigrate(SubmissionQuota{})
+		db.AutoMigrate(Bookmark{})
 
 		sqlDB.SetMaxOpenConns(10)
 		sqlDB.SetConnMaxLifetime(time.Hour)
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	diffContext = 3
+	// diffMaxCells is the maximum size of the LCS table, to bound the time and memory (4MB) of unifiedDiff.
+	// Any user can diff their own submissions, so it is only enough for about 1000 changed lines of each source.
+	diffMaxCells = 1000 * 1000
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	a, b int  // positions in the old and new lines when this op starts
+	line string
+}
+
+func splitLines(source string) []string {
+	if source == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(source, "\n"), "\n")
+}
+
+// diffLines returns the ops which convert a into b, using the longest common subsequence of lines
+func diffLines(a, b []string) ([]diffOp, error) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(ma)+1)*(len(mb)+1) > diffMaxCells {
+		return nil, errors.New("sources are too large to diff")
+	}
+
+	// lcs[i][j] = LCS of ma[i:] and mb[j:]
+	lcs := make([][]int32, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{' ', i, i, a[i]})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, diffOp{' ', prefix + i, prefix + j, ma[i]})
+			i++
+			j++
+		case j == len(mb) || (i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', prefix + i, prefix + j, ma[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', prefix + i, prefix + j, mb[j]})
+			j++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		ops = append(ops, diffOp{' ', len(a) - suffix + k, len(b) - suffix + k, a[len(a)-suffix+k]})
+	}
+	return ops, nil
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// unifiedDiff returns the unified diff from a to b, or "" if they are the same
+func unifiedDiff(a, b, nameA, nameB string) (string, error) {
+	ops, err := diffLines(splitLines(a), splitLines(b))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		last := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			} else if j-last > 2*diffContext {
+				break
+			}
+		}
+		stop := last + diffContext + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		lenA, lenB := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				lenA++
+			}
+			if op.kind != '-' {
+				lenB++
+			}
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(ops[start].a, lenA), hunkRange(ops[start].b, lenB))
+		for _, op := range ops[start:stop] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+		i = stop
+	}
+	return sb.String(), nil
+}
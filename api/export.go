@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	pb "github.com/yosupo06/library-checker-judge/api/proto"
+)
+
+// exportBatchSize is the number of submissions in a message of ExportSubmissions
+const exportBatchSize = 100
+
+// exportRecord is a line of ExportSubmissions
+type exportRecord struct {
+	ID         int32  `json:"id"`
+	Problem    string `json:"problem"`
+	User       string `json:"user"`
+	Lang       string `json:"lang"`
+	Status     string `json:"status"`
+	Hacked     bool   `json:"hacked"`
+	Testhash   string `json:"testhash"`
+	MaxTime    int32  `json:"max_time"`
+	MaxMemory  int64  `json:"max_memory"`
+	SubmitTime string `json:"submit_time"`
+	Source     string `json:"source,omitempty"`
+}
+
+// pseudonymizeUser returns a stable pseudonym of the user, which cannot be reversed without the key
+func pseudonymizeUser(key []byte, name string) string {
+	if name == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, append([]byte("export:"), key...))
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (s *server) ExportSubmissions(in *pb.ExportSubmissionsRequest, stream pb.LibraryCheckerService_ExportSubmissionsServer) error {
+	if err := s.checkFeature("export_submissions"); err != nil {
+		return err
+	}
+	currentUserName := getCurrentUserName(stream.Context())
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return permissionError(currentUser)
+	}
+	filter := in.Filter
+	if filter == nil {
+		filter = &pb.SubmissionListRequest{}
+	}
+	if err := validateSubmissionListFilter(filter); err != nil {
+		return err
+	}
+	columns := "id, user_name, problem_name, lang, status, hacked, testhash, max_time, max_memory, submit_time"
+	if in.IncludeSource {
+		columns += ", source"
+	}
+
+	lastID := int32(0)
+	for {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		submissions := make([]Submission, 0)
+		if err := submissionListQuery(s.db, filter).
+			Where("id > ? and status <> ?", lastID, draftStatus).
+			Select(columns).
+			Order("id asc").
+			Limit(exportBatchSize).
+			Find(&submissions).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to fetch submissions")
+		}
+		if len(submissions) == 0 {
+			return nil
+		}
+		records, err := s.exportRecords(submissions, in.IncludeUserName)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.ExportSubmissionsResponse{
+			Records: records,
+		}); err != nil {
+			return err
+		}
+		lastID = submissions[len(submissions)-1].ID
+	}
+}
+
+// exportRecords encodes submissions to JSONL
+func (s *server) exportRecords(submissions []Submission, includeUserName bool) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	for _, sub := range submissions {
+		user := sub.UserName.String
+		if !includeUserName {
+			user = pseudonymizeUser(s.authTokenManager.hmacKey, user)
+		}
+		if err := encoder.Encode(exportRecord{
+			ID:         sub.ID,
+			Problem:    sub.ProblemName,
+			User:       user,
+			Lang:       sub.Lang,
+			Status:     sub.Status,
+			Hacked:     sub.Hacked,
+			Testhash:   sub.Testhash,
+			MaxTime:    sub.MaxTime,
+			MaxMemory:  sub.MaxMemory,
+			SubmitTime: sub.SubmitTime.UTC().Format(time.RFC3339),
+			Source:     sub.Source,
+		}); err != nil {
+			log.Print(err)
+			return nil, errors.New("failed to encode submissions")
+		}
+	}
+	return buf.Bytes(), nil
+}
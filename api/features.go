@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/yosupo06/library-checker-judge/api/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const featureFlagsKey = "feature_flags"
+
+// feature flags which can be turned on and off at runtime, and whether they are enabled by default
+var defaultFeatureFlags = map[string]bool{
+	"bookmark":           true,
+	"submission_diff":    true,
+	"export_submissions": true,
+}
+
+// fetchFeatureFlagOverrides returns the flags changed by ChangeFeatureFlags, they are shared between all servers via metadata
+func fetchFeatureFlagOverrides(db *gorm.DB) (map[string]bool, error) {
+	overrides := make(map[string]bool)
+	data, err := fetchMetadata(db, featureFlagsKey)
+	if errors.Is(err, errMetadataNotFound) {
+		// not changed
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(data), &overrides); err != nil {
+		log.Print(err)
+		return nil, errors.New("broken feature flags metadata")
+	}
+	return overrides, nil
+}
+
+// featureFlagsCacheTTL is how long each server caches the feature flags, ChangeFeatureFlags takes effect on the other servers after it
+const featureFlagsCacheTTL = 5 * time.Second
+
+type featureFlagsCache struct {
+	mu        sync.Mutex
+	fetchedAt time.Time
+	overrides map[string]bool
+}
+
+// cachedFeatureFlagOverrides returns fetchFeatureFlagOverrides cached for featureFlagsCacheTTL
+func (s *server) cachedFeatureFlagOverrides() (map[string]bool, error) {
+	s.featureCache.mu.Lock()
+	defer s.featureCache.mu.Unlock()
+	if time.Since(s.featureCache.fetchedAt) < featureFlagsCacheTTL {
+		return s.featureCache.overrides, nil
+	}
+	overrides, err := fetchFeatureFlagOverrides(s.db)
+	if err != nil {
+		return nil, err
+	}
+	s.featureCache.fetchedAt = time.Now()
+	s.featureCache.overrides = overrides
+	return overrides, nil
+}
+
+// featureFlags returns whether each feature is enabled. ServerConfig.DisabledFeatures forces them disabled.
+// If the flags cannot be fetched, it returns an error instead of the defaults, not to enable the disabled features.
+func (s *server) featureFlags() (map[string]bool, error) {
+	overrides, err := s.cachedFeatureFlagOverrides()
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[string]bool)
+	for name, enabled := range defaultFeatureFlags {
+		if override, ok := overrides[name]; ok {
+			enabled = override
+		}
+		flags[name] = enabled
+	}
+	for _, name := range s.config.DisabledFeatures {
+		flags[name] = false
+	}
+	return flags, nil
+}
+
+// checkFeature returns Unimplemented error if the feature is disabled
+func (s *server) checkFeature(name string) error {
+	flags, err := s.featureFlags()
+	if err != nil {
+		return err
+	}
+	if !flags[name] {
+		return status.Errorf(codes.Unimplemented, "%v is disabled on this server", name)
+	}
+	return nil
+}
+
+func (s *server) Features(ctx context.Context, in *pb.FeaturesRequest) (*pb.FeaturesResponse, error) {
+	flags, err := s.featureFlags()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.FeaturesResponse{
+		Flags: flags,
+	}, nil
+}
+
+func (s *server) ChangeFeatureFlags(ctx context.Context, in *pb.ChangeFeatureFlagsRequest) (*pb.ChangeFeatureFlagsResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	for name := range in.Flags {
+		if _, ok := defaultFeatureFlags[name]; !ok {
+			return nil, errors.New("unknown feature: " + name)
+		}
+	}
+	for _, name := range in.Reset_ {
+		if _, ok := defaultFeatureFlags[name]; !ok {
+			return nil, errors.New("unknown feature: " + name)
+		}
+	}
+	// read-modify-write under the row lock, not to lose the concurrent changes of other flags
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Metadata{
+			Key:   featureFlagsKey,
+			Value: "{}",
+		}).Error; err != nil {
+			log.Print(err)
+			return errors.New("metadata insert failed")
+		}
+		overrides, err := fetchFeatureFlagOverrides(tx.Clauses(clause.Locking{Strength: "UPDATE"}))
+		if err != nil {
+			return err
+		}
+		for name, enabled := range in.Flags {
+			overrides[name] = enabled
+		}
+		for _, name := range in.Reset_ {
+			delete(overrides, name)
+		}
+		data, err := json.Marshal(overrides)
+		if err != nil {
+			return err
+		}
+		return setMetadata(tx, featureFlagsKey, string(data))
+	}); err != nil {
+		return nil, err
+	}
+	// takes effect on this server immediately
+	s.featureCache.mu.Lock()
+	s.featureCache.fetchedAt = time.Time{}
+	s.featureCache.mu.Unlock()
+	return &pb.ChangeFeatureFlagsResponse{}, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// httpGuard protects the extra HTTP endpoints of the gRPC-web server (e.g. /metrics).
+// A request is allowed if it has the bearer token or comes from the allowlist. If neither is configured, every request is allowed.
+type httpGuard struct {
+	token     []byte
+	allowlist []*net.IPNet
+	// header set by the trusted proxy to get the client IP address (empty: use the remote address)
+	ipHeader string
+}
+
+// parseIPAllowlist parses IP addresses and CIDRs, e.g. "10.0.0.0/8" and "127.0.0.1"
+func parseIPAllowlist(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %v", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%v/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %v", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func newHTTPGuard(token string, allowlist []string, ipHeader string) (*httpGuard, error) {
+	nets, err := parseIPAllowlist(allowlist)
+	if err != nil {
+		return nil, err
+	}
+	return &httpGuard{
+		token:     []byte(token),
+		allowlist: nets,
+		ipHeader:  ipHeader,
+	}, nil
+}
+
+// httpClientIP is the HTTP version of clientIP
+func httpClientIP(req *http.Request, header string) string {
+	if header != "" {
+		if values := req.Header.Values(header); len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (g *httpGuard) allow(req *http.Request) bool {
+	if len(g.token) == 0 && len(g.allowlist) == 0 {
+		return true
+	}
+	if len(g.token) != 0 {
+		if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); subtle.ConstantTimeCompare([]byte(token), g.token) == 1 {
+			return true
+		}
+	}
+	if ip := net.ParseIP(httpClientIP(req, g.ipHeader)); ip != nil {
+		for _, ipNet := range g.allowlist {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g *httpGuard) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !g.allow(req) {
+			if len(g.token) != 0 {
+				resp.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(resp, "unauthorized", http.StatusUnauthorized)
+			} else {
+				http.Error(resp, "forbidden", http.StatusForbidden)
+			}
+			return
+		}
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// newOriginFunc returns whether the origin can call gRPC-web, any origin is allowed if origins is empty
+func newOriginFunc(origins []string) func(origin string) bool {
+	allowed := make(map[string]bool)
+	for _, origin := range origins {
+		allowed[strings.TrimSuffix(strings.TrimSpace(origin), "/")] = true
+	}
+	return func(origin string) bool {
+		return len(allowed) == 0 || allowed[origin]
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 
@@ -55,7 +57,19 @@ func currentRegistrationStatus(sub *Submission, judgeName string) RegistrationSt
 	return Finished
 }
 
-func changeRegistrationStatus(db *gorm.DB, id int32, judgeName string, updateJudgeName string, expiration time.Duration, expect RegistrationStatus) error {
+// errStaleJudgeTask is returned if the judge task is not the latest claim of the submission, e.g. the lease expired and it was claimed again
+var errStaleJudgeTask = errors.New("stale judge task, the submission is claimed again")
+
+// checkJudgeTask checks that taskID is the latest claim of the submission (taskID = 0: not checked, see checkJudgeTaskID)
+func checkJudgeTask(sub *Submission, taskID int32) error {
+	if taskID != 0 && sub.JudgeTaskID != taskID {
+		log.Printf("Stale judge task of %v: expect %v, actual %v", sub.ID, sub.JudgeTaskID, taskID)
+		return errStaleJudgeTask
+	}
+	return nil
+}
+
+func changeRegistrationStatus(db *gorm.DB, id int32, judgeName string, updateJudgeName string, expiration time.Duration, expect RegistrationStatus, taskID int32) error {
 	return db.Transaction(func(tx *gorm.DB) error {
 		sub := &Submission{}
 		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(sub, id).Error; err != nil {
@@ -69,6 +83,9 @@ func changeRegistrationStatus(db *gorm.DB, id int32, judgeName string, updateJud
 			log.Printf("Expect(%v) != Actual(%v)", expect, status)
 			return errors.New("actual status does not matched to expected status")
 		}
+		if err := checkJudgeTask(sub, taskID); err != nil {
+			return err
+		}
 
 		if err := tx.Model(&sub).Updates(map[string]interface{}{
 			"judge_name": updateJudgeName,
@@ -82,19 +99,34 @@ func changeRegistrationStatus(db *gorm.DB, id int32, judgeName string, updateJud
 }
 
 func registerSubmission(db *gorm.DB, id int32, judgeName string, expiration time.Duration, expect RegistrationStatus) error {
-	return changeRegistrationStatus(db, id, judgeName, judgeName, expiration, expect)
+	return changeRegistrationStatus(db, id, judgeName, judgeName, expiration, expect, 0)
 }
 
-func updateSubmissionRegistration(db *gorm.DB, id int32, judgeName string, expiration time.Duration) error {
-	return changeRegistrationStatus(db, id, judgeName, judgeName, expiration, JudgingBySelf)
+func updateSubmissionRegistration(db *gorm.DB, id int32, judgeName string, expiration time.Duration, taskID int32) error {
+	return changeRegistrationStatus(db, id, judgeName, judgeName, expiration, JudgingBySelf, taskID)
 }
 
-func releaseSubmissionRegistration(db *gorm.DB, id int32, judgeName string) error {
-	return changeRegistrationStatus(db, id, judgeName, "", -time.Second, JudgingBySelf)
+// fetchInFlightSubmissions returns the submissions registered by judges, including ones whose registration has expired
+func fetchInFlightSubmissions(db *gorm.DB) ([]Submission, error) {
+	var subs = make([]Submission, 0)
+	if err := db.
+		Select("id, problem_name, status, judge_name, judge_ping").
+		Where("judge_name <> '' and judge_name <> ?", waitingJudgeName).
+		Order("judge_ping asc").
+		Find(&subs).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch in-flight submissions")
+	}
+	return subs, nil
 }
 
-func toWaitingJudge(db *gorm.DB, id int32, priority int32, after time.Duration) error {
-	if err := registerSubmission(db, id, "#WaitingJudge", -time.Second, Finished); err != nil {
+// waitingJudgeName is the dummy judge name of submissions in the queue
+const waitingJudgeName = "#WaitingJudge"
+
+// toWaitingJudge enqueues the submission. rejudgedBy is the user who requests this rejudge, and is credited if it hacks the submission
+// (empty: not a rejudge by a user, e.g. submit).
+func toWaitingJudge(db *gorm.DB, id int32, priority int32, after time.Duration, rejudgedBy string) error {
+	if err := registerSubmission(db, id, waitingJudgeName, -time.Second, Finished); err != nil {
 		return err
 	}
 
@@ -105,6 +137,9 @@ func toWaitingJudge(db *gorm.DB, id int32, priority int32, after time.Duration)
 	}
 	sub.PrevStatus = sub.Status
 	sub.Status = "WJ"
+	sub.RejudgedBy = rejudgedBy
+	sub.DeadLetterTime = sql.NullTime{}
+	sub.RetryCompile = false
 	if err := db.Save(sub).Error; err != nil {
 		log.Print(err)
 		return errors.New("failed to update status")
@@ -121,3 +156,112 @@ func toWaitingJudge(db *gorm.DB, id int32, priority int32, after time.Duration)
 
 	return nil
 }
+
+// resetSubmission forcibly releases the registration of a (maybe stuck) submission and re-enqueues it
+func resetSubmission(db *gorm.DB, id int32, priority int32) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		sub := &Submission{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(sub, id).Error; err != nil {
+			log.Print(err)
+			return errors.New("Submission fetch failed")
+		}
+
+		values := map[string]interface{}{
+			"status":           "WJ",
+			"judge_name":       waitingJudgeName,
+			"judge_ping":       time.Now().Add(-time.Second),
+			"dead_letter_time": nil,
+			"rejudged_by":      "",
+			"retry_compile":    false,
+		}
+		if sub.JudgeName == "" {
+			// not in judging, so the current status is the result of the last judge
+			values["prev_status"] = sub.Status
+		}
+		if err := tx.Model(sub).Updates(values).Error; err != nil {
+			log.Print(err)
+			return errors.New("Submission update failed")
+		}
+		if err := tx.Where("submission = ?", id).Delete(&SubmissionTestcaseResult{}).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to clear submission testcase results")
+		}
+		if err := tx.Where("submission = ?", id).Delete(&Task{}).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to clear tasks")
+		}
+		return pushTask(tx, Task{
+			Submission: id,
+			Available:  time.Now(),
+			Priority:   priority,
+		})
+	})
+}
+
+// deadLetterSubmission gives up judging the submission whose judges have died, and makes its status IE
+func deadLetterSubmission(db *gorm.DB, id int32, attempts int32) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		sub := &Submission{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(sub, id).Error; err != nil {
+			log.Print(err)
+			return errors.New("Submission fetch failed")
+		}
+		if status := currentRegistrationStatus(sub, ""); status != Waiting {
+			// finished, or another judge is still judging
+			return fmt.Errorf("submission %v is not waiting: %v", id, status)
+		}
+		log.Printf("DEAD LETTER: judges failed to judge submission %v %v times, give up", id, attempts)
+		if err := tx.Model(sub).Updates(map[string]interface{}{
+			"status":           "IE",
+			"judge_name":       "",
+			"judge_ping":       time.Now().Add(-time.Second),
+			"dead_letter_time": time.Now(),
+		}).Error; err != nil {
+			log.Print(err)
+			return errors.New("Submission update failed")
+		}
+		return nil
+	})
+}
+
+func fetchDeadLetterSubmissions(db *gorm.DB, limit int) ([]Submission, error) {
+	var subs = make([]Submission, 0)
+	if err := db.
+		Preload("User", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name")
+		}).
+		Preload("Problem", func(db *gorm.DB) *gorm.DB {
+			return db.Select("name, title, testhash")
+		}).
+		Select("id, user_name, problem_name, lang, status, hacked, testhash, max_time, max_memory").
+		Where("dead_letter_time is not null").
+		Order("dead_letter_time desc").
+		Limit(limit).
+		Find(&subs).Error; err != nil {
+		log.Print(err)
+		return nil, errors.New("failed to fetch dead letter submissions")
+	}
+	return subs, nil
+}
+
+// retryCompile re-enqueues the submission whose compile failed, with the flag to compile from scratch
+func retryCompile(db *gorm.DB, id int32, priority int32) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		sub := &Submission{}
+		if err := tx.Select("id, status").Take(sub, id).Error; err != nil {
+			log.Print(err)
+			return errors.New("Submission fetch failed")
+		}
+		if sub.Status != "CE" && sub.Status != "ICE" {
+			return fmt.Errorf("compile of submission %v did not fail: %v", id, sub.Status)
+		}
+		if err := toWaitingJudge(tx, id, priority, time.Duration(0), ""); err != nil {
+			return err
+		}
+		if err := tx.Model(&Submission{}).Where("id = ?", id).Update("retry_compile", true).Error; err != nil {
+			log.Print(err)
+			return errors.New("failed to update submission")
+		}
+		return nil
+	})
+}
@@ -1,33 +1,71 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"path/filepath"
 
 	"github.com/BurntSushi/toml"
 	pb "github.com/yosupo06/library-checker-judge/api/proto"
 )
 
-func ReadLangs(tomlPath string) []*pb.Lang {
+// ReadLangs reads and validates langs.toml
+func ReadLangs(tomlPath string) ([]*pb.Lang, error) {
 	var tomlData struct {
 		Langs []struct {
-			ID      string `toml:"id"`
-			Name    string `toml:"name"`
-			Version string `toml:"version"`
+			ID              string   `toml:"id"`
+			Name            string   `toml:"name"`
+			Version         string   `toml:"version"`
+			Source          string   `toml:"source"`
+			SourceExtension string   `toml:"source_extension"` // default: extension of source
+			CommentPrefix   string   `toml:"comment_prefix"`
+			Compile         []string `toml:"compile"`
+			Exec            []string `toml:"exec"`
+			Template        string   `toml:"template"` // starter source for the submit form (optional)
 		}
 	}
 	if _, err := toml.DecodeFile(tomlPath, &tomlData); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	var langs []*pb.Lang
-	for _, lang := range tomlData.Langs {
+	ids := make(map[string]bool)
+	for i, lang := range tomlData.Langs {
+		if lang.ID == "" {
+			return nil, fmt.Errorf("langs[%d]: id is empty", i)
+		}
+		if ids[lang.ID] {
+			return nil, fmt.Errorf("langs[%d]: duplicated id %s", i, lang.ID)
+		}
+		ids[lang.ID] = true
 		if lang.ID == "checker" {
 			continue
 		}
+		if lang.Name == "" {
+			return nil, fmt.Errorf("langs[%d](%s): name is empty", i, lang.ID)
+		}
+		if lang.Version == "" {
+			return nil, fmt.Errorf("langs[%d](%s): version is empty", i, lang.ID)
+		}
+		if lang.Source == "" {
+			return nil, fmt.Errorf("langs[%d](%s): source is empty", i, lang.ID)
+		}
+		ext := lang.SourceExtension
+		if ext == "" {
+			ext = filepath.Ext(lang.Source)
+		}
 		langs = append(langs, &pb.Lang{
-			Id:      lang.ID,
-			Name:    lang.Name,
-			Version: lang.Version,
+			Id:              lang.ID,
+			Name:            lang.Name,
+			Version:         lang.Version,
+			SourceExtension: ext,
+			CommentPrefix:   lang.CommentPrefix,
+			CompileCommand:  lang.Compile,
+			RunCommand:      lang.Exec,
+			Template:        lang.Template,
 		})
 	}
-	return langs
+	if len(langs) == 0 {
+		return nil, errors.New("no lang is defined")
+	}
+	return langs, nil
 }
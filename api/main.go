@@ -8,21 +8,25 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"runtime/debug"
 	"strconv"
+	"strings"
 
 	"github.com/improbable-eng/grpc-web/go/grpcweb"
 	pb "github.com/yosupo06/library-checker-judge/api/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	health "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	grpc_recovery "github.com/grpc-ecosystem/go-grpc-middleware/recovery"
 	_ "github.com/lib/pq"
 	"gorm.io/gorm"
-
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
 )
 
 func getEnv(key, defaultValue string) string {
@@ -67,96 +71,278 @@ type server struct {
 	db               *gorm.DB
 	langs            []*pb.Lang
 	authTokenManager AuthTokenManager
+	config           ServerConfig
+	recentCache      recentSubmissionsCache
+	statisticsCache  siteStatisticsCache
+	solversCache     problemSolversCache
+	langStatsCache   langStatisticsCache
+	anonymousLimiter *rateLimiter
+	watchLimiter     *concurrencyLimiter
+	maintenanceCache maintenanceCache
+	featureCache     featureFlagsCache
+	cases            caseStorage // nil if not configured
 }
 
-func NewGRPCServer(db *gorm.DB, authTokenManager AuthTokenManager, langsTomlPath string) *grpc.Server {
-	// launch gRPC server
-	s := grpc.NewServer(
-		grpc.UnaryInterceptor(grpc_auth.UnaryServerInterceptor(authTokenManager.authnFunc)))
-	pb.RegisterLibraryCheckerServiceServer(s, &server{
-		db:               db,
-		langs:            ReadLangs(langsTomlPath),
-		authTokenManager: authTokenManager,
-	})
-	return s
+// recoveryHandler converts a panic in a handler into an Internal error
+var recoveryHandler = grpc_recovery.WithRecoveryHandler(func(p interface{}) error {
+	log.Printf("panic: %v\n%s", p, debug.Stack())
+	return status.Error(codes.Internal, "internal error")
+})
+
+// newRecoveryInterceptor converts a panic in a handler into an Internal error
+func newRecoveryInterceptor() grpc.UnaryServerInterceptor {
+	return grpc_recovery.UnaryServerInterceptor(recoveryHandler)
 }
 
-func getSecureString(secureKey, defaultValue string) string {
-	if secureKey == "" {
-		if defaultValue == "" {
-			log.Fatal("both secureKey and defaultValue is empty")
-		}
-		return defaultValue
-	}
+const serviceName = "librarychecker.LibraryCheckerService"
 
-	// Create the client.
-	ctx := context.Background()
-	client, err := secretmanager.NewClient(ctx)
+// isServiceMethod returns whether method is a method of LibraryCheckerService, e.g. "PopJudgeTask"
+func isServiceMethod(method string) bool {
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(serviceName)
 	if err != nil {
-		log.Fatalf("failed to create secretmanager client: %v", err)
+		return false
 	}
-	defer client.Close()
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	return ok && service.Methods().ByName(protoreflect.Name(method)) != nil
+}
+
+// errInternalMethod is returned when internal methods are called on the public listener
+var errInternalMethod = status.Error(codes.PermissionDenied, "this method is not available on the public endpoint")
 
-	// Build the request.
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: secureKey,
+func internalMethodSet(internalMethods []string) map[string]bool {
+	internal := make(map[string]bool)
+	for _, method := range internalMethods {
+		internal["/"+serviceName+"/"+method] = true
 	}
+	return internal
+}
 
-	// Call the API.
-	result, err := client.AccessSecretVersion(ctx, req)
-	if err != nil {
-		log.Fatalf("failed to access secret version: %v", err)
+// newPublicInterceptor rejects internalMethods, for the listener exposed to the public
+func newPublicInterceptor(internalMethods []string) grpc.UnaryServerInterceptor {
+	internal := internalMethodSet(internalMethods)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if internal[info.FullMethod] {
+			return nil, errInternalMethod
+		}
+		return handler(ctx, req)
+	}
+}
+
+// newPublicStreamInterceptor is the stream version of newPublicInterceptor
+func newPublicStreamInterceptor(internalMethods []string) grpc.StreamServerInterceptor {
+	internal := internalMethodSet(internalMethods)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if internal[info.FullMethod] {
+			return errInternalMethod
+		}
+		return handler(srv, ss)
 	}
+}
 
-	return string(result.Payload.Data)
+func NewGRPCServer(db *gorm.DB, authTokenManager AuthTokenManager, langs []*pb.Lang, config ServerConfig, opts ...grpc.ServerOption) *grpc.Server {
+	// launch gRPC server
+	interceptors := []grpc.UnaryServerInterceptor{newRecoveryInterceptor()}
+	streamInterceptors := []grpc.StreamServerInterceptor{grpc_recovery.StreamServerInterceptor(recoveryHandler)}
+	if config.Public {
+		interceptors = append(interceptors, newPublicInterceptor(config.InternalMethods))
+		streamInterceptors = append(streamInterceptors, newPublicStreamInterceptor(config.InternalMethods))
+	}
+	interceptors = append(interceptors, grpc_auth.UnaryServerInterceptor(authTokenManager.authnFunc))
+	streamInterceptors = append(streamInterceptors, grpc_auth.StreamServerInterceptor(authTokenManager.authnFunc))
+	opts = append(opts, grpc.ChainUnaryInterceptor(interceptors...), grpc.ChainStreamInterceptor(streamInterceptors...))
+	s := grpc.NewServer(opts...)
+	cases, err := newCaseStorage(config)
+	if err != nil {
+		log.Fatal("failed to connect test case storage: ", err)
+	}
+	pb.RegisterLibraryCheckerServiceServer(s, &server{
+		db:               db,
+		langs:            langs,
+		authTokenManager: authTokenManager,
+		config:           config,
+		anonymousLimiter: newRateLimiter(config.AnonymousSubmissionLimit, config.AnonymousSubmissionWindow),
+		watchLimiter:     newConcurrencyLimiter(config.MaxWatchesPerClient),
+		cases:            cases,
+	})
+	if config.Reflection {
+		reflection.Register(s)
+	}
+	return s
 }
 
 func main() {
 	langsTomlPath := flag.String("langs", "../langs/langs.toml", "toml path of langs.toml")
 	isGRPCWeb := flag.Bool("grpcweb", false, "launch gRPCWeb server")
 
-	pgHost := flag.String("pghost", "127.0.0.1", "postgre host")
-	pgHostSecret := flag.String("pghost-secret", "", "gcloud secret of postgre host")
-	pgPass := flag.String("pgpass", "passwd", "postgre password")
-	pgPassSecret := flag.String("pgpass-secret", "", "gcloud secret of postgre password")
+	pgHost := flag.String("pghost", "", "postgre host (env: POSTGRE_HOST)")
+	pgHostSecret := flag.String("pghost-secret", "", "gcloud secret of postgre host (env: POSTGRE_HOST_SECRET)")
+	pgPass := flag.String("pgpass", "", "postgre password (env: POSTGRE_PASS)")
+	pgPassSecret := flag.String("pgpass-secret", "", "gcloud secret of postgre password (env: POSTGRE_PASS_SECRET)")
+	pgPassRefresh := flag.Duration("pgpass-refresh", 0, "interval to re-fetch pgpass-secret, 0 means disabled (env: POSTGRE_PASS_REFRESH)")
 
 	hmacKey := flag.String("hmackey", "", "hmac key")
 	hmacKeySecret := flag.String("hmackey-secret", "", "gcloud secret of hmac key")
 
+	judgeToken := flag.String("judgetoken", "", "shared secret token of judges, empty means disabled (env: API_JUDGE_TOKEN)")
+	judgeTokenSecret := flag.String("judgetoken-secret", "", "gcloud secret of judge token (env: API_JUDGE_TOKEN_SECRET)")
+
 	portArg := flag.Int("port", -1, "port number")
+	isPublic := flag.Bool("public", false, "reject internal methods (e.g. judge RPCs) on -port (env: API_PUBLIC)")
+	internalPort := flag.Int("internal-port", -1, "port number of the internal gRPC server which serves all methods, -port becomes public if set")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, plaintext is used if empty")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	httpToken := flag.String("http-token", "", "bearer token to access the extra HTTP endpoints of the gRPC-web server, e.g. /metrics (env: API_HTTP_TOKEN)")
+	httpTokenSecret := flag.String("http-token-secret", "", "gcloud secret of http token (env: API_HTTP_TOKEN_SECRET)")
+	httpAllowlist := flag.String("http-allowlist", "", "comma separated IP addresses or CIDRs which can access the extra HTTP endpoints without the token (env: API_HTTP_ALLOWLIST)")
+	protectHealth := flag.Bool("protect-health", false, "protect /health by -http-token and -http-allowlist as well (env: API_PROTECT_HEALTH)")
+	allowedOrigins := flag.String("allowed-origins", "", "comma separated origins which can call gRPC-web, empty means any (env: API_ALLOWED_ORIGINS)")
+	caseDir := flag.String("casedir", "", "directory which has <testhash>.zip of the test cases, used instead of minio (env: API_CASE_DIR)")
+	minioHost := flag.String("miniohost", "", "minio host of the test cases (env: API_MINIO_HOST)")
+	minioID := flag.String("minioid", "", "minio ID (env: API_MINIO_ID)")
+	minioKey := flag.String("miniokey", "", "minio access key (env: API_MINIO_KEY)")
+	minioKeySecret := flag.String("miniokey-secret", "", "gcloud secret of minio access key (env: API_MINIO_KEY_SECRET)")
+	minioBucket := flag.String("miniobucket", "", "minio bucket of the test cases (env: API_MINIO_BUCKET)")
+	enableReflection := flag.Bool("reflection", false, "register gRPC reflection service, only for development (env: API_REFLECTION)")
 	flag.Parse()
 
+	defer closeSecretClient()
+
+	langs, err := ReadLangs(*langsTomlPath)
+	if err != nil {
+		log.Fatalf("invalid langs file(%s): %v", *langsTomlPath, err)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("both -tls-cert and -tls-key must be specified")
+	}
+	useTLS := *tlsCert != ""
+
 	port := getEnv("PORT", "50051")
 	if *portArg != -1 {
 		port = strconv.Itoa(*portArg)
 	}
 
 	// connect db
-	db := dbConnect(
-		getSecureString(*pgHostSecret, *pgHost),
-		getEnv("POSTGRE_PORT", "5432"),
-		"librarychecker",
-		getEnv("POSTGRE_USER", "postgres"),
-		getSecureString(*pgPassSecret, *pgPass),
-		getEnv("API_DB_LOG", "") != "")
+	dbConfig := loadDBConfig(DBConfigSource{
+		Host:        *pgHost,
+		HostSecret:  *pgHostSecret,
+		Pass:        *pgPass,
+		PassSecret:  *pgPassSecret,
+		PassRefresh: *pgPassRefresh,
+	})
+	if err := dbConfig.Validate(); err != nil {
+		log.Fatal("invalid db config: ", err)
+	}
+	password := func() string { return dbConfig.Password }
+	if dbConfig.PasswordRefresh > 0 {
+		password = NewRefreshingSecret(dbConfig.PasswordSecret, dbConfig.Password, dbConfig.PasswordRefresh).Get
+	}
+	db := dbConnectWithPassword(
+		dbConfig.Host,
+		dbConfig.Port,
+		dbConfig.DBName,
+		dbConfig.User,
+		password,
+		dbConfig.Log)
 	authTokenManager := NewAuthTokenManager(getSecureString(*hmacKeySecret, *hmacKey))
-	s := NewGRPCServer(db, authTokenManager, *langsTomlPath)
+	authTokenManager.SetJudgeToken(resolveSetting(
+		firstNonEmpty(*judgeTokenSecret, os.Getenv("API_JUDGE_TOKEN_SECRET")),
+		*judgeToken, "API_JUDGE_TOKEN", ""))
+	serverConfig := loadServerConfig()
+	if *enableReflection {
+		serverConfig.Reflection = true
+	}
+	if *isPublic || *internalPort != -1 {
+		serverConfig.Public = true
+	}
+	serverConfig.HTTPToken = resolveSetting(
+		firstNonEmpty(*httpTokenSecret, os.Getenv("API_HTTP_TOKEN_SECRET")),
+		*httpToken, "API_HTTP_TOKEN", "")
+	if *httpAllowlist != "" {
+		serverConfig.HTTPAllowlist = strings.Split(*httpAllowlist, ",")
+	}
+	if *protectHealth {
+		serverConfig.ProtectHealth = true
+	}
+	if *allowedOrigins != "" {
+		serverConfig.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+	}
+	if *caseDir != "" {
+		serverConfig.CaseDir = *caseDir
+	}
+	if *minioHost != "" {
+		serverConfig.MinioHost = *minioHost
+	}
+	if *minioID != "" {
+		serverConfig.MinioID = *minioID
+	}
+	serverConfig.MinioKey = resolveSetting(
+		firstNonEmpty(*minioKeySecret, os.Getenv("API_MINIO_KEY_SECRET")),
+		*minioKey, "API_MINIO_KEY", "")
+	if *minioBucket != "" {
+		serverConfig.MinioBucket = *minioBucket
+	}
+	if err := serverConfig.Validate(); err != nil {
+		log.Fatal("invalid server config: ", err)
+	}
+	var opts []grpc.ServerOption
+	if useTLS && !*isGRPCWeb {
+		creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal("failed to load TLS certificate: ", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s := NewGRPCServer(db, authTokenManager, langs, serverConfig, opts...)
+	if serverConfig.AnonymousSubmissionRetention > 0 {
+		StartAnonymousSubmissionCleanup(db, serverConfig)
+	}
+
+	if *internalPort != -1 {
+		internalConfig := serverConfig
+		internalConfig.Public = false
+		internal := NewGRPCServer(db, authTokenManager, langs, internalConfig, opts...)
+		health.RegisterHealthServer(internal, &healthHandler{})
+		listen, err := net.Listen("tcp", ":"+strconv.Itoa(*internalPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print("launch internal gRPC server port=", *internalPort, " tls=", useTLS)
+		go func() {
+			log.Fatal(internal.Serve(listen))
+		}()
+	}
 
+	log.Print("version: ", version)
 	if *isGRPCWeb {
-		log.Print("launch gRPCWeb server port=", port)
-		wrappedGrpc := grpcweb.WrapServer(s, grpcweb.WithOriginFunc(func(origin string) bool { return true }))
+		log.Print("launch gRPCWeb server port=", port, " tls=", useTLS)
+		wrappedGrpc := grpcweb.WrapServer(s, grpcweb.WithOriginFunc(newOriginFunc(serverConfig.AllowedOrigins)))
 		http.HandleFunc("/health", func(resp http.ResponseWriter, req *http.Request) {
 			io.WriteString(resp, "SERVING")
 		})
-		http.ListenAndServe(":"+port, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		guard, err := newHTTPGuard(serverConfig.HTTPToken, serverConfig.HTTPAllowlist, serverConfig.TrustedIPHeader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		guarded := guard.wrap(http.DefaultServeMux)
+		handler := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 			if wrappedGrpc.IsAcceptableGrpcCorsRequest(req) || wrappedGrpc.IsGrpcWebRequest(req) {
 				wrappedGrpc.ServeHTTP(resp, req)
 				return
 			}
-			http.DefaultServeMux.ServeHTTP(resp, req)
-		}))
+			if req.URL.Path == "/health" && !serverConfig.ProtectHealth {
+				http.DefaultServeMux.ServeHTTP(resp, req)
+				return
+			}
+			guarded.ServeHTTP(resp, req)
+		})
+		if useTLS {
+			log.Fatal(http.ListenAndServeTLS(":"+port, *tlsCert, *tlsKey, handler))
+		} else {
+			log.Fatal(http.ListenAndServe(":"+port, handler))
+		}
 	} else {
-		log.Print("launch gRPC server port=", port)
+		log.Print("launch gRPC server port=", port, " tls=", useTLS)
 		health.RegisterHealthServer(s, &healthHandler{})
 		listen, err := net.Listen("tcp", ":"+port)
 		if err != nil {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// rateLimiter allows at most limit events per key in a sliding window. It is local to each server.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+// rateLimiterSweepSize is the number of keys to start removing the expired keys
+const rateLimiterSweepSize = 10000
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// allow records an event of key at now and returns true, or returns false if key already reaches the limit
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	if r.limit <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rateLimiterSweepSize <= len(r.events) {
+		for k, events := range r.events {
+			if !events[len(events)-1].After(now.Add(-r.window)) {
+				delete(r.events, k)
+			}
+		}
+	}
+
+	events := r.events[key]
+	for len(events) > 0 && !events[0].After(now.Add(-r.window)) {
+		events = events[1:]
+	}
+	if r.limit <= len(events) {
+		r.events[key] = events
+		return false
+	}
+	r.events[key] = append(events, now)
+	return true
+}
+
+// concurrencyLimiter allows at most limit concurrent holders per key. It is local to each server.
+type concurrencyLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	counts map[string]int
+}
+
+func newConcurrencyLimiter(limit int) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		limit:  limit,
+		counts: make(map[string]int),
+	}
+}
+
+// acquire returns true if key has less than limit holders, and then release must be called later
+func (c *concurrencyLimiter) acquire(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limit > 0 && c.limit <= c.counts[key] {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+func (c *concurrencyLimiter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]--
+	if c.counts[key] <= 0 {
+		delete(c.counts, key)
+	}
+}
+
+// clientIP returns the IP address of the client, or "" if unknown.
+// If header (e.g. "x-forwarded-for") is not empty, the last address in it, which is appended by the trusted proxy, is used.
+func clientIP(ctx context.Context, header string) string {
+	if header != "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(header); len(values) > 0 {
+				addrs := strings.Split(values[len(values)-1], ",")
+				if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+					return addr
+				}
+			}
+		}
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// hashIP returns the keyed hash of ip, to store it without exposing the raw address
+func hashIP(key []byte, ip string) string {
+	if ip == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
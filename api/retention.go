@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+
+	pb "github.com/yosupo06/library-checker-judge/api/proto"
+)
+
+const (
+	// anonymousSubmissionDeleteBatch is the number of submissions deleted in a transaction
+	anonymousSubmissionDeleteBatch = 1000
+	// anonymousSubmissionDeleteLock is the key of the advisory lock held while deleting a batch,
+	// so that only one of the servers deletes anonymous submissions at a time
+	anonymousSubmissionDeleteLock = 0x616e6f6e // "anon"
+)
+
+var errAnonymousSubmissionDeleteRunning = status.Error(codes.Aborted, "anonymous submissions are being deleted by another server")
+
+// deleteAnonymousSubmissions deletes the anonymous submissions submitted before the time with their case results,
+// and returns the number of deleted submissions. Submissions in the queue or in judging are kept.
+// It stops with errAnonymousSubmissionDeleteRunning if another server is deleting them.
+func deleteAnonymousSubmissions(db *gorm.DB, before time.Time) (int64, error) {
+	deleted := int64(0)
+	for {
+		count := int64(0)
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			locked := false
+			if err := tx.Raw("select pg_try_advisory_xact_lock(?)", anonymousSubmissionDeleteLock).Scan(&locked).Error; err != nil {
+				log.Print(err)
+				return errors.New("failed to lock anonymous submissions")
+			}
+			if !locked {
+				return errAnonymousSubmissionDeleteRunning
+			}
+			var ids = make([]int32, 0)
+			if err := tx.Model(&Submission{}).
+				Where("user_name is null and submit_time < ? and judge_name = ''", before).
+				Where("not exists (select 1 from tasks where tasks.submission = submissions.id)").
+				Order("id asc").
+				Limit(anonymousSubmissionDeleteBatch).
+				Pluck("id", &ids).Error; err != nil {
+				log.Print(err)
+				return errors.New("failed to fetch anonymous submissions")
+			}
+			if len(ids) == 0 {
+				return nil
+			}
+			if err := tx.Where("submission in ?", ids).Delete(&SubmissionTestcaseResult{}).Error; err != nil {
+				log.Print(err)
+				return errors.New("failed to delete submission testcase results")
+			}
+			if err := tx.Where("submission in ?", ids).Delete(&Bookmark{}).Error; err != nil {
+				log.Print(err)
+				return errors.New("failed to delete bookmarks")
+			}
+			result := tx.Where("id in ?", ids).Delete(&Submission{})
+			if result.Error != nil {
+				log.Print(result.Error)
+				return errors.New("failed to delete submissions")
+			}
+			count = result.RowsAffected
+			return nil
+		}); err != nil {
+			return deleted, err
+		}
+		deleted += count
+		if count < anonymousSubmissionDeleteBatch {
+			return deleted, nil
+		}
+	}
+}
+
+// StartAnonymousSubmissionCleanup deletes the anonymous submissions older than AnonymousSubmissionRetention
+// every AnonymousSubmissionCleanupInterval, except during maintenance.
+// It may run on every server, but only one of them deletes at a time.
+func StartAnonymousSubmissionCleanup(db *gorm.DB, config ServerConfig) {
+	retention := config.AnonymousSubmissionRetention
+	go func() {
+		ticker := time.NewTicker(config.AnonymousSubmissionCleanupInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := checkWritable(db, config.Maintenance); err != nil {
+				continue
+			}
+			deleted, err := deleteAnonymousSubmissions(db, time.Now().Add(-retention))
+			if errors.Is(err, errAnonymousSubmissionDeleteRunning) {
+				continue
+			}
+			if err != nil {
+				log.Print("failed to delete anonymous submissions: ", err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("delete %v anonymous submissions older than %v", deleted, retention)
+			}
+		}
+	}()
+}
+
+func (s *server) DeleteAnonymousSubmissions(ctx context.Context, in *pb.DeleteAnonymousSubmissionsRequest) (*pb.DeleteAnonymousSubmissionsResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	retention := s.config.AnonymousSubmissionRetention
+	if in.OlderThan != nil {
+		retention = in.OlderThan.AsDuration()
+	}
+	if retention <= 0 {
+		return nil, errors.New("older_than must be positive if the retention is not configured")
+	}
+	deleted, err := deleteAnonymousSubmissions(s.db, time.Now().Add(-retention))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("delete %v anonymous submissions older than %v by %v", deleted, retention, currentUserName)
+	return &pb.DeleteAnonymousSubmissionsResponse{
+		Deleted: int32(deleted),
+	}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+const secretAccessTimeout = 30 * time.Second
+
+var (
+	secretClientMu sync.Mutex
+	secretClient   *secretmanager.Client
+)
+
+// getSecretClient returns the shared secretmanager client, creating it on first use
+func getSecretClient(ctx context.Context) (*secretmanager.Client, error) {
+	secretClientMu.Lock()
+	defer secretClientMu.Unlock()
+	if secretClient != nil {
+		return secretClient, nil
+	}
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secretClient = client
+	return secretClient, nil
+}
+
+func closeSecretClient() {
+	secretClientMu.Lock()
+	defer secretClientMu.Unlock()
+	if secretClient == nil {
+		return
+	}
+	if err := secretClient.Close(); err != nil {
+		log.Print("failed to close secretmanager client: ", err)
+	}
+	secretClient = nil
+}
+
+func accessSecretVersion(secureKey string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretAccessTimeout)
+	defer cancel()
+
+	client, err := getSecretClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	result, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: secureKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(result.Payload.Data), nil
+}
+
+func getSecureString(secureKey, defaultValue string) string {
+	if secureKey == "" {
+		if defaultValue == "" {
+			log.Fatal("both secureKey and defaultValue is empty")
+		}
+		return defaultValue
+	}
+
+	value, err := accessSecretVersion(secureKey)
+	if err != nil {
+		log.Fatalf("failed to access secret version: %v", err)
+	}
+	return value
+}
+
+// RefreshingSecret is a secret value which is re-fetched periodically
+type RefreshingSecret struct {
+	key   string
+	mu    sync.RWMutex
+	value string
+}
+
+// NewRefreshingSecret starts to refresh the secret(key) every interval. value is the initial value.
+func NewRefreshingSecret(key, value string, interval time.Duration) *RefreshingSecret {
+	s := &RefreshingSecret{
+		key:   key,
+		value: value,
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.refresh()
+		}
+	}()
+	return s
+}
+
+func (s *RefreshingSecret) refresh() {
+	value, err := accessSecretVersion(s.key)
+	if err != nil {
+		// keep the old value, it may still be valid
+		log.Print("failed to refresh secret: ", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.value != value {
+		log.Print("secret is rotated: ", s.key)
+	}
+	s.value = value
+}
+
+func (s *RefreshingSecret) Get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode"
+)
+
+const shingleSize = 4
+
+// tokenize splits source into identifiers, numbers and symbols (spaces and comments are not removed specially)
+func tokenize(source string) []string {
+	var tokens []string
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+func shingles(source string) map[string]struct{} {
+	tokens := tokenize(source)
+	result := make(map[string]struct{})
+	if len(tokens) < shingleSize {
+		if len(tokens) > 0 {
+			result[strings.Join(tokens, " ")] = struct{}{}
+		}
+		return result
+	}
+	for i := 0; i+shingleSize <= len(tokens); i++ {
+		result[strings.Join(tokens[i:i+shingleSize], " ")] = struct{}{}
+	}
+	return result
+}
+
+// sourceHash returns the hash of source to find byte-identical submissions, it must be same as the one in fillSourceHash
+func sourceHash(source string) string {
+	hash := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(hash[:])
+}
+
+// sourceSimilarity returns the jaccard index of token 4-grams of two sources (0.0: different, 1.0: same)
+func sourceSimilarity(a, b string) float64 {
+	return shinglesSimilarity(shingles(a), shingles(b))
+}
+
+func shinglesSimilarity(sa, sb map[string]struct{}) float64 {
+	if len(sa) == 0 && len(sb) == 0 {
+		return 1.0
+	}
+	common := 0
+	for s := range sa {
+		if _, ok := sb[s]; ok {
+			common++
+		}
+	}
+	return float64(common) / float64(len(sa)+len(sb)-common)
+}
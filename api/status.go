@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/yosupo06/library-checker-judge/api/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"gorm.io/gorm"
+)
+
+// version is injected at link time (-ldflags "-X main.version=...")
+var version = "dev"
+
+var startTime = time.Now()
+
+// supportedFeatures is the list of features which clients can use
+var supportedFeatures = []string{
+	"recent_submissions",
+	"first_ac_filter",
+	"problem_fastest_submissions",
+	"has_solved",
+	"lang_info",
+	"submission_note",
+	"plagiarism_scan",
+	"maintenance",
+}
+
+// verdictStatuses is the statuses of finished submissions reported by judges
+var verdictStatuses = []string{"AC", "WA", "RE", "TLE", "PE", "Fail", "ITLE", "CE", "ICE", "IE"}
+
+// pendingStatuses is the statuses of submissions which are in the queue or in judging.
+// draftStatus is not included, drafts are not finished but not judged until Rejudge.
+var pendingStatuses = []string{"WJ", "Fetching", "Compiling", "Executing"}
+
+// sort orders accepted by SubmissionList, ProblemList and ProblemFastestSubmissions ("" is the default of each)
+var (
+	submissionListOrders     = []string{"-id", "+time"}
+	problemListOrders        = []string{"name", "solvers_desc", "solvers_asc"}
+	fastestSubmissionsOrders = []string{"time", "memory"}
+)
+
+const (
+	maintenanceKey        = "maintenance"
+	maintenanceMessageKey = "maintenance_message"
+)
+
+// maintenanceStatus returns whether the server is in maintenance; forced (API_MAINTENANCE) overrides the stored state
+func maintenanceStatus(db *gorm.DB, forced bool) (bool, string) {
+	message, _ := fetchMetadata(db, maintenanceMessageKey)
+	if forced {
+		return true, message
+	}
+	value, err := fetchMetadata(db, maintenanceKey)
+	if err != nil {
+		return false, ""
+	}
+	return value == "true", message
+}
+
+// maintenanceError returns Unavailable error if the server is under maintenance
+func maintenanceError(maintenance bool, message string) error {
+	if !maintenance {
+		return nil
+	}
+	if message == "" {
+		message = "server is under maintenance"
+	}
+	return status.Error(codes.Unavailable, message)
+}
+
+// checkWritable returns Unavailable error if the server is under maintenance
+func checkWritable(db *gorm.DB, forced bool) error {
+	return maintenanceError(maintenanceStatus(db, forced))
+}
+
+// maintenanceCacheTTL is how long each server caches the maintenance state, not to read metadata on every write RPC.
+// ChangeMaintenance takes effect on the other servers after it.
+const maintenanceCacheTTL = 5 * time.Second
+
+type maintenanceCache struct {
+	mu          sync.Mutex
+	fetchedAt   time.Time
+	maintenance bool
+	message     string
+}
+
+func (s *server) maintenanceStatus() (bool, string) {
+	s.maintenanceCache.mu.Lock()
+	defer s.maintenanceCache.mu.Unlock()
+	if time.Since(s.maintenanceCache.fetchedAt) < maintenanceCacheTTL {
+		return s.maintenanceCache.maintenance, s.maintenanceCache.message
+	}
+	maintenance, message := maintenanceStatus(s.db, s.config.Maintenance)
+	s.maintenanceCache.fetchedAt = time.Now()
+	s.maintenanceCache.maintenance = maintenance
+	s.maintenanceCache.message = message
+	return maintenance, message
+}
+
+// checkWritable returns Unavailable error if the server is under maintenance, Submit, Rejudge and PopJudgeTask check it
+func (s *server) checkWritable() error {
+	return maintenanceError(s.maintenanceStatus())
+}
+
+func (s *server) ServerStatus(ctx context.Context, in *pb.ServerStatusRequest) (*pb.ServerStatusResponse, error) {
+	maintenance, message := s.maintenanceStatus()
+	return &pb.ServerStatusResponse{
+		Maintenance:        maintenance,
+		MaintenanceMessage: message,
+		Version:            version,
+		Uptime:             durationpb.New(time.Since(startTime)),
+		Features:           supportedFeatures,
+	}, nil
+}
+
+func (s *server) ServerMetadata(ctx context.Context, in *pb.ServerMetadataRequest) (*pb.ServerMetadataResponse, error) {
+	return &pb.ServerMetadataResponse{
+		Statuses:                 verdictStatuses,
+		PendingStatuses:          pendingStatuses,
+		SubmissionListOrders:     submissionListOrders,
+		ProblemListOrders:        problemListOrders,
+		FastestSubmissionsOrders: fastestSubmissionsOrders,
+		Langs:                    s.langs,
+	}, nil
+}
+
+func (s *server) ChangeMaintenance(ctx context.Context, in *pb.ChangeMaintenanceRequest) (*pb.ChangeMaintenanceResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	value := "false"
+	if in.Maintenance {
+		value = "true"
+	}
+	if err := setMetadata(s.db, maintenanceKey, value); err != nil {
+		return nil, err
+	}
+	if err := setMetadata(s.db, maintenanceMessageKey, in.Message); err != nil {
+		return nil, err
+	}
+	// takes effect on this server immediately
+	s.maintenanceCache.mu.Lock()
+	s.maintenanceCache.fetchedAt = time.Time{}
+	s.maintenanceCache.mu.Unlock()
+	return &pb.ChangeMaintenanceResponse{}, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v6"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/yosupo06/library-checker-judge/api/proto"
+)
+
+// caseDataMaxSize is the maximum size of each of the input and the output returned by ProblemCaseData
+const caseDataMaxSize = 1024 * 1024
+
+// caseStorage is where the test cases uploaded by the deploy script are stored.
+// Each testhash has <testhash>.zip which contains checker.cpp, in/<case>.in and out/<case>.out
+type caseStorage interface {
+	// open returns the zip of testhash, the closer must be closed after the reader is used
+	open(testhash string) (*zip.Reader, io.Closer, error)
+}
+
+var errCaseStorageNotConfigured = status.Error(codes.FailedPrecondition, "test case storage is not configured")
+
+// newCaseStorage returns the storage configured in config, or nil if not configured
+func newCaseStorage(config ServerConfig) (caseStorage, error) {
+	if config.CaseDir != "" {
+		return dirCaseStorage{dir: config.CaseDir}, nil
+	}
+	if config.MinioHost != "" {
+		client, err := minio.New(config.MinioHost, config.MinioID, config.MinioKey, config.MinioSecure)
+		if err != nil {
+			return nil, err
+		}
+		return minioCaseStorage{client: client, bucket: config.MinioBucket}, nil
+	}
+	return nil, nil
+}
+
+type minioCaseStorage struct {
+	client *minio.Client
+	bucket string
+}
+
+func (m minioCaseStorage) open(testhash string) (*zip.Reader, io.Closer, error) {
+	object, err := m.client.GetObject(m.bucket, testhash+".zip", minio.GetObjectOptions{})
+	if err != nil {
+		log.Print(err)
+		return nil, nil, errors.New("failed to fetch test cases")
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		log.Print(err)
+		return nil, nil, status.Error(codes.NotFound, "test cases are not found")
+	}
+	return openCaseZip(object, info.Size)
+}
+
+// dirCaseStorage reads <testhash>.zip from the local directory, e.g. for development
+type dirCaseStorage struct {
+	dir string
+}
+
+func (d dirCaseStorage) open(testhash string) (*zip.Reader, io.Closer, error) {
+	if testhash == "" || filepath.Base(testhash) != testhash {
+		return nil, nil, errors.New("invalid testhash")
+	}
+	file, err := os.Open(filepath.Join(d.dir, testhash+".zip"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, status.Error(codes.NotFound, "test cases are not found")
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, nil, errors.New("failed to fetch test cases")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		log.Print(err)
+		return nil, nil, errors.New("failed to fetch test cases")
+	}
+	return openCaseZip(file, info.Size())
+}
+
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+func openCaseZip(file readerAtCloser, size int64) (*zip.Reader, io.Closer, error) {
+	reader, err := zip.NewReader(file, size)
+	if err != nil {
+		file.Close()
+		log.Print(err)
+		return nil, nil, errors.New("broken test cases")
+	}
+	return reader, file, nil
+}
+
+// readCaseFile reads at most maxSize bytes of the file in the zip, and returns the data and the size of the whole file
+func readCaseFile(cases *zip.Reader, name string, maxSize int) ([]byte, int64, error) {
+	for _, file := range cases.File {
+		if file.Name != name {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			log.Print(err)
+			return nil, 0, errors.New("failed to read test case")
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)))
+		if err != nil {
+			log.Print(err)
+			return nil, 0, errors.New("failed to read test case")
+		}
+		return data, int64(file.UncompressedSize64), nil
+	}
+	return nil, 0, status.Errorf(codes.NotFound, "%v is not found", path.Base(name))
+}
+
+func (s *server) ProblemCaseData(ctx context.Context, in *pb.ProblemCaseDataRequest) (*pb.ProblemCaseDataResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	if in.Case == "" || path.Base(in.Case) != in.Case {
+		return nil, errors.New("invalid case name")
+	}
+	if s.cases == nil {
+		return nil, errCaseStorageNotConfigured
+	}
+	problem := Problem{}
+	if err := s.db.Select("name, testhash").Where("name = ?", in.Problem).Take(&problem).Error; err != nil {
+		return nil, errors.New("failed to get problem")
+	}
+	if problem.Testhash == "" {
+		return nil, status.Error(codes.NotFound, "test cases are not uploaded")
+	}
+
+	cases, closer, err := s.cases.open(problem.Testhash)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	input, inputSize, err := readCaseFile(cases, "in/"+in.Case+".in", caseDataMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	output, outputSize, err := readCaseFile(cases, "out/"+in.Case+".out", caseDataMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("case data is fetched by %v: %v %v", currentUserName, in.Problem, in.Case)
+	return &pb.ProblemCaseDataResponse{
+		CaseVersion: problem.Testhash,
+		Input:       input,
+		Output:      output,
+		InputSize:   inputSize,
+		OutputSize:  outputSize,
+	}, nil
+}
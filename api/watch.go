@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+
+	pb "github.com/yosupo06/library-checker-judge/api/proto"
+)
+
+const (
+	// interval to check the update of the watched submission
+	submissionWatchInterval = time.Second
+	// SubmissionInfoStream is closed after this duration even if the submission is not finished, clients should reconnect
+	submissionWatchMaxDuration = 10 * time.Minute
+	// default and maximum timeout of WaitSubmissionInfo
+	submissionWaitMaxTimeout = 30 * time.Second
+)
+
+// isPendingStatus returns whether the submission of status will be updated by judges
+func isPendingStatus(status string) bool {
+	for _, pending := range pendingStatuses {
+		if status == pending {
+			return true
+		}
+	}
+	return false
+}
+
+// submissionProgress is the part of the submission which is polled by the watchers, the full info is fetched only if it changes
+type submissionProgress struct {
+	Status          string
+	CaseResultCount int32
+}
+
+func fetchSubmissionProgress(db *gorm.DB, id int32) (submissionProgress, error) {
+	progress := submissionProgress{}
+	if err := db.Raw(
+		"select status, (select count(*) from submission_testcase_results where submission = submissions.id) as case_result_count from submissions where id = ?",
+		id).Scan(&progress).Error; err != nil {
+		log.Print(err)
+		return progress, errors.New("failed to fetch submission")
+	}
+	return progress, nil
+}
+
+var errTooManyWatches = status.Error(codes.ResourceExhausted, "too many submissions are watched at once")
+
+// acquireWatch reserves a watch of the caller, keyed by the user name or the IP address if not logged in.
+// Anonymous watches are not limited without TrustedIPHeader, because the peer address may be the proxy shared by all of them.
+// The returned function releases it.
+func (s *server) acquireWatch(ctx context.Context, currentUser User) (func(), error) {
+	key := "user:" + currentUser.Name
+	if currentUser.Name == "" {
+		if s.config.TrustedIPHeader == "" {
+			return func() {}, nil
+		}
+		key = "ip:" + clientIP(ctx, s.config.TrustedIPHeader)
+	}
+	if !s.watchLimiter.acquire(key) {
+		return nil, errTooManyWatches
+	}
+	return func() { s.watchLimiter.release(key) }, nil
+}
+
+// SubmissionInfoStream sends SubmissionInfoResponse every time the status or the number of case results changes until it is finished.
+// Server streaming is supported by the gRPC-web wrapper as well.
+func (s *server) SubmissionInfoStream(in *pb.SubmissionInfoRequest, stream pb.LibraryCheckerService_SubmissionInfoStreamServer) error {
+	ctx := stream.Context()
+	currentUser, _ := fetchUser(s.db, getCurrentUserName(ctx))
+	release, err := s.acquireWatch(ctx, currentUser)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	deadline := time.Now().Add(submissionWatchMaxDuration)
+	var prev *pb.SubmissionInfoResponse
+	var prevProgress submissionProgress
+	for {
+		progress, err := fetchSubmissionProgress(s.db, in.Id)
+		if err != nil {
+			return err
+		}
+		if prev == nil || progress != prevProgress {
+			// the full info also checks the permission to see the submission
+			res, err := s.submissionInfo(ctx, currentUser, in)
+			if err != nil {
+				return err
+			}
+			if prev == nil || !proto.Equal(prev, res) {
+				if err := stream.Send(res); err != nil {
+					return err
+				}
+				prev = res
+			}
+			prevProgress = progress
+		}
+		if !isPendingStatus(prev.Overview.Status) || time.Now().After(deadline) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(submissionWatchInterval):
+		}
+	}
+}
+
+// WaitSubmissionInfo is the long-poll version of SubmissionInfoStream, for clients which cannot consume server streaming
+func (s *server) WaitSubmissionInfo(ctx context.Context, in *pb.WaitSubmissionInfoRequest) (*pb.WaitSubmissionInfoResponse, error) {
+	timeout := submissionWaitMaxTimeout
+	if in.Timeout != nil {
+		if in.Timeout.AsDuration() < 0 {
+			return nil, errors.New("negative timeout")
+		}
+		if in.Timeout.AsDuration() < timeout {
+			timeout = in.Timeout.AsDuration()
+		}
+	}
+	currentUser, _ := fetchUser(s.db, getCurrentUserName(ctx))
+	release, err := s.acquireWatch(ctx, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	req := &pb.SubmissionInfoRequest{
+		Id:          in.Id,
+		SourceLimit: in.SourceLimit,
+	}
+	known := submissionProgress{
+		Status:          in.Status,
+		CaseResultCount: in.CaseResultCount,
+	}
+	deadline := time.Now().Add(timeout)
+	// the full info also checks the permission to see the submission
+	res, err := s.submissionInfo(ctx, currentUser, req)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if res.Overview.Status != known.Status || len(res.CaseResults) != int(known.CaseResultCount) {
+			return &pb.WaitSubmissionInfoResponse{
+				Info:    res,
+				Changed: true,
+			}, nil
+		}
+		if !isPendingStatus(res.Overview.Status) || !time.Now().Add(submissionWatchInterval).Before(deadline) {
+			return &pb.WaitSubmissionInfoResponse{
+				Info: res,
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(submissionWatchInterval):
+		}
+		progress, err := fetchSubmissionProgress(s.db, in.Id)
+		if err != nil {
+			return nil, err
+		}
+		if progress != known {
+			if res, err = s.submissionInfo(ctx, currentUser, req); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	pb "github.com/yosupo06/library-checker-judge/api/proto"
+	"gorm.io/gorm"
+)
+
+const webhooksKey = "webhooks"
+
+const (
+	webhookTimeout    = 5 * time.Second
+	webhookRetry      = 1
+	webhookRetryDelay = 3 * time.Second
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// WebhookPayload is POSTed to each webhook when a submission is finished
+type WebhookPayload struct {
+	ID      int32  `json:"id"`
+	User    string `json:"user"`
+	Problem string `json:"problem"`
+	Status  string `json:"status"`
+}
+
+func fetchWebhooks(db *gorm.DB) ([]string, error) {
+	data, err := fetchMetadata(db, webhooksKey)
+	if err != nil {
+		// not configured
+		return nil, nil
+	}
+	var urls []string
+	if err := json.Unmarshal([]byte(data), &urls); err != nil {
+		log.Print(err)
+		return nil, errors.New("broken webhooks metadata")
+	}
+	return urls, nil
+}
+
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %v", rawURL)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url must be http(s): %v", rawURL)
+	}
+	return nil
+}
+
+func postWebhook(rawURL string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returns %v", resp.Status)
+	}
+	return nil
+}
+
+// notifyWebhooks sends payload to urls in background. Delivery is best-effort.
+func notifyWebhooks(urls []string, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, rawURL := range urls {
+		go func(rawURL string) {
+			for i := 0; i <= webhookRetry; i++ {
+				if i > 0 {
+					time.Sleep(webhookRetryDelay)
+				}
+				err := postWebhook(rawURL, body)
+				if err == nil {
+					return
+				}
+				log.Printf("webhook %v failed %d/%d: %v", rawURL, i+1, webhookRetry+1, err)
+			}
+		}(rawURL)
+	}
+}
+
+// notifyFinished notifies webhooks that the submission is finished
+func (s *server) notifyFinished(id int32) {
+	urls, err := fetchWebhooks(s.db)
+	if err != nil || len(urls) == 0 {
+		return
+	}
+	sub := Submission{}
+	if err := s.db.Select("id, user_name, problem_name, status").Where("id = ?", id).Take(&sub).Error; err != nil {
+		log.Print(err)
+		return
+	}
+	notifyWebhooks(urls, WebhookPayload{
+		ID:      sub.ID,
+		User:    sub.UserName.String,
+		Problem: sub.ProblemName,
+		Status:  sub.Status,
+	})
+}
+
+func (s *server) Webhooks(ctx context.Context, in *pb.WebhooksRequest) (*pb.WebhooksResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	urls, err := fetchWebhooks(s.db)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.WebhooksResponse{
+		Urls: urls,
+	}, nil
+}
+
+func (s *server) ChangeWebhooks(ctx context.Context, in *pb.ChangeWebhooksRequest) (*pb.ChangeWebhooksResponse, error) {
+	currentUserName := getCurrentUserName(ctx)
+	currentUser, _ := fetchUser(s.db, currentUserName)
+	if !currentUser.Admin {
+		return nil, permissionError(currentUser)
+	}
+	urls := make([]string, 0)
+	for _, rawURL := range in.Urls {
+		if err := validateWebhookURL(rawURL); err != nil {
+			return nil, err
+		}
+		urls = append(urls, rawURL)
+	}
+	data, err := json.Marshal(urls)
+	if err != nil {
+		return nil, err
+	}
+	if err := setMetadata(s.db, webhooksKey, string(data)); err != nil {
+		return nil, err
+	}
+	return &pb.ChangeWebhooksResponse{}, nil
+}
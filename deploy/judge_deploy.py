@@ -14,6 +14,8 @@ from create_instance import create_instance, run_in_instance, send_file
 logger: Logger = getLogger(__name__)
 
 def build_judge():
+    # the judge is built with ../api, whose protoc outputs are not committed
+    run(['./gen_protoc.sh'], check=True, cwd='../api')
     args = ['go', 'build', '../judge']
     run(args, check=True, cwd='../judge')
 
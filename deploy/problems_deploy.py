@@ -147,10 +147,12 @@ if __name__ == "__main__":
         first_time = "FirstTime"
 
         try:
-            old_version = stub.ProblemInfo(libpb.ProblemInfoRequest(
-                name=name), credentials=cred_token).case_version
+            old_info = stub.ProblemInfo(libpb.ProblemInfoRequest(
+                name=name), credentials=cred_token)
+            old_version = old_info.case_version
         except grpc.RpcError as err:
             if err.code() == grpc.StatusCode.UNKNOWN:
+                old_info = libpb.ProblemInfoResponse()
                 old_version = first_time
             else:
                 raise RuntimeError('Unknown gRPC error')
@@ -165,7 +167,12 @@ if __name__ == "__main__":
             probdir.parent.name,
             probdir.name
         )
+        solution_url = source_url + '/sol/correct.cpp'
+        checker_url = source_url + '/checker.cpp'
+        generator_url = source_url + '/gen'
         timelimit = problem.config['timelimit']
+        case_count = len(list(probdir.glob('in/*.in')))
+        author = problem.config.get('author', '')
 
         if new_version != old_version:
             with tempfile.NamedTemporaryFile(suffix='.zip', delete=False) as tmp:
@@ -187,5 +194,8 @@ if __name__ == "__main__":
         html = problem.gen_html()
         statement = html.statement
         stub.ChangeProblemInfo(libpb.ChangeProblemInfoRequest(
-            name=name, title=title, statement=statement, time_limit=timelimit, case_version=new_version, source_url=source_url
+            name=name, title=title, statement=statement, time_limit=timelimit, case_version=new_version, source_url=source_url,
+            solution_url=solution_url, checker_url=checker_url, generator_url=generator_url, case_count=case_count,
+            author=author, statement_format='html', excluded_langs=old_info.excluded_langs,
+            editorial_url=old_info.editorial_url, template=old_info.template
         ), credentials=cred_token)
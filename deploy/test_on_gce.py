@@ -14,6 +14,8 @@ from create_instance import create_instance, delete_instance, run_in_instance, s
 logger: Logger = getLogger(__name__)
 
 def build_judge():
+    # the judge is built with ../api, whose protoc outputs are not committed
+    run(['./gen_protoc.sh'], check=True, cwd='../api')
     args = ['go', 'test', '-c']
     run(args, check=True, cwd='../judge')
 
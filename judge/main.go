@@ -10,7 +10,10 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	_ "github.com/lib/pq"
 	"github.com/yosupo06/library-checker-judge/api/clientutil"
@@ -24,9 +27,19 @@ import (
 var client pb.LibraryCheckerServiceClient
 var judgeName string
 var judgeCtx context.Context
+
+// registerCtx is authenticated by the shared judge token or the login, which is used only to register the judge
+var registerCtx context.Context
+var judgeTokenExpiry time.Time
+
+// judgeTokenRenewMargin is the time before the expiry to register again and renew judgeCtx
+const judgeTokenRenewMargin = time.Hour
+
 var testCaseFetcher TestCaseFetcher
 
-func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
+// execJudge judges the submission claimed by the task taskID against caseVersion, or the current test cases of the problem if it is empty.
+// If retryCompile is set, the cached test cases, which include the checker, are discarded and fetched again before compiling.
+func execJudge(judgedir, testlibPath string, submissionID, taskID int32, caseVersion string, retryCompile bool) (err error) {
 	submission, err := client.SubmissionInfo(judgeCtx, &pb.SubmissionInfoRequest{
 		Id: submissionID,
 	})
@@ -42,12 +55,21 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
 		JudgeName:    judgeName,
 		SubmissionId: submissionID,
+		TaskId:       taskID,
 		Status:       "Fetching",
 	}); err != nil {
 		return err
 	}
 
-	caseVersion := problem.CaseVersion
+	if caseVersion == "" {
+		caseVersion = problem.CaseVersion
+	}
+	if retryCompile {
+		log.Print("Retry compile, discard the cached test cases: ", caseVersion)
+		if err := testCaseFetcher.Discard(caseVersion); err != nil {
+			return err
+		}
+	}
 	testCases, err := testCaseFetcher.Fetch(submission.Overview.ProblemName, caseVersion)
 	log.Print("Fetched :", caseVersion)
 	if err != nil {
@@ -67,6 +89,7 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 			client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
 				JudgeName:    judgeName,
 				SubmissionId: submissionID,
+				TaskId:       taskID,
 				Status:       "IE",
 				CaseVersion:  caseVersion,
 			})
@@ -76,6 +99,7 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
 		JudgeName:    judgeName,
 		SubmissionId: submissionID,
+		TaskId:       taskID,
 		Status:       "Compiling",
 	}); err != nil {
 		return err
@@ -98,6 +122,7 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 		if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
 			JudgeName:    judgeName,
 			SubmissionId: submissionID,
+			TaskId:       taskID,
 			Status:       "ICE",
 			CaseVersion:  caseVersion,
 		}); err != nil {
@@ -127,12 +152,18 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 	if err != nil {
 		return err
 	}
+	// this judge always compiles the source from scratch
+	compileCache := pb.CompileCacheStatus_COMPILE_CACHE_MISS
+	compileTime := durationpb.New(result.Time)
 	if result.ExitCode != 0 {
 		if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
 			JudgeName:    judgeName,
 			SubmissionId: submissionID,
+			TaskId:       taskID,
 			CompileError: compileError,
 			Status:       "CE",
+			CompileCache: compileCache,
+			CompileTime:  compileTime,
 		}); err != nil {
 			return err
 		}
@@ -140,6 +171,7 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 		if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
 			JudgeName:    judgeName,
 			SubmissionId: submissionID,
+			TaskId:       taskID,
 			CaseVersion:  caseVersion,
 		}); err != nil {
 			return err
@@ -149,7 +181,10 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 	if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
 		JudgeName:    judgeName,
 		SubmissionId: submissionID,
+		TaskId:       taskID,
 		Status:       "Executing",
+		CompileCache: compileCache,
+		CompileTime:  compileTime,
 	}); err != nil {
 		return err
 	}
@@ -172,6 +207,7 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 		if _, err = client.SyncJudgeTaskStatus(judgeCtx, &pb.SyncJudgeTaskStatusRequest{
 			JudgeName:    judgeName,
 			SubmissionId: submissionID,
+			TaskId:       taskID,
 			Status:       "Executing",
 			CaseResults:  cases,
 		}); err != nil {
@@ -220,6 +256,7 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 	if _, err = client.FinishJudgeTask(judgeCtx, &pb.FinishJudgeTaskRequest{
 		JudgeName:    judgeName,
 		SubmissionId: submissionID,
+		TaskId:       taskID,
 		Status:       caseResult.Status,
 		Time:         caseResult.Time.Seconds(),
 		Memory:       int64(caseResult.Memory),
@@ -230,24 +267,55 @@ func execJudge(judgedir, testlibPath string, submissionID int32) (err error) {
 	return nil
 }
 
-func initClient(conn *grpc.ClientConn, apiUser, apiPassword string) {
+// initClient logins to API server, or uses judgeToken instead if it is not empty, and registers the judge
+func initClient(conn *grpc.ClientConn, apiUser, apiPassword, judgeToken string) {
 	client = pb.NewLibraryCheckerServiceClient(conn)
 	ctx := context.Background()
-	resp, err := client.Login(ctx, &pb.LoginRequest{
-		Name:     apiUser,
-		Password: apiPassword,
-	})
+	if judgeToken != "" {
+		log.Print("Use judge token")
+		registerCtx = clientutil.ContextWithToken(ctx, judgeToken)
+	} else {
+		resp, err := client.Login(ctx, &pb.LoginRequest{
+			Name:     apiUser,
+			Password: apiPassword,
+		})
 
-	if err != nil {
-		log.Fatal("Cannot login to API Server:", err)
+		if err != nil {
+			log.Fatal("Cannot login to API Server:", err)
+		}
+		registerCtx = clientutil.ContextWithToken(ctx, resp.Token)
 	}
-	judgeCtx = clientutil.ContextWithToken(ctx, resp.Token)
 
+	var err error
 	judgeName, err = os.Hostname()
 	if err != nil {
 		log.Fatal("Cannot get hostname:", err)
 	}
 	log.Print("JudgeName: ", judgeName)
+	if err := registerJudge(); err != nil {
+		log.Fatal("Cannot register judge:", err)
+	}
+}
+
+// registerJudge registers this judge, and sets judgeCtx to the token which can act only as this judge.
+// If the API server does not support RegisterJudge, judgeCtx falls back to registerCtx.
+func registerJudge() error {
+	resp, err := client.RegisterJudge(registerCtx, &pb.RegisterJudgeRequest{
+		Name: judgeName,
+	})
+	if status.Code(err) == codes.Unimplemented {
+		log.Print("RegisterJudge is not supported, use the shared token: ", err)
+		judgeCtx = registerCtx
+		// register again an hour later, in case the API server is updated
+		judgeTokenExpiry = time.Now().Add(judgeTokenRenewMargin + time.Hour)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	judgeCtx = clientutil.ContextWithToken(context.Background(), resp.Token)
+	judgeTokenExpiry = resp.ExpiresAt.AsTime()
+	return nil
 }
 
 func apiConnect(apiHost string, useTLS bool) *grpc.ClientConn {
@@ -329,6 +397,9 @@ func main() {
 	apiPass := flag.String("apipass", "password", "api password")
 	apiPassSecret := flag.String("apipass-secret", "", "gcloud secret of api password")
 
+	judgeToken := flag.String("judgetoken", "", "judge token of api, used instead of apiuser/apipass")
+	judgeTokenSecret := flag.String("judgetoken-secret", "", "gcloud secret of judge token")
+
 	flag.Parse()
 
 	ReadLangs(*langsTomlPath)
@@ -338,7 +409,11 @@ func main() {
 	// init gRPC
 	conn := apiConnect(*apiHost, *prod)
 	defer conn.Close()
-	initClient(conn, *apiUser, getSecureString(*apiPassSecret, *apiPass))
+	if *judgeToken != "" || *judgeTokenSecret != "" {
+		initClient(conn, "", "", getSecureString(*judgeTokenSecret, *judgeToken))
+	} else {
+		initClient(conn, *apiUser, getSecureString(*apiPassSecret, *apiPass), "")
+	}
 
 	testCaseFetcher, err = NewTestCaseFetcher(
 		getSecureString(*minioHostSecret, *minioHost),
@@ -354,6 +429,13 @@ func main() {
 
 	log.Println("Start Pooling")
 	for {
+		if time.Until(judgeTokenExpiry) < judgeTokenRenewMargin {
+			if err := registerJudge(); err != nil {
+				time.Sleep(3 * time.Second)
+				log.Print("RegisterJudge error: ", err)
+				continue
+			}
+		}
 		task, err := client.PopJudgeTask(judgeCtx, &pb.PopJudgeTaskRequest{
 			JudgeName: judgeName,
 		})
@@ -367,7 +449,7 @@ func main() {
 			continue
 		}
 		log.Println("Start Judge:", task.SubmissionId)
-		err = execJudge(*judgedir, *testlibPath, task.SubmissionId)
+		err = execJudge(*judgedir, *testlibPath, task.SubmissionId, task.TaskId, task.CaseVersion, task.RetryCompile)
 		if err != nil {
 			log.Println(err.Error())
 			continue
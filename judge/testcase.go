@@ -60,6 +60,17 @@ func (t *TestCaseFetcher) Close() error {
 	return nil
 }
 
+// Discard removes the cached test cases of the version, which are fetched again by the next Fetch
+func (t *TestCaseFetcher) Discard(version string) error {
+	if err := os.RemoveAll(path.Join(t.casesDir, fmt.Sprintf("cases-%s.zip", version))); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path.Join(t.casesDir, fmt.Sprintf("cases-%s", version))); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (t *TestCaseFetcher) Fetch(problem string, version string) (TestCaseDir, error) {
 	zipPath := path.Join(t.casesDir, fmt.Sprintf("cases-%s.zip", version))
 	dataPath := path.Join(t.casesDir, fmt.Sprintf("cases-%s", version))